@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// changePasswordHandler replaces the logged-in user's password after checking the current
+// one and ends the user's other sessions. Wrong current passwords count towards the login
+// lockout, so the form can't be used to guess them either. Mount it behind requireAuth.
+func changePasswordHandler(response http.ResponseWriter, request *http.Request) {
+	userName := authUser(request)
+	if sessionExpired(request) {
+		http.Error(response, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		http.Error(response, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	oldPassword := request.FormValue("old_password")
+	newPassword := request.FormValue("new_password")
+	if remaining, locked := accountLockedFor(request.Context(), userName); locked {
+		setRetryAfter(response, remaining)
+		http.Error(response, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if !verifyCredentials(request.Context(), userName, oldPassword) {
+		recordLoginFailure(request.Context(), userName)
+		http.Error(response, "current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if err := validateNewPassword(newPassword); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to hash password", "error", err)
+		http.Error(response, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if err := store.UpdatePassword(request.Context(), userName, hash); err != nil {
+		requestLogger(request.Context()).Error("failed to update password", "user", userName, "error", err)
+		http.Error(response, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+	// whoever knew the old password may be logged in elsewhere; only this session stays
+	if err := store.ClearSessions(request.Context(), userName); err != nil {
+		requestLogger(request.Context()).Error("failed to end sessions", "user", userName, "error", err)
+		http.Error(response, "password changed, but other sessions could not be ended", http.StatusInternalServerError)
+		return
+	}
+	if err := renewSession(response, request); err != nil {
+		requestLogger(request.Context()).Error("failed to renew session", "user", userName, "error", err)
+	}
+
+	audit(request, auditPasswordChange, userName, "")
+	fmt.Fprint(response, "<h1>Password changed</h1><a href=\"/internal\">Back</a>")
+}
+
+// deleteAccountHandler removes the logged-in user's account after re-checking the password;
+// mount it behind requireAuth
+func deleteAccountHandler(response http.ResponseWriter, request *http.Request) {
+	userName := authUser(request)
+	if sessionExpired(request) {
+		http.Error(response, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		http.Error(response, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !verifyCredentials(request.Context(), userName, request.FormValue("password")) {
+		http.Error(response, "password is incorrect", http.StatusForbidden)
+		return
+	}
+	if err := store.DeleteUser(request.Context(), userName); err != nil {
+		requestLogger(request.Context()).Error("failed to delete account", "user", userName, "error", err)
+		http.Error(response, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	destroySession(response, request)
+	http.Redirect(response, request, "/", http.StatusFound)
+}
+
+// authUserHeader names the response header /auth/validate puts the username in, for
+// proxies to pass downstream; empty leaves it out
+var authUserHeader = "X-Auth-User"
+
+// authValidateHandler answers 200 for a live session and 401 otherwise, without a body,
+// for reverse proxy subrequests (nginx auth_request, Traefik forward-auth)
+func authValidateHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Cache-Control", "no-store")
+	userName := getUserName(request)
+	if userName == "" || sessionExpired(request) {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if authUserHeader != "" {
+		response.Header().Set(authUserHeader, userName)
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+// meHandler returns the logged-in user as JSON; mount it behind requireAuth
+func meHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, map[string]string{"username": authUser(request)})
+}
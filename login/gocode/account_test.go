@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postChangePassword submits the change-password form with an optional session cookie
+func postChangePassword(t *testing.T, cookie *http.Cookie, oldPassword string, newPassword string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	form.Add("old_password", oldPassword)
+	form.Add("new_password", newPassword)
+	req := httptest.NewRequest("POST", "/change-password", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestChangePasswordHappyPath(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "oldpass123"})
+	useMemoryUserStore(t, store)
+
+	rr := postChangePassword(t, sessionCookieFor(t, "bob", roleUser), "oldpass123", "newpass456")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	stored, _ := store.FindUser(context.Background(), "bob")
+	if stored.Password == "newpass456" {
+		t.Error("new password should be stored hashed")
+	}
+	if !verifyCredentials(context.Background(), "bob", "newpass456") {
+		t.Error("new password should authenticate")
+	}
+	if verifyCredentials(context.Background(), "bob", "oldpass123") {
+		t.Error("old password should no longer authenticate")
+	}
+}
+
+func TestChangePasswordWrongOldPassword(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "oldpass123"}))
+
+	rr := postChangePassword(t, sessionCookieFor(t, "bob", roleUser), "notmypass1", "newpass456")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a wrong current password, got %d", rr.Code)
+	}
+	if !verifyCredentials(context.Background(), "bob", "oldpass123") {
+		t.Error("password should be unchanged after a failed attempt")
+	}
+}
+
+func TestChangePasswordWeakNewPassword(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "oldpass123"}))
+
+	rr := postChangePassword(t, sessionCookieFor(t, "bob", roleUser), "oldpass123", "weak")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a weak new password, got %d", rr.Code)
+	}
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	fake := useFakeClock(t)
+	app := newTestApp(t, User{Username: "bob", Password: "oldpass123"})
+	other := app.loginCookie("bob", "oldpass123")
+	current := app.loginCookie("bob", "oldpass123")
+	fake.Advance(time.Second)
+
+	rr := app.postForm("/change-password", url.Values{"old_password": {"oldpass123"}, "new_password": {"newpass456"}}, current)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.get("/internal", app.sessionCookieOf(rr)); rr.Code != http.StatusOK {
+		t.Errorf("the session that changed the password should go on, got %d", rr.Code)
+	}
+	if rr := app.get("/internal", other); rr.Code != http.StatusFound {
+		t.Errorf("other sessions should be ended by the change, got %d", rr.Code)
+	}
+}
+
+func TestChangePasswordCountsTowardsLockout(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob", Password: "oldpass123"})
+	cookie := app.loginCookie("bob", "oldpass123")
+	change := func(oldPassword string) *httptest.ResponseRecorder {
+		return app.postForm("/change-password", url.Values{"old_password": {oldPassword}, "new_password": {"newpass456"}}, cookie)
+	}
+
+	for i := 0; i < maxFailedLogins; i++ {
+		if rr := change("notmypass1"); rr.Code != http.StatusForbidden {
+			t.Fatalf("attempt %d: expected 403 for a wrong current password, got %d", i+1, rr.Code)
+		}
+	}
+	rr := change("oldpass123")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After once locked, got %d %v", rr.Code, rr.Header())
+	}
+	if !verifyCredentials(context.Background(), "bob", "oldpass123") {
+		t.Error("password should be unchanged while locked")
+	}
+	if rr := app.login("bob", "oldpass123"); rr.Code == http.StatusFound {
+		t.Error("the lockout should apply to logging in too")
+	}
+}
+
+func TestChangePasswordNoSession(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "oldpass123"}))
+
+	rr := postChangePassword(t, nil, "oldpass123", "newpass456")
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to / without a session, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if !verifyCredentials(context.Background(), "bob", "oldpass123") {
+		t.Error("password should be unchanged without a session")
+	}
+}
+
+func getMe(cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/me", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMeWithSession(t *testing.T) {
+	rr := getMe(sessionCookieFor(t, "bob", roleUser))
+
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"username":"bob"}` {
+		t.Errorf("expected bob, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store, no-cache" {
+		t.Errorf("expected Cache-Control no-store, no-cache, got %q", cacheControl)
+	}
+}
+
+func TestMeWithoutValidSession(t *testing.T) {
+	for name, cookie := range map[string]*http.Cookie{
+		"no cookie":      nil,
+		"invalid cookie": encodeWithUnknownKey(t, "bob"),
+	} {
+		rr := getMe(cookie)
+		if rr.Code != http.StatusUnauthorized || strings.TrimSpace(rr.Body.String()) != `{"error":{"code":"unauthenticated","message":"authentication required"}}` {
+			t.Errorf("%s: expected 401 unauthenticated, got %d: %s", name, rr.Code, rr.Body.String())
+		}
+		if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("%s: expected Cache-Control no-store, got %q", name, cacheControl)
+		}
+	}
+}
+
+// postDeleteAccount submits the delete-account form with an optional session cookie
+func postDeleteAccount(cookie *http.Cookie, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/delete-account", strings.NewReader(url.Values{"password": {pass}}.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestDeleteAccountHappyPath(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+	useMemoryUserStore(t, store)
+
+	rr := postDeleteAccount(sessionCookieFor(t, "bob", roleUser), "secret")
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/" {
+		t.Fatalf("expected redirect to /, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, err := store.FindUser(context.Background(), "bob"); err != errUserNotFound {
+		t.Errorf("account should be deleted, got %v", err)
+	}
+	cleared := false
+	for _, cookie := range rr.Result().Cookies() {
+		cleared = cleared || (cookie.Name == sessionCookieName && cookie.MaxAge < 0)
+	}
+	if !cleared {
+		t.Error("session cookie should be cleared")
+	}
+}
+
+func TestDeleteAccountWrongPassword(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+	useMemoryUserStore(t, store)
+
+	if rr := postDeleteAccount(sessionCookieFor(t, "bob", roleUser), "wrong"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a wrong password, got %d", rr.Code)
+	}
+	if _, err := store.FindUser(context.Background(), "bob"); err != nil {
+		t.Errorf("account should be kept after a wrong password, got %v", err)
+	}
+}
+
+func TestDeleteAccountUnauthenticated(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+	useMemoryUserStore(t, store)
+
+	if rr := postDeleteAccount(nil, "secret"); rr.Code != http.StatusFound || rr.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to / without a session, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, err := store.FindUser(context.Background(), "bob"); err != nil {
+		t.Errorf("account should be kept without a session, got %v", err)
+	}
+}
+
+func TestDeleteAccountWithoutDatabase(t *testing.T) {
+	originalCollection := currentUsersCollection()
+	setUsersCollection(nil)
+	defer func() { setUsersCollection(originalCollection) }()
+	useMemoryUserStore(t, nil)
+
+	if rr := postDeleteAccount(sessionCookieFor(t, username, roleAdmin), password); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a database, got %d", rr.Code)
+	}
+}
+
+func getAuthValidate(cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth/validate", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthValidateWithSession(t *testing.T) {
+	rr := getAuthValidate(sessionCookieFor(t, "bob", roleUser))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty 200, got %d: %q", rr.Code, rr.Body.String())
+	}
+	if user := rr.Header().Get("X-Auth-User"); user != "bob" {
+		t.Errorf("expected X-Auth-User bob, got %q", user)
+	}
+}
+
+func TestAuthValidateWithoutValidSession(t *testing.T) {
+	for name, cookie := range map[string]*http.Cookie{
+		"no cookie":      nil,
+		"invalid cookie": encodeWithUnknownKey(t, "bob"),
+	} {
+		rr := getAuthValidate(cookie)
+		if rr.Code != http.StatusUnauthorized || rr.Body.Len() != 0 {
+			t.Errorf("%s: expected an empty 401, got %d: %q", name, rr.Code, rr.Body.String())
+		}
+		if user := rr.Header().Get("X-Auth-User"); user != "" {
+			t.Errorf("%s: no user header should be set, got %q", name, user)
+		}
+	}
+}
+
+func TestAuthValidateUserHeaderDisabled(t *testing.T) {
+	original := authUserHeader
+	authUserHeader = ""
+	defer func() { authUserHeader = original }()
+
+	rr := getAuthValidate(sessionCookieFor(t, "bob", roleUser))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Auth-User") != "" {
+		t.Errorf("expected 200 without X-Auth-User, got %d %q", rr.Code, rr.Header().Get("X-Auth-User"))
+	}
+}
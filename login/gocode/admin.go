@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /users page sizes: the default when ?limit= is absent, and the cap on what clients ask for
+var usersPageDefaultLimit int64 = 50
+var usersPageMaxLimit int64 = 500
+
+// usersListResponse is the JSON body returned by GET /users
+type usersListResponse struct {
+	Usernames []string `json:"usernames"`
+	Total     int64    `json:"total"`
+	Offset    int64    `json:"offset"`
+	Limit     int64    `json:"limit"`
+	Note      string   `json:"note,omitempty"`
+}
+
+// pageParam parses a non-negative integer query parameter, returning def when it is absent
+func pageParam(request *http.Request, key string, def int64) (int64, error) {
+	value := request.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return parsed, nil
+}
+
+// usersHandler lists a page of registered usernames (never passwords) selected by
+// ?offset= and ?limit=; mount it behind requireAdmin
+func usersHandler(response http.ResponseWriter, request *http.Request) {
+	offset, err := pageParam(request, "offset", 0)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := pageParam(request, "limit", usersPageDefaultLimit)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > usersPageMaxLimit {
+		limit = usersPageMaxLimit
+	}
+
+	body := usersListResponse{Usernames: []string{}, Offset: offset, Limit: limit}
+	store := currentUserStore()
+	if store == nil {
+		body.Note = "no database connection; only the hardcoded credentials exist"
+	} else {
+		usernames, total, err := store.ListUsernamesPage(request.Context(), offset, limit)
+		if err != nil {
+			requestLogger(request.Context()).Error("failed to list users", "error", err)
+			http.Error(response, "failed to list users", http.StatusInternalServerError)
+			return
+		}
+		body.Usernames = append(body.Usernames, usernames...)
+		body.Total = total
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(body)
+}
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	return role == roleUser || role == roleAdmin
+}
+
+// updateRoleHandler sets the role of {username} from the "role" form or JSON field;
+// mount it behind requireAdmin
+func updateRoleHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	role := request.FormValue("role")
+	if role == "" {
+		var body struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); isBodyTooLarge(err) {
+			writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+			return
+		}
+		role = body.Role
+	}
+	if !validRole(role) {
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("unknown role %q", role))
+		return
+	}
+
+	err := store.UpdateRole(request.Context(), normalizeUsername(mux.Vars(request)["username"]), role)
+	if errors.Is(err, errUserNotFound) {
+		writeJSONError(response, http.StatusNotFound, errCodeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to update role", "error", err)
+		writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to update role")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// updateEnabledHandler enables or disables logging in as {username} from an "enabled"
+// form field or JSON body; mount it behind requireAdmin
+func updateEnabledHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if value := request.FormValue("enabled"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("invalid enabled value %q", value))
+			return
+		}
+		body.Enabled = &enabled
+	} else if err := json.NewDecoder(request.Body).Decode(&body); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	if body.Enabled == nil {
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, "enabled must be true or false")
+		return
+	}
+
+	err := store.SetEnabled(request.Context(), normalizeUsername(mux.Vars(request)["username"]), *body.Enabled)
+	if errors.Is(err, errUserNotFound) {
+		writeJSONError(response, http.StatusNotFound, errCodeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to update account status", "error", err)
+		writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to update account status")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// adminResetPasswordHandler sets a new password for {username} from a "password" form or
+// JSON field and lifts any lockout; with "invalidate_sessions" it also ends the user's
+// sessions (see ClearSessions). Mount it behind requireAdmin.
+func adminResetPasswordHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	var body struct {
+		Password           string `json:"password"`
+		InvalidateSessions bool   `json:"invalidate_sessions"`
+	}
+	if value := request.FormValue("password"); value != "" {
+		body.Password = value
+		if invalidate := request.FormValue("invalidate_sessions"); invalidate != "" {
+			parsed, err := strconv.ParseBool(invalidate)
+			if err != nil {
+				writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("invalid invalidate_sessions value %q", invalidate))
+				return
+			}
+			body.InvalidateSessions = parsed
+		}
+	} else if err := json.NewDecoder(request.Body).Decode(&body); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	if err := validateNewPassword(body.Password); err != nil {
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	userName := normalizeUsername(mux.Vars(request)["username"])
+	hash, err := hashPassword(body.Password)
+	if err == nil {
+		err = store.UpdatePassword(request.Context(), userName, hash)
+	}
+	if err == nil && body.InvalidateSessions {
+		err = store.ClearSessions(request.Context(), userName)
+	}
+	if errors.Is(err, errUserNotFound) {
+		writeJSONError(response, http.StatusNotFound, errCodeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to reset password", "user", userName, "error", err)
+		writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to reset password")
+		return
+	}
+	recordLoginSuccess(request.Context(), userName)
+	audit(request, auditPasswordChange, userName, "reset by admin "+getUserName(request))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// validationResponse is the JSON body listing every problem with a submitted user
+type validationResponse struct {
+	Errors validationErrors `json:"errors"`
+}
+
+// createUserHandler creates one user from a JSON body shaped like an import entry or the
+// same fields as a form. All problems with the input are reported together: with 409 when
+// the username or email is taken and nothing else is wrong, 400 otherwise. Mount it
+// behind requireAdmin.
+func createUserHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	var entry importUser
+	if isFormContent(request) {
+		if err := request.ParseForm(); isBodyTooLarge(err) {
+			httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+			return
+		}
+		entry = importUser{
+			Username: request.PostFormValue("username"),
+			Password: request.PostFormValue("password"),
+			Role:     request.PostFormValue("role"),
+			Email:    request.PostFormValue("email"),
+		}
+	} else if err := json.NewDecoder(request.Body).Decode(&entry); err != nil {
+		if isBodyTooLarge(err) {
+			writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+			return
+		}
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, "body must be a JSON user")
+		return
+	}
+
+	problems := validateImportUser(entry)
+	taken, err := takenFields(request.Context(), store, entry)
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to look up user", "error", err)
+		httpError(response, request, http.StatusInternalServerError, errCodeInternal, "failed to create user")
+		return
+	}
+	if problems = append(problems, taken...); len(problems) > 0 {
+		writeValidationErrors(response, request, problems)
+		return
+	}
+	user, err := newImportedUser(entry)
+	if err == nil {
+		err = store.CreateUser(request.Context(), user)
+	}
+	// taken in the meantime
+	if errors.Is(err, errDuplicateUser) {
+		writeValidationErrors(response, request, validationErrors{{"username", err.Error()}})
+		return
+	}
+	if errors.Is(err, errDuplicateEmail) {
+		writeValidationErrors(response, request, validationErrors{{"email", err.Error()}})
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to create user", "error", err)
+		httpError(response, request, http.StatusInternalServerError, errCodeInternal, "failed to create user")
+		return
+	}
+	if !isJSONContent(request) && !wantsJSON(request) {
+		http.Redirect(response, request, "/users", http.StatusSeeOther)
+		return
+	}
+	writeJSON(response, http.StatusCreated, map[string]string{"username": user.Username, "role": user.Role})
+}
+
+// writeValidationErrors reports problems as {"errors":[...]} to JSON clients and as a
+// list on the error page to forms
+func writeValidationErrors(response http.ResponseWriter, request *http.Request, problems validationErrors) {
+	status := http.StatusBadRequest
+	if problems.conflictsOnly() {
+		status = http.StatusConflict
+	}
+	if isJSONContent(request) || wantsJSON(request) {
+		writeJSON(response, status, validationResponse{Errors: problems})
+		return
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Field + ": " + problem.Message
+	}
+	renderErrorPage(response, errorPage{Status: status, Title: "The user could not be created", Errors: messages})
+}
+
+// deleteUserHandler removes {username}; mount it behind requireAdmin
+func deleteUserHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	err := store.DeleteUser(request.Context(), normalizeUsername(mux.Vars(request)["username"]))
+	if errors.Is(err, errUserNotFound) {
+		writeJSONError(response, http.StatusNotFound, errCodeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to delete user", "error", err)
+		writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to delete user")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
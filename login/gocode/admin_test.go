@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionCookieFor returns a valid session cookie for userName with the given role
+func sessionCookieFor(t *testing.T, userName string, role string) *http.Cookie {
+	rr := httptest.NewRecorder()
+	setSessionWithRole(userName, role, rr)
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("setSession did not set a cookie")
+	}
+	return cookies[0]
+}
+
+func TestUsersHandlerAuthenticatedAdmin(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(
+		User{Username: "bob", Password: "secret"},
+		User{Username: username, Password: password, Role: roleAdmin},
+	))
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected JSON content type, got %s", contentType)
+	}
+
+	var body usersListResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Usernames) != 2 || body.Usernames[0] != username || body.Usernames[1] != "bob" {
+		t.Errorf("unexpected usernames: %v", body.Usernames)
+	}
+	if strings.Contains(rr.Body.String(), "secret") || strings.Contains(rr.Body.String(), password) {
+		t.Error("response must never include passwords")
+	}
+}
+
+func TestUsersHandlerUnauthenticated(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rr.Code)
+	}
+}
+
+func TestUsersHandlerNonAdmin(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin user, got %d", rr.Code)
+	}
+}
+
+func TestUsersHandlerWithoutDatabase(t *testing.T) {
+	originalCollection := currentUsersCollection()
+	setUsersCollection(nil)
+	defer func() { setUsersCollection(originalCollection) }()
+	useMemoryUserStore(t, nil)
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	var body usersListResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Usernames == nil || len(body.Usernames) != 0 {
+		t.Errorf("expected an empty array without a database, got %v", body.Usernames)
+	}
+	if body.Note == "" {
+		t.Error("expected a note explaining only hardcoded credentials exist")
+	}
+}
+
+// getUsersPage calls GET /users as an admin with the given query string
+func getUsersPage(t *testing.T, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/users?"+query, nil)
+	req.AddCookie(sessionCookieFor(t, "alice", roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUsersHandlerPagination(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(
+		User{Username: "alice", Role: roleAdmin}, User{Username: "bob"}, User{Username: "carol"},
+		User{Username: "dave"}, User{Username: "erin"},
+	))
+	originalMax := usersPageMaxLimit
+	usersPageMaxLimit = 3
+	defer func() { usersPageMaxLimit = originalMax }()
+
+	testCases := []struct {
+		query string
+		want  string
+		limit int64
+	}{
+		{"limit=2", "alice,bob", 2},
+		{"limit=2&offset=2", "carol,dave", 2},
+		{"limit=2&offset=4", "erin", 2},
+		{"offset=5", "", 3},
+		{"offset=100", "", 3},
+		{"limit=0", "", 0},
+		{"limit=1000", "alice,bob,carol", 3},
+	}
+	for _, tc := range testCases {
+		rr := getUsersPage(t, tc.query)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.query, rr.Code)
+		}
+		var body usersListResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(body.Usernames, ","); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.query, tc.want, got)
+		}
+		if body.Total != 5 || body.Limit != tc.limit {
+			t.Errorf("%s: expected total 5 and limit %d, got %d and %d", tc.query, tc.limit, body.Total, body.Limit)
+		}
+	}
+}
+
+func TestUsersHandlerInvalidPageParams(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "alice", Role: roleAdmin}, User{Username: "bob"}))
+
+	for _, query := range []string{"limit=-1", "offset=-5", "limit=ten", "offset=1.5"} {
+		if rr := getUsersPage(t, query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+func TestUpdateRoleHandler(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: username, Password: password, Role: roleAdmin})
+	useMemoryUserStore(t, store)
+	cookie := sessionCookieFor(t, username, roleAdmin)
+
+	req := httptest.NewRequest("PUT", "/api/users/bob/role", strings.NewReader(`{"role":"admin"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if user, _ := store.FindUser(req.Context(), "bob"); user.Role != roleAdmin {
+		t.Errorf("expected bob to be promoted, got role %q", user.Role)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/users/bob/role", strings.NewReader(`{"role":"root"}`))
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown role, got %d", rr.Code)
+	}
+}
+
+func TestDisabledUserCannotLogIn(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: username, Password: password, Role: roleAdmin})
+	useMemoryUserStore(t, store)
+	cookie := sessionCookieFor(t, username, roleAdmin)
+
+	setEnabled := func(body string) int {
+		req := httptest.NewRequest("PUT", "/api/users/bob/enabled", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := setEnabled(`{"enabled":false}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204 disabling bob, got %d", code)
+	}
+	rr := postLogin("bob", "secret")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "Account disabled") {
+		t.Errorf("a disabled user should be rejected with 403, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if user, _ := store.FindUser(context.Background(), "bob"); user.FailedAttempts != 0 {
+		t.Errorf("a disabled login with the right password should not count as failed, got %d", user.FailedAttempts)
+	}
+	if rr := postLogin("bob", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong password should not reveal the account is disabled, got %d", rr.Code)
+	}
+
+	if code := setEnabled(`{"enabled":true}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204 enabling bob, got %d", code)
+	}
+	if rr := postLogin("bob", "secret"); rr.Code != http.StatusFound {
+		t.Errorf("re-enabling bob should restore login, got %d", rr.Code)
+	}
+
+	if code := setEnabled(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without an enabled value, got %d", code)
+	}
+}
+
+func TestDisablingUserEndsSessions(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+	session := app.loginCookie("bob", "secret")
+
+	app.store.SetEnabled(context.Background(), "bob", false)
+	if rr := app.get("/internal", session); rr.Code != http.StatusFound {
+		t.Errorf("a disabled user's session should be ended, got %d", rr.Code)
+	}
+}
+
+func TestRoleChangeEndsSessions(t *testing.T) {
+	app := newTestApp(t, User{Username: "alice", Password: "secret", Role: roleAdmin}, User{Username: "bob", Password: "secret"})
+	admin, user := app.loginCookie("alice", "secret"), app.loginCookie("bob", "secret")
+
+	app.store.UpdateRole(context.Background(), "alice", roleUser)
+	app.store.UpdateRole(context.Background(), "bob", roleAdmin)
+	if rr := app.get("/internal", admin); rr.Code != http.StatusFound {
+		t.Errorf("a demoted admin's session should be ended, got %d", rr.Code)
+	}
+	if rr := app.get("/internal", user); rr.Code != http.StatusFound {
+		t.Errorf("a promoted user should log in again to get the new role, got %d", rr.Code)
+	}
+}
+
+func TestDeleteUserHandlerNotFound(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: username, Password: password, Role: roleAdmin}))
+
+	req := httptest.NewRequest("DELETE", "/api/users/nobody", nil)
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", rr.Code)
+	}
+}
+
+// failingCreateStore fails every insert with a write error that isn't a duplicate key
+type failingCreateStore struct {
+	*memoryUserStore
+}
+
+func (failingCreateStore) CreateUser(ctx context.Context, user User) error {
+	return errors.New("not primary")
+}
+
+func TestCreateUserHandler(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: username, Password: password, Role: roleAdmin}))
+	cookie := sessionCookieFor(t, username, roleAdmin)
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/users", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := create(`{"username":"carol","password":"s3cret-pass"}`); rr.Code != http.StatusCreated {
+		t.Errorf("expected 201 for a new user, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr := create(`{"username":"Bob","password":"s3cret-pass"}`)
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), `{"field":"username","message":"username already exists"}`) {
+		t.Errorf("expected 409 for a taken username, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := create(`{"username":"dave","password":"short"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a weak password, got %d", rr.Code)
+	}
+
+	useMemoryUserStore(t, failingCreateStore{newMemoryUserStore(User{Username: username, Password: password, Role: roleAdmin})})
+	rr = create(`{"username":"erin","password":"s3cret-pass"}`)
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "not primary") {
+		t.Errorf("a generic write error should answer a plain 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCreateUserReportsAllProblems(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret", Email: "bob@example.com"}, User{Username: username, Password: password, Role: roleAdmin}))
+	cookie := sessionCookieFor(t, username, roleAdmin)
+
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"username":"bob","password":"short","email":"not-an-email","role":"root"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body validationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]bool{}
+	for _, problem := range body.Errors {
+		fields[problem.Field] = true
+	}
+	for _, field := range []string{"username", "password", "email", "role"} {
+		if !fields[field] {
+			t.Errorf("expected a problem with %s, got %+v", field, body.Errors)
+		}
+	}
+
+	form := url.Values{"username": {"bob"}, "password": {"short"}, "email": {"bob@example.com"}}
+	req = httptest.NewRequest("POST", "/api/users", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	html := rr.Body.String()
+	if rr.Code != http.StatusBadRequest || strings.Count(html, "<li>") != 3 {
+		t.Errorf("expected the three problems listed on the error page, got %d: %s", rr.Code, html)
+	}
+	for _, want := range []string{"username already exists", "email already in use", "password must be at least"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected %q in the list, got %s", want, html)
+		}
+	}
+}
+
+// resetPasswordRequest posts an admin password reset for name with a JSON body
+func resetPasswordRequest(name string, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/admin/users/"+name+"/reset-password", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestAdminResetPassword(t *testing.T) {
+	limitSessions(t, 2)
+	app := newTestApp(t, User{Username: "bob", Password: "old-secret"}, User{Username: username, Password: password, Role: roleAdmin})
+	admin := app.loginCookie(username, password)
+	bobSession := app.loginCookie("bob", "old-secret")
+	loginAttempts.recordFailure("bob")
+
+	rr := app.do(resetPasswordRequest("Bob", `{"password":"new-secret-9","invalidate_sessions":true}`), admin)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.login("bob", "old-secret"); rr.Code == http.StatusFound {
+		t.Error("the old password should no longer work")
+	}
+	if rr := app.login("bob", "new-secret-9"); rr.Code != http.StatusFound {
+		t.Errorf("expected bob to log in with the new password, got %d", rr.Code)
+	}
+	if user, _ := app.store.FindUser(context.Background(), "bob"); user.Password == "new-secret-9" {
+		t.Error("the new password should be stored hashed")
+	}
+	if rr := app.get("/internal", bobSession); rr.Code == http.StatusOK {
+		t.Error("bob's session from before the reset should have been ended")
+	}
+}
+
+func TestAdminResetPasswordKeepsSessionsByDefault(t *testing.T) {
+	limitSessions(t, 2)
+	app := newTestApp(t, User{Username: "bob", Password: "old-secret"}, User{Username: username, Password: password, Role: roleAdmin})
+	bobSession := app.loginCookie("bob", "old-secret")
+
+	form := url.Values{"password": {"new-secret-9"}}
+	if rr := app.postForm("/admin/users/bob/reset-password", form, app.loginCookie(username, password)); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.get("/internal", bobSession); rr.Code != http.StatusOK {
+		t.Errorf("bob's session should survive a reset that doesn't invalidate sessions, got %d", rr.Code)
+	}
+}
+
+func TestAdminResetPasswordInvalidatesSessionsWithoutSessionLimit(t *testing.T) {
+	limitSessions(t, 0)
+	fake := useFakeClock(t)
+	app := newTestApp(t, User{Username: "bob", Password: "old-secret"}, User{Username: username, Password: password, Role: roleAdmin})
+	bobSession := app.loginCookie("bob", "old-secret")
+	admin := app.loginCookie(username, password)
+	fake.Advance(time.Second)
+
+	if rr := app.do(resetPasswordRequest("bob", `{"password":"new-secret-9"}`), admin); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.get("/internal", bobSession); rr.Code != http.StatusOK {
+		t.Errorf("without invalidate_sessions bob's session should be kept, got %d", rr.Code)
+	}
+
+	rr := app.do(resetPasswordRequest("bob", `{"password":"new-secret-10","invalidate_sessions":true}`), admin)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.get("/internal", bobSession); rr.Code != http.StatusFound {
+		t.Errorf("bob's uncounted session should be ended, got %d", rr.Code)
+	}
+}
+
+func TestAdminResetPasswordRequiresAdmin(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob", Password: "old-secret"})
+
+	rr := app.do(resetPasswordRequest("bob", `{"password":"new-secret-9"}`), sessionCookieFor(t, "bob", roleUser))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", rr.Code)
+	}
+	if rr := app.do(resetPasswordRequest("bob", `{"password":"new-secret-9"}`)); rr.Code == http.StatusNoContent {
+		t.Error("an anonymous request should not reset passwords")
+	}
+	if rr := app.login("bob", "old-secret"); rr.Code != http.StatusFound {
+		t.Errorf("bob's password should be unchanged, got %d", rr.Code)
+	}
+}
+
+func TestAdminResetPasswordUnknownUser(t *testing.T) {
+	app := newTestApp(t, User{Username: username, Password: password, Role: roleAdmin})
+	admin := app.loginCookie(username, password)
+
+	rr := app.do(resetPasswordRequest("nobody", `{"password":"new-secret-9"}`), admin)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", rr.Code)
+	}
+	if code := decodeAPIError(t, rr).Code; code != errCodeNotFound {
+		t.Errorf("expected error code %q, got %q", errCodeNotFound, code)
+	}
+	if rr := app.do(resetPasswordRequest("nobody", `{"password":""}`), admin); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a valid password, got %d", rr.Code)
+	}
+}
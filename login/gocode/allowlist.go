@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// allowedNetworks are the client ranges (ALLOWED_CIDRS) admin routes are served to; empty
+// allows every client. Clients are identified by clientIP, so proxies must be trusted.
+var allowedNetworks []*net.IPNet
+
+// ipAllowlist answers 403 to clients outside allowedNetworks
+func ipAllowlist(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if len(allowedNetworks) > 0 {
+			if ip := clientIP(request); !inNetworks(ip, allowedNetworks) {
+				requestLogger(request.Context()).Warn("client outside the allowed networks", "client_ip", ip, "path", request.URL.Path)
+				httpError(response, request, http.StatusForbidden, errCodeForbidden, "access denied from this address")
+				return
+			}
+		}
+		next(response, request)
+	}
+}
+
+// requireAdmin guards the admin routes: the client must be allowlisted and its session
+// carry the admin role
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return ipAllowlist(requireRole(roleAdmin, next))
+}
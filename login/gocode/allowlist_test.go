@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// allowNetworks sets ALLOWED_CIDRS for the duration of a test
+func allowNetworks(t *testing.T, cidrs ...string) {
+	original := allowedNetworks
+	networks, err := parseNetworks(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedNetworks = networks
+	t.Cleanup(func() { allowedNetworks = original })
+}
+
+func TestAdminRoutesAllowlist(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: "admin", Role: roleAdmin}))
+	allowNetworks(t, "10.1.0.0/16")
+	trustProxies(t, "192.0.2.10")
+	cookie := sessionCookieFor(t, "admin", roleAdmin)
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"in range", "10.1.2.3:1234", "", http.StatusOK},
+		{"out of range", "198.51.100.1:1234", "", http.StatusForbidden},
+		{"in range behind a trusted proxy", "192.0.2.10:1234", "10.1.2.3", http.StatusOK},
+		{"out of range behind a trusted proxy", "192.0.2.10:1234", "198.51.100.1", http.StatusForbidden},
+		{"forged header", "198.51.100.1:1234", "10.1.2.3", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			req.AddCookie(cookie)
+			rr := httptest.NewRecorder()
+			setupRouter().ServeHTTP(rr, req)
+			if rr.Code != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, rr.Code)
+			}
+		})
+	}
+
+	// routes outside the admin area stay open
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the login page to be served outside the allowlist, got %d", rr.Code)
+	}
+}
+
+func TestInvalidAllowedCIDRsRejected(t *testing.T) {
+	original := allowedNetworks
+	t.Cleanup(func() { allowedNetworks = original })
+	t.Setenv("ALLOWED_CIDRS", "10.0.0.0/33")
+	if err := loadConfig(); err == nil {
+		t.Error("an invalid allowed range should be rejected at startup")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// error codes of JSON error responses; clients branch on these, the messages are for people
+const (
+	errCodeUnauthenticated      = "unauthenticated"
+	errCodeForbidden            = "forbidden"
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeInvalidCredentials   = "invalid_credentials"
+	errCodeNotFound             = "not_found"
+	errCodeGone                 = "gone"
+	errCodeBodyTooLarge         = "body_too_large"
+	errCodeUnsupportedMediaType = "unsupported_media_type"
+	errCodeLocked               = "locked"
+	errCodeAccountDisabled      = "account_disabled"
+	errCodeUnavailable          = "unavailable"
+	errCodeInternal             = "internal"
+)
+
+// apiError is the JSON error body: {"error":{"code":...,"message":...}}
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSON writes body as a JSON response with the given status
+func writeJSON(response http.ResponseWriter, status int, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+// writeJSONError writes a JSON error response; API clients never see cached errors
+func writeJSONError(response http.ResponseWriter, status int, code string, message string) {
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, status, apiError{Error: apiErrorDetail{Code: code, Message: message}})
+}
+
+// httpError answers API requests (see isAPIRequest) with a JSON error and everything
+// else with a plain text one, for middleware shared by pages and API routes
+func httpError(response http.ResponseWriter, request *http.Request, status int, code string, message string) {
+	if isAPIRequest(request) {
+		writeJSONError(response, status, code, message)
+		return
+	}
+	http.Error(response, message, status)
+}
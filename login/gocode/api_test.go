@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// decodeAPIError parses a JSON error response, failing the test on any other shape
+func decodeAPIError(t *testing.T, rr *httptest.ResponseRecorder) apiErrorDetail {
+	t.Helper()
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected a JSON error, got Content-Type %q: %s", contentType, rr.Body.String())
+	}
+	var body apiError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Code == "" {
+		t.Fatalf("expected {\"error\":{\"code\",\"message\"}}, got %s", rr.Body.String())
+	}
+	return body.Error
+}
+
+func TestWriteJSONError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeJSONError(rr, http.StatusNotFound, errCodeNotFound, "user not found")
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+	if got := decodeAPIError(t, rr); got.Code != errCodeNotFound || got.Message != "user not found" {
+		t.Errorf("unexpected error body %+v", got)
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("expected Cache-Control no-store, got %q", cacheControl)
+	}
+}
+
+func TestAPIRoutesReturnJSONErrors(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob"}, User{Username: username, Password: password, Role: roleAdmin}))
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		cookie *http.Cookie
+		status int
+		code   string
+	}{
+		{"unknown user", "DELETE", "/api/users/nobody", sessionCookieFor(t, username, roleAdmin), http.StatusNotFound, errCodeNotFound},
+		{"not an admin", "DELETE", "/api/users/nobody", sessionCookieFor(t, "bob", roleUser), http.StatusForbidden, errCodeForbidden},
+		{"no session", "DELETE", "/api/users/nobody", nil, http.StatusUnauthorized, errCodeUnauthenticated},
+		{"no bearer token", "GET", "/api/token", nil, http.StatusUnauthorized, errCodeUnauthenticated},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.cookie != nil {
+				req.AddCookie(tc.cookie)
+			}
+			rr := httptest.NewRecorder()
+			setupRouter().ServeHTTP(rr, req)
+
+			if rr.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, rr.Code)
+			}
+			if got := decodeAPIError(t, rr); got.Code != tc.code {
+				t.Errorf("expected code %q, got %+v", tc.code, got)
+			}
+		})
+	}
+}
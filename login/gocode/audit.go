@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// audit event types
+const (
+	auditLoginSuccess   = "login_success"
+	auditLoginFailure   = "login_failure"
+	auditLogout         = "logout"
+	auditPasswordChange = "password_change"
+)
+
+// audit sinks selectable with AUDIT_SINK
+const (
+	auditSinkLog   = "log"
+	auditSinkMongo = "mongo"
+)
+
+// auditSink selects where audit events go; the mongo sink falls back to the log
+// without a database connection
+var auditSink = auditSinkLog
+
+// auditCollectionName is the MongoDB collection audit events are appended to
+var auditCollectionName = "audit"
+
+// AuditEvent is one entry of the audit trail; it never carries a password
+type AuditEvent struct {
+	Time      time.Time `bson:"time" json:"time"`
+	Type      string    `bson:"type" json:"type"`
+	Username  string    `bson:"username,omitempty" json:"username,omitempty"`
+	SourceIP  string    `bson:"source_ip" json:"source_ip"`
+	RequestID string    `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// AuditLogger appends audit events; implementations must never update or delete them
+type AuditLogger interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// logAuditLogger writes audit events as structured log lines
+type logAuditLogger struct{}
+
+func (logAuditLogger) Record(ctx context.Context, event AuditEvent) error {
+	slog.Info("audit", "event", event.Type, "user", event.Username, "source_ip", event.SourceIP,
+		"request_id", event.RequestID, "reason", event.Reason, "time", event.Time)
+	return nil
+}
+
+// mongoAuditLogger inserts audit events into a MongoDB collection
+type mongoAuditLogger struct {
+	collection *mongo.Collection
+}
+
+func (l *mongoAuditLogger) Record(ctx context.Context, event AuditEvent) error {
+	defer trackDBOp()()
+	_, err := l.collection.InsertOne(ctx, event)
+	return err
+}
+
+// auditLogger overrides the configured sink; tests use it to capture events
+var auditLogger AuditLogger
+
+// currentAuditLogger returns the AuditLogger for auditSink
+func currentAuditLogger() AuditLogger {
+	if auditLogger != nil {
+		return auditLogger
+	}
+	if auditSink == auditSinkMongo {
+		if collection := currentUsersCollection(); collection != nil {
+			return &mongoAuditLogger{collection: collection.Database().Collection(auditCollectionName)}
+		}
+	}
+	return logAuditLogger{}
+}
+
+// audit records an event of eventType for userName made by request; a failing sink is
+// logged but never fails the request
+func audit(request *http.Request, eventType string, userName string, reason string) {
+	event := AuditEvent{
+		Time:      clock().UTC(),
+		Type:      eventType,
+		Username:  userName,
+		SourceIP:  clientIP(request),
+		RequestID: requestIDFromContext(request.Context()),
+		Reason:    reason,
+	}
+	if err := currentAuditLogger().Record(request.Context(), event); err != nil {
+		requestLogger(request.Context()).Error("failed to record audit event", "event", eventType, "error", err)
+	}
+}
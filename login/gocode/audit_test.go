@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingAuditLogger keeps audit events in memory
+type recordingAuditLogger struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (l *recordingAuditLogger) Record(ctx context.Context, event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+// only returns the single recorded event, failing the test otherwise
+func (l *recordingAuditLogger) only(t *testing.T) AuditEvent {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) != 1 {
+		t.Fatalf("expected one audit event, got %+v", l.events)
+	}
+	return l.events[0]
+}
+
+// useAuditLogger captures audit events for the duration of a test
+func useAuditLogger(t *testing.T) *recordingAuditLogger {
+	original := auditLogger
+	recorder := &recordingAuditLogger{}
+	auditLogger = recorder
+	t.Cleanup(func() { auditLogger = original })
+	return recorder
+}
+
+func TestAuditFailedLogin(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	recorder := useAuditLogger(t)
+
+	postLogin("bob", "wrong-password")
+
+	event := recorder.only(t)
+	if event.Type != auditLoginFailure || event.Username != "bob" || event.SourceIP == "" {
+		t.Errorf("expected a login failure for bob with a source IP, got %+v", event)
+	}
+	if event.Time.IsZero() {
+		t.Error("audit events should be timestamped")
+	}
+	if strings.Contains(event.Reason, "wrong-password") {
+		t.Error("audit events must never carry the password")
+	}
+}
+
+func TestAuditSuccessfulLoginWithRequestID(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	recorder := useAuditLogger(t)
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("name=bob&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-ID", "audit-test-1")
+	appHandler(setupRouter()).ServeHTTP(httptest.NewRecorder(), req)
+
+	event := recorder.only(t)
+	if event.Type != auditLoginSuccess || event.Username != "bob" || event.RequestID != "audit-test-1" {
+		t.Errorf("expected a login success for bob tagged with the request ID, got %+v", event)
+	}
+}
+
+func TestAuditLogoutAndPasswordChange(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "oldpass123"}))
+	recorder := useAuditLogger(t)
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	rr := postChangePassword(t, cookie, "oldpass123", "newpass456")
+	if event := recorder.only(t); event.Type != auditPasswordChange || event.Username != "bob" {
+		t.Errorf("expected a password change for bob, got %+v", event)
+	}
+	// the change ends older sessions and renews this one
+	for _, renewed := range rr.Result().Cookies() {
+		if renewed.Name == sessionCookieName {
+			cookie = renewed
+		}
+	}
+
+	recorder.events = nil
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(cookie)
+	setupRouter().ServeHTTP(httptest.NewRecorder(), req)
+	if event := recorder.only(t); event.Type != auditLogout || event.Username != "bob" {
+		t.Errorf("expected a logout for bob, got %+v", event)
+	}
+}
+
+func TestMongoAuditLogger(t *testing.T) {
+	testCollection, cleanup := setupTestMongoDB(t)
+	if testCollection == nil {
+		return
+	}
+	defer cleanup()
+	originalCollection, originalSink := currentUsersCollection(), auditSink
+	setUsersCollection(testCollection)
+	auditSink = auditSinkMongo
+	defer func() {
+		setUsersCollection(originalCollection)
+		auditSink = originalSink
+	}()
+
+	audit(httptest.NewRequest(http.MethodPost, "/login", nil), auditLoginFailure, "bob", "invalid credentials")
+
+	events := testCollection.Database().Collection(auditCollectionName)
+	defer events.Drop(context.Background())
+	if count, err := events.CountDocuments(context.Background(), map[string]interface{}{"username": "bob"}); err != nil || count != 1 {
+		t.Errorf("expected one audit document, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"strings"
+)
+
+// appName (APP_NAME) is shown above the internal page; empty shows nothing
+var appName = ""
+
+// defaultWelcomeMessage is the welcome line of the internal page unless WELCOME_MESSAGE
+// replaces it. Both are html/template text, so the username stays escaped.
+const defaultWelcomeMessage = `You're welcome {{.Username}}`
+
+var welcomeTemplate = template.Must(template.New("welcome").Parse(defaultWelcomeMessage))
+
+// welcomeData is what the welcome template can refer to
+type welcomeData struct {
+	Username string
+	Role     string
+	AppName  string
+}
+
+// loadWelcomeTemplate replaces the welcome template with text
+func loadWelcomeTemplate(text string) error {
+	parsed, err := template.New("welcome").Parse(text)
+	if err != nil {
+		return err
+	}
+	welcomeTemplate = parsed
+	return nil
+}
+
+// welcomeMessage renders the welcome line for userName, falling back to the default text
+// when the configured template fails at render time
+func welcomeMessage(userName string, role string) string {
+	var message strings.Builder
+	if err := welcomeTemplate.Execute(&message, welcomeData{Username: userName, Role: role, AppName: appName}); err != nil {
+		slog.Error("failed to render welcome message", "error", err)
+		return "You're welcome " + html.EscapeString(userName)
+	}
+	return message.String()
+}
+
+// brandHeader is the escaped app name header of the internal page
+func brandHeader() string {
+	if appName == "" {
+		return ""
+	}
+	return fmt.Sprintf("<header class=\"brand\">%s</header>\n", html.EscapeString(appName))
+}
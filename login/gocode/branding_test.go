@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useBranding sets APP_NAME and WELCOME_MESSAGE for the duration of a test
+func useBranding(t *testing.T, name string, welcome string) {
+	originalName, originalTemplate := appName, welcomeTemplate
+	t.Cleanup(func() { appName, welcomeTemplate = originalName, originalTemplate })
+	t.Setenv("APP_NAME", name)
+	t.Setenv("WELCOME_MESSAGE", welcome)
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInternalPageBranding(t *testing.T) {
+	useBranding(t, "Acme <Portal>", "Hello {{.Username}}, this is {{.AppName}}")
+	app := newTestApp(t, User{Username: "<b>bob</b>"})
+
+	body := app.get("/internal", sessionCookieFor(t, "<b>bob</b>", roleUser)).Body.String()
+	if !strings.Contains(body, `<header class="brand">Acme &lt;Portal&gt;</header>`) {
+		t.Errorf("expected the escaped app name in the page, got %s", body)
+	}
+	if !strings.Contains(body, "Hello &lt;b&gt;bob&lt;/b&gt;, this is Acme &lt;Portal&gt;") {
+		t.Errorf("expected the configured welcome message with an escaped username, got %s", body)
+	}
+}
+
+func TestInternalPageDefaultWelcome(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob"})
+
+	body := app.get("/internal", sessionCookieFor(t, "bob", roleUser)).Body.String()
+	if !strings.Contains(body, "You're welcome bob") || strings.Contains(body, `class="brand"`) {
+		t.Errorf("expected the default welcome without a brand header, got %s", body)
+	}
+}
+
+func TestInvalidWelcomeMessageRejected(t *testing.T) {
+	original := welcomeTemplate
+	t.Cleanup(func() { welcomeTemplate = original })
+	t.Setenv("WELCOME_MESSAGE", "Hello {{.Username")
+	if err := loadConfig(); err == nil {
+		t.Error("a malformed WELCOME_MESSAGE should be rejected at startup")
+	}
+}
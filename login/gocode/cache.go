@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// userCacheTTL enables a short-lived cache of user lookups when positive (off by default)
+var userCacheTTL time.Duration
+
+// lookupCache holds cached user lookups shared by all requests
+var lookupCache = newUserCache()
+
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// userCache is a concurrency-safe map of users with per-entry expiry, keyed by
+// tenantUsername so tenants sharing a username don't see each other's user
+type userCache struct {
+	mu      sync.Mutex
+	entries map[string]userCacheEntry
+	// generation counts invalidations, so a lookup that raced one doesn't cache what it read
+	generation uint64
+}
+
+func newUserCache() *userCache {
+	return &userCache{entries: make(map[string]userCacheEntry)}
+}
+
+// get returns the user cached under key if present and not expired
+func (c *userCache) get(key string) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if clock().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	user := entry.user
+	return &user, true
+}
+
+// currentGeneration returns the generation to pass to put for a lookup starting now
+func (c *userCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches user under key (see tenantUsername) for ttl, unless the cache was invalidated
+// since generation was taken: the user may then have been read before a write
+func (c *userCache) put(key string, user User, ttl time.Duration, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.entries[key] = userCacheEntry{user: user, expires: clock().Add(ttl)}
+}
+
+// invalidate drops any entry cached under key; call it on every update or delete of that user
+func (c *userCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	c.generation++
+}
+
+// clear drops all cached entries
+func (c *userCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]userCacheEntry)
+	c.generation++
+}
+
+// cachingUserStore serves read-only lookups from the cache and invalidates it on writes
+type cachingUserStore struct {
+	next  UserStore
+	cache *userCache
+}
+
+func (s *cachingUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	key := tenantUsername(ctx, username)
+	if user, ok := s.cache.get(key); ok {
+		return user, nil
+	}
+	generation := s.cache.currentGeneration()
+	user, err := s.next.FindUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.put(key, *user, userCacheTTL, generation)
+	return user, nil
+}
+
+func (s *cachingUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.next.FindUserByEmail(ctx, email)
+}
+
+func (s *cachingUserStore) ListUsernames(ctx context.Context) ([]string, error) {
+	return s.next.ListUsernames(ctx)
+}
+
+func (s *cachingUserStore) UpsertUser(ctx context.Context, user User) error {
+	defer s.cache.invalidate(tenantUsername(ctx, user.Username))
+	return s.next.UpsertUser(ctx, user)
+}
+
+func (s *cachingUserStore) ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error) {
+	return s.next.ListUsernamesPage(ctx, offset, limit)
+}
+
+func (s *cachingUserStore) UpdatePassword(ctx context.Context, username string, passwordHash string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.UpdatePassword(ctx, username, passwordHash)
+}
+
+func (s *cachingUserStore) CreateUser(ctx context.Context, user User) error {
+	defer s.cache.invalidate(tenantUsername(ctx, user.Username))
+	return s.next.CreateUser(ctx, user)
+}
+
+func (s *cachingUserStore) UpdateRole(ctx context.Context, username string, role string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.UpdateRole(ctx, username, role)
+}
+
+func (s *cachingUserStore) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.SetEnabled(ctx, username, enabled)
+}
+
+func (s *cachingUserStore) LinkOIDCSubject(ctx context.Context, username string, subject string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.LinkOIDCSubject(ctx, username, subject)
+}
+
+func (s *cachingUserStore) AddSession(ctx context.Context, username string, sessionID string, keep int) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.AddSession(ctx, username, sessionID, keep)
+}
+
+func (s *cachingUserStore) ClearSessions(ctx context.Context, username string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.ClearSessions(ctx, username)
+}
+
+func (s *cachingUserStore) DeleteUser(ctx context.Context, username string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.DeleteUser(ctx, username)
+}
+
+func (s *cachingUserStore) RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error) {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.RecordFailedLogin(ctx, username, maxAttempts, lockFor)
+}
+
+func (s *cachingUserStore) ClearFailedLogins(ctx context.Context, username string) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.ClearFailedLogins(ctx, username)
+}
+
+func (s *cachingUserStore) SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error {
+	defer s.cache.invalidate(tenantUsername(ctx, username))
+	return s.next.SetResetToken(ctx, username, tokenHash, expires)
+}
+
+func (s *cachingUserStore) FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error) {
+	return s.next.FindUserByResetToken(ctx, tokenHash)
+}
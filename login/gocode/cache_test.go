@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// countingUserStore counts FindUser calls that reach the underlying store
+type countingUserStore struct {
+	UserStore
+	finds int
+}
+
+func (s *countingUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	s.finds++
+	return s.UserStore.FindUser(ctx, username)
+}
+
+// enableUserCache turns the lookup cache on with ttl for the duration of the test
+func enableUserCache(t *testing.T, ttl time.Duration) {
+	original := userCacheTTL
+	userCacheTTL = ttl
+	lookupCache.clear()
+	t.Cleanup(func() {
+		userCacheTTL = original
+		lookupCache.clear()
+	})
+}
+
+func TestUserCacheServesLookupWithinTTL(t *testing.T) {
+	counting := &countingUserStore{UserStore: newMemoryUserStore(User{Username: "bob", Password: "secret"})}
+	useMemoryUserStore(t, counting)
+	enableUserCache(t, time.Minute)
+
+	if !verifyCredentials(context.Background(), "bob", "secret") || !verifyCredentials(context.Background(), "bob", "secret") {
+		t.Fatal("verifyCredentials should succeed for a stored user")
+	}
+	if counting.finds != 1 {
+		t.Errorf("second lookup within the TTL should be served from cache, store hit %d times", counting.finds)
+	}
+}
+
+func TestUserCacheInvalidate(t *testing.T) {
+	counting := &countingUserStore{UserStore: newMemoryUserStore(User{Username: "bob", Password: "secret"})}
+	useMemoryUserStore(t, counting)
+	enableUserCache(t, time.Minute)
+
+	verifyCredentials(context.Background(), "bob", "secret")
+	lookupCache.invalidate("bob")
+	verifyCredentials(context.Background(), "bob", "secret")
+
+	if counting.finds != 2 {
+		t.Errorf("lookup after invalidation should hit the store, store hit %d times", counting.finds)
+	}
+}
+
+func TestUserCacheExpires(t *testing.T) {
+	fake := useFakeClock(t)
+	cache := newUserCache()
+	cache.put("bob", User{Username: "bob"}, time.Minute, cache.currentGeneration())
+	fake.Advance(time.Minute + time.Second)
+
+	if _, ok := cache.get("bob"); ok {
+		t.Error("expired entries should not be served")
+	}
+}
+
+// racingUserStore invalidates the cache during a lookup, like a write finishing while
+// the lookup's result is on its way back
+type racingUserStore struct {
+	UserStore
+}
+
+func (s *racingUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	user, err := s.UserStore.FindUser(ctx, username)
+	lookupCache.invalidate(tenantUsername(ctx, username))
+	return user, err
+}
+
+func TestUserCacheDropsLookupThatRacedInvalidation(t *testing.T) {
+	enableUserCache(t, time.Minute)
+	store := &cachingUserStore{next: &racingUserStore{UserStore: newMemoryUserStore(User{Username: "bob", Password: "secret"})}, cache: lookupCache}
+
+	if _, err := store.FindUser(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupCache.get(tenantUsername(context.Background(), "bob")); ok {
+		t.Error("a lookup that raced an invalidation should not be cached")
+	}
+}
+
+func TestUserCacheDisabledByDefault(t *testing.T) {
+	counting := &countingUserStore{UserStore: newMemoryUserStore(User{Username: "bob", Password: "secret"})}
+	useMemoryUserStore(t, counting)
+	enableUserCache(t, 0)
+
+	verifyCredentials(context.Background(), "bob", "secret")
+	verifyCredentials(context.Background(), "bob", "secret")
+
+	if counting.finds != 2 {
+		t.Errorf("without a TTL every lookup should hit the store, store hit %d times", counting.finds)
+	}
+}
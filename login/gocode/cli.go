@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// runCommand runs the subcommand named by args[0], or the -check-config mode, instead of
+// the server, reporting whether there was one; other server flags are left alone
+func runCommand(args []string, out io.Writer) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	if hasFlag(args, "check-config") {
+		return true, checkConfigCommand(args, out)
+	}
+	switch args[0] {
+	case "create-admin":
+		return true, createAdminCommand(args[1:], out)
+	}
+	return false, nil
+}
+
+// hasFlag reports whether args set the boolean flag name, in any of the forms the flag
+// package accepts
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name || arg == name+"=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigTimeout bounds the MongoDB connection attempt of -check-config
+var checkConfigTimeout = 5 * time.Second
+
+// checkConfigCommand implements -check-config: it loads the configuration and tries
+// MongoDB once, reporting each step, and fails if either does, without starting the server
+func checkConfigCommand(args []string, out io.Writer) error {
+	if err := loadConfig(); err != nil {
+		fmt.Fprintf(out, "configuration: FAILED: %v\n", err)
+		return err
+	}
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Bool("check-config", false, "validate the configuration and exit")
+	host, err := parseFlags(fs, args)
+	if err != nil {
+		fmt.Fprintf(out, "configuration: FAILED: %v\n", err)
+		return err
+	}
+	fmt.Fprintln(out, "configuration: ok")
+	if storeBackend == storeBackendSQL {
+		// loadConfig already connected to the SQL database
+		fmt.Fprintf(out, "sql %s: ok\n", sqlDriver)
+		return nil
+	}
+
+	if mongoConnectTimeout > checkConfigTimeout {
+		mongoConnectTimeout = checkConfigTimeout
+	}
+	mongodb_username, mongodb_password = getMongoDBCredentials()
+	collection := connectFunc(host)
+	if collection == nil {
+		fmt.Fprintf(out, "mongodb %s: FAILED\n", host)
+		return fmt.Errorf("check-config: could not connect to MongoDB at %s", host)
+	}
+	disconnectDB(context.Background())
+	fmt.Fprintf(out, "mongodb %s: ok\n", host)
+	return nil
+}
+
+// createAdminCommand implements "create-admin -username X -password Y": it upserts an
+// admin in the database configured like the server's, without starting the server
+func createAdminCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	fs.SetOutput(out)
+	name := fs.String("username", "", "name of the admin user")
+	pass := fs.String("password", getEnvOrFile("ADMIN_PASSWORD"), "password of the admin user, defaults to ADMIN_PASSWORD")
+	host := fs.String("mongo-host", getEnvString("MONGODB_IP", localhost), "MongoDB host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*name) == "" {
+		return errors.New("create-admin: -username is required")
+	}
+	if err := validateNewPassword(*pass); err != nil {
+		return fmt.Errorf("create-admin: %w", err)
+	}
+	if err := loadConfig(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if userStore == nil {
+		mongodb_username, mongodb_password = getMongoDBCredentials()
+		setUsersCollection(connectWithRetry(*host))
+		defer disconnectDB(ctx)
+	}
+	store := currentUserStore()
+	if store == nil {
+		return errors.New("create-admin: no database connection")
+	}
+	created, err := createAdmin(ctx, store, *name, *pass)
+	if err != nil {
+		return fmt.Errorf("create-admin: %w", err)
+	}
+	if created {
+		fmt.Fprintf(out, "created admin user %q\n", normalizeUsername(*name))
+	} else {
+		fmt.Fprintf(out, "updated user %q to admin with the new password\n", normalizeUsername(*name))
+	}
+	return nil
+}
+
+// createAdmin upserts name as an admin with pass, promoting an existing user; it reports
+// whether the user was newly created
+func createAdmin(ctx context.Context, store UserStore, name string, pass string) (bool, error) {
+	normalized := normalizeUsername(name)
+	_, err := store.FindUser(ctx, normalized)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		return false, err
+	}
+	created := errors.Is(err, errUserNotFound)
+	if err := upsertSeedUser(ctx, store, name, pass, roleAdmin); err != nil {
+		return false, err
+	}
+	// UpsertUser leaves the role of existing users alone
+	if err := store.UpdateRole(ctx, normalized, roleAdmin); err != nil {
+		return false, err
+	}
+	return created, nil
+}
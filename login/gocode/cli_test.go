@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestCreateAdminCommand(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "old-secret1", Role: roleUser})
+	useMemoryUserStore(t, store)
+
+	var out bytes.Buffer
+	ran, err := runCommand([]string{"create-admin", "-username", "Root", "-password", "s3cret-pass"}, &out)
+	if !ran || err != nil {
+		t.Fatalf("expected create-admin to run, got ran=%v err=%v", ran, err)
+	}
+	if !strings.Contains(out.String(), `created admin user "root"`) {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	user, err := store.FindUser(context.Background(), "root")
+	if err != nil || user.Role != roleAdmin || !passwordMatches(user.Password, "s3cret-pass") {
+		t.Errorf("expected root to be stored as an admin with a hashed password, got %+v, %v", user, err)
+	}
+
+	// an existing user is promoted and gets the new password
+	out.Reset()
+	if _, err := runCommand([]string{"create-admin", "-username", "bob", "-password", "new-secret2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindUser(context.Background(), "bob"); user.Role != roleAdmin || !passwordMatches(user.Password, "new-secret2") {
+		t.Errorf("expected bob to be promoted with the new password, got %+v", user)
+	}
+}
+
+func TestCreateAdminCommandValidatesInput(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore())
+
+	for _, args := range [][]string{
+		{"create-admin", "-password", "s3cret-pass"},
+		{"create-admin", "-username", "root", "-password", "short"},
+		{"create-admin", "-unknown"},
+	} {
+		if _, err := runCommand(args, &bytes.Buffer{}); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	if ran, _ := runCommand([]string{"-mongo-host", "db"}, &bytes.Buffer{}); ran {
+		t.Error("server flags should not be taken for a subcommand")
+	}
+}
+
+// stubCheckConfigConnect makes -check-config's connection attempt return collection
+func stubCheckConfigConnect(t *testing.T, collection *mongo.Collection) {
+	originalConnect, originalTimeout := connectFunc, mongoConnectTimeout
+	t.Cleanup(func() { connectFunc, mongoConnectTimeout = originalConnect, originalTimeout })
+	connectFunc = func(string) *mongo.Collection { return collection }
+}
+
+func TestCheckConfigCommand(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubCheckConfigConnect(t, client.Database(database_name).Collection(collection_name))
+
+	var out bytes.Buffer
+	ran, err := runCommand([]string{"-check-config", "-mongo-host", "db"}, &out)
+	if !ran || err != nil {
+		t.Fatalf("expected -check-config to run and pass, got ran=%v err=%v\n%s", ran, err, out.String())
+	}
+	if !strings.Contains(out.String(), "configuration: ok") || !strings.Contains(out.String(), "mongodb db: ok") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if mongoConnectTimeout > checkConfigTimeout {
+		t.Errorf("expected the connect timeout capped at %v, got %v", checkConfigTimeout, mongoConnectTimeout)
+	}
+}
+
+func TestCheckConfigCommandFails(t *testing.T) {
+	stubCheckConfigConnect(t, nil)
+
+	var out bytes.Buffer
+	if _, err := runCommand([]string{"--check-config"}, &out); err == nil || !strings.Contains(out.String(), "FAILED") {
+		t.Errorf("expected an unreachable database to fail the check, got %v\n%s", err, out.String())
+	}
+
+	originalUsernameField, originalPasswordField := loginUsernameField, loginPasswordField
+	t.Cleanup(func() { loginUsernameField, loginPasswordField = originalUsernameField, originalPasswordField })
+	t.Setenv("LOGIN_USERNAME_FIELD", "user")
+	t.Setenv("LOGIN_PASSWORD_FIELD", "user")
+	out.Reset()
+	if _, err := runCommand([]string{"-check-config=true"}, &out); err == nil || !strings.Contains(out.String(), "configuration: FAILED") {
+		t.Errorf("expected invalid configuration to fail the check, got %v\n%s", err, out.String())
+	}
+}
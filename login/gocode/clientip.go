@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers are believed;
+// from anyone else the headers could be forged, so RemoteAddr is used instead
+var trustedProxies []*net.IPNet
+
+// trustProxyHeaders believes the forwarding headers from every peer; prefer listing the
+// proxies in TRUSTED_PROXIES
+var trustProxyHeaders = false
+
+// parseNetworks parses a list of CIDRs, where a bare IP stands for a single host
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip is in one of the trustedProxies ranges
+func isTrustedProxy(ip string) bool {
+	return inNetworks(ip, trustedProxies)
+}
+
+// inNetworks reports whether ip is in one of networks
+func inNetworks(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request, taken from the
+// forwarding headers only when the immediate peer is a trusted proxy
+func clientIP(request *http.Request) string {
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		peer = request.RemoteAddr
+	}
+	if !trustProxyHeaders && !isTrustedProxy(peer) {
+		return peer
+	}
+	if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		// each proxy appends the address it got the request from, so walk back from the
+		// end past our own proxies; anything before the first other address is forgeable
+		parts := strings.Split(forwarded, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(parts[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(request.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
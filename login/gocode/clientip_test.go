@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// trustProxies sets TRUSTED_PROXIES for the duration of a test
+func trustProxies(t *testing.T, cidrs ...string) {
+	original := trustedProxies
+	proxies, err := parseNetworks(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = original })
+}
+
+func TestClientIP(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8", "192.0.2.10")
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"no header", "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted proxy forwarded for", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"trusted single host", "192.0.2.10:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"forged entries before the client", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"trusted proxy real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.8"}, "203.0.113.8"},
+		{"untrusted peer forwarded for", "198.51.100.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "198.51.100.1"},
+		{"untrusted peer real ip", "198.51.100.1:1234", map[string]string{"X-Real-IP": "203.0.113.8"}, "198.51.100.1"},
+		{"garbage header", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "unknown"}, "10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			if got := clientIP(req); got != tc.want {
+				t.Errorf("clientIP = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTrustedProxies(t *testing.T) {
+	original := trustedProxies
+	t.Cleanup(func() { trustedProxies = original })
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 2001:db8::1")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !isTrustedProxy("10.1.2.3") || !isTrustedProxy("2001:db8::1") || isTrustedProxy("11.0.0.1") {
+		t.Errorf("unexpected trusted proxies %v", trustedProxies)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/33")
+	if err := loadConfig(); err == nil {
+		t.Error("an invalid proxy range should be rejected at startup")
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getEnvBool reads a boolean environment variable, returning def when unset or invalid
+func getEnvBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("invalid value, using default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvInt reads an integer environment variable, returning def when unset or invalid
+func getEnvInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("invalid value, using default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvInt64 reads a 64-bit integer environment variable, returning def when unset or invalid
+func getEnvInt64(key string, def int64) int64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		slog.Warn("invalid value, using default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvFloat reads a floating point environment variable, returning def when unset or invalid
+func getEnvFloat(key string, def float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("invalid value, using default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvDuration reads a duration environment variable (e.g. "500ms", "2s"), returning def when unset or invalid
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("invalid value, using default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvString reads a string environment variable, returning def when unset or empty
+func getEnvString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getEnvOrFile reads key from the file named by key_FILE when set, falling back to the
+// plain variable when the file is missing or unreadable
+func getEnvOrFile(key string) string {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(content))
+		}
+		slog.Warn("failed to read secret file, falling back to the variable", "key", key+"_FILE", "error", err)
+	}
+	return os.Getenv(key)
+}
+
+// getEnvList reads a comma-separated environment variable, returning def when unset
+func getEnvList(key string, def []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseFlags applies -http-port and -db-name and returns the -mongo-host, each flag
+// falling back to HTTP_PORT, DB_NAME and MONGODB_IP. A positional host argument is
+// still accepted for older deployments.
+func parseFlags(fs *flag.FlagSet, args []string) (string, error) {
+	mongoHost := fs.String("mongo-host", getEnvString("MONGODB_IP", localhost), "MongoDB host")
+	fs.IntVar(&http_port, "http-port", getEnvInt("HTTP_PORT", http_port), "HTTP port to listen on")
+	fs.StringVar(&database_name, "db-name", getEnvString("DB_NAME", database_name), "MongoDB database name")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+
+	hostSet := false
+	fs.Visit(func(f *flag.Flag) { hostSet = hostSet || f.Name == "mongo-host" })
+	if !hostSet && fs.NArg() > 0 {
+		slog.Warn("deprecated: pass the MongoDB host as -mongo-host instead of a positional argument")
+		*mongoHost = fs.Arg(0)
+	}
+	if *mongoHost == "" {
+		return localhost, nil
+	}
+	return *mongoHost, nil
+}
+
+// loadConfig overrides the package defaults with values from environment variables,
+// returning an error for settings the app cannot start with
+func loadConfig() error {
+	configureLogging()
+	if value := os.Getenv("APP_ENV"); value != "" {
+		appEnv = value
+	}
+	// the built-in seed credentials are public, so only development seeds them by default
+	seedDefaultUser = getEnvBool("SEED_DEFAULT_USER", appEnv == "development")
+	// reset tokens are credentials, so they only reach the log in development
+	logResetTokens = getEnvBool("LOG_RESET_TOKENS", logResetTokens)
+	if logResetTokens && appEnv == "production" {
+		return errors.New("LOG_RESET_TOKENS is not allowed in production")
+	}
+	seedUsername, usernameSet := os.LookupEnv("SEED_USERNAME")
+	if usernameSet {
+		username = seedUsername
+	}
+	seedPassword, passwordSet := os.LookupEnv("SEED_PASSWORD")
+	if passwordSet {
+		password = seedPassword
+	}
+	if path := os.Getenv("SEED_USERS_FILE"); path != "" {
+		users, err := loadSeedUsers(path)
+		if err != nil {
+			return fmt.Errorf("invalid SEED_USERS_FILE: %w", err)
+		}
+		seedUsers = users
+	}
+	if seedDefaultUser && len(seedUsers) == 0 && appEnv != "development" && !(usernameSet && passwordSet) {
+		return errors.New("SEED_DEFAULT_USER outside development needs SEED_USERNAME and SEED_PASSWORD; the built-in credentials are public")
+	}
+	if value := os.Getenv("FALLBACK_PASSWORD_HASH"); value != "" {
+		fallbackPasswordHash = value
+	}
+	if fallbackPasswordHash != "" && !validFallbackHash(fallbackPasswordHash) {
+		slog.Warn("fallback password hash is not a valid bcrypt hash; fallback login is disabled")
+	}
+	loginUsernameField = getEnvString("LOGIN_USERNAME_FIELD", loginUsernameField)
+	loginPasswordField = getEnvString("LOGIN_PASSWORD_FIELD", loginPasswordField)
+	if loginUsernameField == loginPasswordField {
+		return fmt.Errorf("invalid LOGIN_PASSWORD_FIELD: same as LOGIN_USERNAME_FIELD %q", loginUsernameField)
+	}
+	loginContentTypes = getEnvList("LOGIN_CONTENT_TYPES", loginContentTypes)
+	clearInvalidSessions = getEnvBool("CLEAR_INVALID_SESSIONS", clearInvalidSessions)
+	mongoConnectAttempts = getEnvInt("MONGO_CONNECT_ATTEMPTS", mongoConnectAttempts)
+	mongoConnectBaseDelay = getEnvDuration("MONGO_CONNECT_BASE_DELAY", mongoConnectBaseDelay)
+	mongoConnectTimeout = getEnvDuration("MONGO_CONNECT_TIMEOUT", mongoConnectTimeout)
+	dbWatchInterval = getEnvDuration("DB_WATCH_INTERVAL", dbWatchInterval)
+	mongoTLS = getEnvBool("MONGO_TLS", mongoTLS)
+	ensureIndexes = getEnvBool("ENSURE_INDEXES", ensureIndexes)
+	mongoCAFile = getEnvString("MONGO_CA_FILE", mongoCAFile)
+	uriOptions, err := parseMongoURIOptions(getEnvString("MONGO_URI_OPTIONS", mongoURIOptions))
+	if err != nil {
+		return fmt.Errorf("invalid MONGO_URI_OPTIONS: %w", err)
+	}
+	mongoURIOptions = uriOptions
+	userCacheTTL = getEnvDuration("USER_CACHE_TTL", userCacheTTL)
+	honeypotEnabled = getEnvBool("HONEYPOT_ENABLED", honeypotEnabled)
+	sessionTTL = getEnvDuration("SESSION_TTL", sessionTTL)
+	sessionGracePeriod = getEnvDuration("GRACE_PERIOD", sessionGracePeriod)
+	slidingSessions = getEnvBool("SESSION_SLIDING", slidingSessions)
+	sessionRefreshWindow = getEnvDuration("SESSION_REFRESH_WINDOW", sessionRefreshWindow)
+	sessionMaxLifetime = getEnvDuration("SESSION_MAX_LIFETIME", sessionMaxLifetime)
+	maxSessionsPerUser = getEnvInt("MAX_SESSIONS_PER_USER", maxSessionsPerUser)
+	dbDrainTimeout = getEnvDuration("DB_DRAIN_TIMEOUT", dbDrainTimeout)
+	shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", shutdownTimeout)
+	loginBodyLimit = getEnvInt64("LOGIN_MAX_BODY_BYTES", loginBodyLimit)
+	importBodyLimit = getEnvInt64("IMPORT_MAX_BODY_BYTES", importBodyLimit)
+	maxBodyBytes = getEnvInt64("MAX_BODY_BYTES", maxBodyBytes)
+	maxFailedLogins = getEnvInt("MAX_FAILED_LOGINS", maxFailedLogins)
+	lockoutDuration = getEnvDuration("LOCKOUT_DURATION", lockoutDuration)
+	allowedOrigins = getEnvList("ALLOWED_ORIGINS", allowedOrigins)
+	if value, ok := os.LookupEnv("AUTH_USER_HEADER"); ok {
+		authUserHeader = value
+	}
+	methodOverrideEnabled = getEnvBool("METHOD_OVERRIDE", methodOverrideEnabled)
+	csrfProtection = getEnvBool("CSRF_PROTECTION", csrfProtection)
+	caseInsensitiveUsernames = getEnvBool("USERNAME_CASE_INSENSITIVE", caseInsensitiveUsernames)
+	minUsernameLength = getEnvInt("USERNAME_MIN_LENGTH", minUsernameLength)
+	maxUsernameLength = getEnvInt("USERNAME_MAX_LENGTH", maxUsernameLength)
+	if minUsernameLength < 1 || maxUsernameLength < minUsernameLength {
+		return fmt.Errorf("invalid USERNAME_MIN_LENGTH/USERNAME_MAX_LENGTH: %d-%d", minUsernameLength, maxUsernameLength)
+	}
+	if value := os.Getenv("SESSION_COOKIE_NAME"); value != "" {
+		sessionCookieName = value
+	}
+	if domain := getEnvString("SESSION_COOKIE_DOMAIN", sessionCookieDomain); domain == "" || validCookieDomain(domain) {
+		sessionCookieDomain = domain
+	} else {
+		slog.Warn("invalid SESSION_COOKIE_DOMAIN, expected a host name like example.com", "value", domain)
+	}
+	if path := getEnvString("SESSION_COOKIE_PATH", sessionCookiePath); validCookiePath(path) {
+		sessionCookiePath = path
+	} else {
+		slog.Warn("invalid SESSION_COOKIE_PATH, expected an absolute path like /app", "value", path)
+	}
+	switch backend := getEnvString("SESSION_BACKEND", sessionBackendCookie); backend {
+	case sessionBackendCookie:
+		sessionStore = cookieSessionStore{}
+	case sessionBackendMemory:
+		sessionStore = newMemorySessionStore()
+	case sessionBackendRedis:
+		redisAddr = getEnvString("REDIS_ADDR", redisAddr)
+		redisPassword = getEnvOrFile("REDIS_PASSWORD")
+		redisTimeout = getEnvDuration("REDIS_TIMEOUT", redisTimeout)
+		redisFallback = getEnvBool("REDIS_FALLBACK", redisFallback)
+		store, err := connectRedisSessionStore()
+		if err != nil {
+			return fmt.Errorf("invalid SESSION_BACKEND=redis: %w", err)
+		}
+		sessionStore = store
+	default:
+		return fmt.Errorf("invalid SESSION_BACKEND %q, expected cookie, memory or redis", backend)
+	}
+	sessionSignOnly = getEnvBool("SESSION_SIGN_ONLY", sessionSignOnly)
+	appName = getEnvString("APP_NAME", appName)
+	if text := os.Getenv("WELCOME_MESSAGE"); text != "" {
+		if err := loadWelcomeTemplate(text); err != nil {
+			return fmt.Errorf("invalid WELCOME_MESSAGE: %w", err)
+		}
+	}
+	if path := os.Getenv("ERROR_TEMPLATE_FILE"); path != "" {
+		if err := loadErrorTemplate(path); err != nil {
+			return fmt.Errorf("invalid ERROR_TEMPLATE_FILE: %w", err)
+		}
+	}
+	if err := loadOIDCConfig(); err != nil {
+		return fmt.Errorf("invalid OIDC configuration: %w", err)
+	}
+	if err := loadCookieKeys(); err != nil {
+		// random keys would log everyone out on restart and differ between replicas
+		return fmt.Errorf("invalid session keys: %w", err)
+	}
+	if value := os.Getenv("JWT_SECRET"); value != "" {
+		jwtSecret = []byte(value)
+	}
+	jwtTTL = getEnvDuration("JWT_TTL", jwtTTL)
+	switch mode := getEnvString("AUTH_MODE", authMode); mode {
+	case authModeCookie, authModeJWT:
+		authMode = mode
+	default:
+		slog.Warn("invalid AUTH_MODE, expected cookie or jwt", "value", mode)
+	}
+	jwtMaxTTL = getEnvDuration("JWT_MAX_TTL", jwtMaxTTL)
+	if jwtTTL > jwtMaxTTL {
+		slog.Warn("JWT_TTL exceeds JWT_MAX_TTL, issuing tokens for the maximum", "jwt_ttl", jwtTTL, "jwt_max_ttl", jwtMaxTTL)
+		jwtTTL = jwtMaxTTL
+	}
+	rateLimitPerSecond = getEnvFloat("RATE_LIMIT_RPS", rateLimitPerSecond)
+	rateLimitBurst = getEnvInt("RATE_LIMIT_BURST", rateLimitBurst)
+	maxInflightRequests = getEnvInt("MAX_INFLIGHT_REQUESTS", maxInflightRequests)
+	tenantSource = getEnvString("TENANT_SOURCE", tenantSource)
+	tenantHeader = getEnvString("TENANT_HEADER", tenantHeader)
+	tenantDomain = getEnvString("TENANT_DOMAIN", tenantDomain)
+	tenants = getEnvList("TENANTS", tenants)
+	if err := validateTenantConfig(); err != nil {
+		return err
+	}
+	switch storeBackend = getEnvString("STORE_BACKEND", storeBackendMongo); storeBackend {
+	case storeBackendMongo:
+	case storeBackendSQL:
+		if tenantSource != "" {
+			return fmt.Errorf("TENANT_SOURCE needs STORE_BACKEND=mongo")
+		}
+		sqlDriver = getEnvString("SQL_DRIVER", sqlDriver)
+		sqlDSN = getEnvOrFile("SQL_DSN")
+		store, err := openSQLUserStore(sqlDriver, sqlDSN)
+		if err != nil {
+			return fmt.Errorf("invalid STORE_BACKEND=sql: %w", err)
+		}
+		userStore = store
+	default:
+		return fmt.Errorf("invalid STORE_BACKEND %q, expected mongo or sql", storeBackend)
+	}
+	trustProxyHeaders = getEnvBool("TRUST_PROXY_HEADERS", trustProxyHeaders)
+	// a mistyped range would silently key rate limits and audits on the proxy's address
+	proxies, err := parseNetworks(getEnvList("TRUSTED_PROXIES", nil))
+	if err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	trustedProxies = proxies
+	allowed, err := parseNetworks(getEnvList("ALLOWED_CIDRS", nil))
+	if err != nil {
+		return fmt.Errorf("invalid ALLOWED_CIDRS: %w", err)
+	}
+	allowedNetworks = allowed
+	if redirect := getEnvString("LOGOUT_REDIRECT", logoutRedirect); safeNext(redirect) != "" {
+		logoutRedirect = redirect
+	} else {
+		slog.Warn("invalid LOGOUT_REDIRECT, expected a local path like /goodbye", "value", redirect)
+	}
+	pages, err := parseLandingPages(getEnvList("LANDING_PAGES", nil))
+	if err != nil {
+		return fmt.Errorf("invalid LANDING_PAGES: %w", err)
+	}
+	landingPages = pages
+	usersPageDefaultLimit = getEnvInt64("USERS_PAGE_DEFAULT_LIMIT", usersPageDefaultLimit)
+	usersPageMaxLimit = getEnvInt64("USERS_PAGE_MAX_LIMIT", usersPageMaxLimit)
+	logoutConfirm = getEnvBool("LOGOUT_CONFIRM", logoutConfirm)
+	contentSecurityPolicy = getEnvString("CONTENT_SECURITY_POLICY", contentSecurityPolicy)
+	switch strings.ToLower(os.Getenv("SESSION_SAMESITE")) {
+	case "":
+	case "strict":
+		sessionSameSite = http.SameSiteStrictMode
+	case "lax":
+		sessionSameSite = http.SameSiteLaxMode
+	default:
+		slog.Warn("invalid SESSION_SAMESITE, expected strict or lax", "value", os.Getenv("SESSION_SAMESITE"))
+	}
+	resetTokenTTL = getEnvDuration("RESET_TOKEN_TTL", resetTokenTTL)
+	bindAddr = getEnvString("BIND_ADDR", bindAddr)
+	httpReadHeaderTimeout = getEnvDuration("HTTP_READ_HEADER_TIMEOUT", httpReadHeaderTimeout)
+	httpReadTimeout = getEnvDuration("HTTP_READ_TIMEOUT", httpReadTimeout)
+	httpWriteTimeout = getEnvDuration("HTTP_WRITE_TIMEOUT", httpWriteTimeout)
+	httpIdleTimeout = getEnvDuration("HTTP_IDLE_TIMEOUT", httpIdleTimeout)
+	switch sink := getEnvString("AUDIT_SINK", auditSink); sink {
+	case auditSinkLog, auditSinkMongo:
+		auditSink = sink
+	default:
+		slog.Warn("invalid AUDIT_SINK, expected log or mongo", "value", sink)
+	}
+	readyInFallback = getEnvBool("READY_IN_FALLBACK", readyInFallback)
+	fallbackWarnInterval = getEnvDuration("FALLBACK_WARN_INTERVAL", fallbackWarnInterval)
+	verifyTokenUser = getEnvBool("TOKEN_VERIFY_USER", verifyTokenUser)
+	switch status := getEnvInt("TOKEN_DELETED_USER_STATUS", deletedUserTokenStatus); status {
+	case http.StatusGone, http.StatusUnauthorized:
+		deletedUserTokenStatus = status
+	default:
+		slog.Warn("invalid TOKEN_DELETED_USER_STATUS, using the default", "value", status, "default", deletedUserTokenStatus)
+	}
+	// an unusable cost would only surface at the first hash, so refuse to start instead
+	cost := getEnvInt("BCRYPT_COST", bcryptCost)
+	if err := validBcryptCost(cost); err != nil {
+		return fmt.Errorf("invalid BCRYPT_COST: %w", err)
+	}
+	bcryptCost = cost
+	return nil
+}
+
+// redacted hides a secret in logs while still showing whether it is set
+func redacted(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// logEffectiveConfig logs the settings the app starts with once loadConfig has run, so
+// deployments can check which values took effect. Passwords and keys are redacted.
+func logEffectiveConfig(mongodb_ip string) {
+	user, pass := getMongoDBCredentials()
+	slog.Info("effective configuration",
+		"app_env", appEnv,
+		"http_port", http_port,
+		"mongodb_host", mongodb_ip,
+		"mongodb_port", mongodb_port,
+		"mongodb_uri", mongoURI(mongodb_ip, user, redacted(pass)),
+		"database", database_name,
+		"collection", collection_name,
+		"mongo_tls", mongoTLS,
+		"seed_default_user", seedDefaultUser,
+		"seed_username", username,
+		"seed_password", redacted(password),
+		"seed_users", len(seedUsers),
+		"auth_mode", authMode,
+		"jwt_secret", redacted(string(jwtSecret)),
+		"session_hash_key", redacted(os.Getenv("SESSION_HASH_KEY")),
+		"session_block_key", redacted(os.Getenv("SESSION_BLOCK_KEY")),
+		"session_sign_only", sessionSignOnly,
+		"redis_addr", redisAddr,
+		"redis_password", redacted(redisPassword),
+		"tenant_source", tenantSource,
+		"oidc_issuer", oidcIssuer,
+		"oidc_client_secret", redacted(oidcClientSecret),
+		"oidc_link_existing", oidcLinkExisting,
+	)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// minHashKeyLength is the shortest hash key accepted; securecookie recommends 32 or 64 bytes
+const minHashKeyLength = 32
+
+// sessionSignOnly makes new session cookies signed but not encrypted, leaving their
+// content readable by the client; for environments that don't need confidentiality
+var sessionSignOnly = false
+
+// loadCookieKeys replaces the random per-process cookie keys with configured ones so
+// sessions survive restarts. SESSION_HASH_KEY and SESSION_BLOCK_KEY (base64) sign and
+// encrypt new cookies; SESSION_PREVIOUS_KEYS lists retired "hash:block" pairs that still
+// verify. A missing block key is an error unless sessionSignOnly asks for plain signing.
+func loadCookieKeys() error {
+	hashKey := os.Getenv("SESSION_HASH_KEY")
+	if hashKey == "" {
+		slog.Warn("SESSION_HASH_KEY not set, session cookies use random keys and won't survive a restart")
+		if sessionSignOnly {
+			cookieCodecs = securecookie.CodecsFromPairs(securecookie.GenerateRandomKey(64), nil)
+		}
+		return nil
+	}
+	blockKey := os.Getenv("SESSION_BLOCK_KEY")
+	if sessionSignOnly {
+		blockKey = ""
+	} else if blockKey == "" {
+		return errors.New("SESSION_BLOCK_KEY is required with SESSION_HASH_KEY; set SESSION_SIGN_ONLY to sign cookies without encrypting them")
+	}
+	pairs := []string{hashKey + ":" + blockKey}
+	if previous := os.Getenv("SESSION_PREVIOUS_KEYS"); previous != "" {
+		pairs = append(pairs, strings.Split(previous, ",")...)
+	}
+	codecs, err := cookieCodecsFromPairs(pairs)
+	if err != nil {
+		return err
+	}
+	cookieCodecs = codecs
+	return nil
+}
+
+// cookieCodecsFromPairs builds codecs from base64 "hash:block" pairs, current key first;
+// the block key may be left empty to sign without encrypting
+func cookieCodecsFromPairs(pairs []string) ([]securecookie.Codec, error) {
+	var keys [][]byte
+	for i, pair := range pairs {
+		hashPart, blockPart, _ := strings.Cut(strings.TrimSpace(pair), ":")
+		hashKey, err := base64.StdEncoding.DecodeString(hashPart)
+		if err != nil || len(hashKey) == 0 {
+			return nil, fmt.Errorf("cookie key %d: invalid hash key", i)
+		}
+		if n := len(hashKey); n < minHashKeyLength {
+			return nil, fmt.Errorf("cookie key %d: hash key must be at least %d bytes, got %d", i, minHashKeyLength, n)
+		}
+		blockKey, err := base64.StdEncoding.DecodeString(blockPart)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %d: invalid block key", i)
+		}
+		if n := len(blockKey); n != 0 && n != 16 && n != 24 && n != 32 {
+			return nil, fmt.Errorf("cookie key %d: block key must be 16, 24 or 32 bytes, got %d", i, n)
+		}
+		if len(blockKey) == 0 {
+			blockKey = nil
+		}
+		keys = append(keys, hashKey, blockKey)
+	}
+	return securecookie.CodecsFromPairs(keys...), nil
+}
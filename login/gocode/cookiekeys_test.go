@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+// randomKeyPair returns a base64 "hash:block" pair
+func randomKeyPair() string {
+	return base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)) + ":" +
+		base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// useCookieCodecs swaps the session codecs for the duration of a test
+func useCookieCodecs(t *testing.T, pairs ...string) []securecookie.Codec {
+	codecs, err := cookieCodecsFromPairs(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := cookieCodecs
+	cookieCodecs = codecs
+	t.Cleanup(func() { cookieCodecs = original })
+	return codecs
+}
+
+func sessionCookie(t *testing.T, userName string) *http.Cookie {
+	rr := httptest.NewRecorder()
+	setSession(userName, rr)
+	return rr.Result().Cookies()[0]
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	oldKey, newKey := randomKeyPair(), randomKeyPair()
+	oldCodecs := useCookieCodecs(t, oldKey)
+	oldCookie := sessionCookie(t, "testuser")
+
+	newCodecs := useCookieCodecs(t, newKey, oldKey)[:1]
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(oldCookie)
+	if userName := getUserName(req); userName != "testuser" {
+		t.Errorf("a cookie signed with the previous key should still decode, got %q", userName)
+	}
+
+	newCookie := sessionCookie(t, "testuser")
+	value := map[string]string{}
+	if err := securecookie.DecodeMulti(sessionCookieName, newCookie.Value, &value, newCodecs...); err != nil {
+		t.Errorf("new cookies should be signed with the current key: %v", err)
+	}
+	if err := securecookie.DecodeMulti(sessionCookieName, newCookie.Value, &value, oldCodecs...); err == nil {
+		t.Error("new cookies should not be signed with the previous key")
+	}
+}
+
+func TestLoadCookieKeysFromEnv(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	t.Setenv("SESSION_HASH_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)))
+	t.Setenv("SESSION_BLOCK_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
+	t.Setenv("SESSION_PREVIOUS_KEYS", randomKeyPair()+","+randomKeyPair())
+
+	if err := loadCookieKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cookieCodecs) != 3 {
+		t.Errorf("expected the current and two previous codecs, got %d", len(cookieCodecs))
+	}
+
+	t.Setenv("SESSION_BLOCK_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if err := loadCookieKeys(); err == nil {
+		t.Error("a block key of invalid length should be rejected")
+	}
+}
+
+func TestLoadCookieKeysAppliesConfiguredKeys(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	hashKey, blockKey := securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)
+	t.Setenv("SESSION_HASH_KEY", base64.StdEncoding.EncodeToString(hashKey))
+	t.Setenv("SESSION_BLOCK_KEY", base64.StdEncoding.EncodeToString(blockKey))
+	if err := loadCookieKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := sessionCookie(t, "testuser")
+	value := map[string]string{}
+	if err := securecookie.New(hashKey, blockKey).Decode(sessionCookieName, cookie.Value, &value); err != nil {
+		t.Fatalf("new cookies should use the configured keys: %v", err)
+	}
+	if value["name"] != "testuser" {
+		t.Errorf("expected the session user, got %v", value)
+	}
+	if err := securecookie.New(hashKey, nil).Decode(sessionCookieName, cookie.Value, &value); err == nil {
+		t.Error("cookies should be encrypted when a block key is configured")
+	}
+}
+
+func TestLoadCookieKeysSignOnly(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	original := sessionSignOnly
+	t.Cleanup(func() { sessionSignOnly = original })
+	sessionSignOnly = true
+	hashKey := securecookie.GenerateRandomKey(64)
+	t.Setenv("SESSION_HASH_KEY", base64.StdEncoding.EncodeToString(hashKey))
+	t.Setenv("SESSION_BLOCK_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
+	if err := loadCookieKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	value := map[string]string{}
+	if err := securecookie.New(hashKey, nil).Decode(sessionCookieName, sessionCookie(t, "testuser").Value, &value); err != nil {
+		t.Fatalf("sign-only cookies should decode with the hash key alone: %v", err)
+	}
+	if value["name"] != "testuser" {
+		t.Errorf("expected the session user, got %v", value)
+	}
+}
+
+func TestLoadCookieKeysRequiresBlockKeyUnlessSignOnly(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	original := sessionSignOnly
+	t.Cleanup(func() { sessionSignOnly = original })
+	sessionSignOnly = false
+	t.Setenv("SESSION_HASH_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)))
+	t.Setenv("SESSION_BLOCK_KEY", "")
+	if err := loadCookieKeys(); err == nil {
+		t.Error("a hash key without a block key should be rejected unless SESSION_SIGN_ONLY is set")
+	}
+
+	sessionSignOnly = true
+	if err := loadCookieKeys(); err != nil {
+		t.Errorf("SESSION_SIGN_ONLY should allow a hash key alone, got %v", err)
+	}
+}
+
+func TestLoadCookieKeysRejectsShortHashKey(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	t.Setenv("SESSION_HASH_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(16)))
+	t.Setenv("SESSION_BLOCK_KEY", base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)))
+	if err := loadCookieKeys(); err == nil {
+		t.Error("a hash key shorter than 32 bytes should be rejected")
+	}
+}
+
+func TestLoadConfigRejectsInvalidSessionKeys(t *testing.T) {
+	useCookieCodecs(t, randomKeyPair())
+	t.Setenv("SESSION_HASH_KEY", "not base64!")
+	if err := loadConfig(); err == nil {
+		t.Error("loadConfig should fail instead of falling back to random keys")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// allowedOrigins lists the browser origins allowed to call the /api/* routes with the
+// session cookie. "*" lets any other origin call them without credentials, e.g. with a
+// bearer token; browsers then neither send nor accept cookies.
+var allowedOrigins []string
+
+// CORS response values for the JSON API
+const (
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, Authorization, X-Requested-With, X-CSRF-Token"
+	corsMaxAge       = "600"
+)
+
+// originAllowed reports whether origin is listed by name in allowedOrigins
+func originAllowed(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOriginAllowed reports whether allowedOrigins includes "*"
+func anyOriginAllowed() bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds CORS headers to /api/* responses. Origins listed by name get their
+// origin echoed back with credentials allowed, since the session cookie makes these
+// credentialed requests; the "*" wildcard never allows credentials.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if strings.HasPrefix(request.URL.Path, "/api/") {
+			response.Header().Add("Vary", "Origin")
+			if origin := request.Header.Get("Origin"); origin != "" {
+				if originAllowed(origin) {
+					response.Header().Set("Access-Control-Allow-Origin", origin)
+					response.Header().Set("Access-Control-Allow-Credentials", "true")
+				} else if anyOriginAllowed() {
+					response.Header().Set("Access-Control-Allow-Origin", "*")
+				}
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// preflightHandler answers CORS preflight (OPTIONS) requests for the /api/* routes
+func preflightHandler(response http.ResponseWriter, request *http.Request) {
+	if response.Header().Get("Access-Control-Allow-Origin") != "" {
+		response.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		response.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		response.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
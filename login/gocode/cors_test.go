@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// allowOrigins sets allowedOrigins for the duration of the test
+func allowOrigins(t *testing.T, origins ...string) {
+	original := allowedOrigins
+	allowedOrigins = origins
+	t.Cleanup(func() { allowedOrigins = original })
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	allowOrigins(t, "https://app.example.com")
+	useMemoryUserStore(t, newMemoryUserStore())
+
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader("[]"))
+	req.Header.Set("Origin", "https://app.example.com")
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("allowed origin should be echoed, got %q", origin)
+	}
+	if rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("credentialed requests need Access-Control-Allow-Credentials")
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	allowOrigins(t, "https://app.example.com")
+
+	req := httptest.NewRequest("OPTIONS", "/api/users/import", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("disallowed origin should not get CORS headers, got %q", origin)
+	}
+	if methods := rr.Header().Get("Access-Control-Allow-Methods"); methods != "" {
+		t.Errorf("disallowed origin should not get allowed methods, got %q", methods)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	allowOrigins(t, "https://app.example.com")
+
+	req := httptest.NewRequest("OPTIONS", "/api/users/import", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight should return 204, got %d", rr.Code)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Error("preflight should echo the allowed origin")
+	}
+	if !strings.Contains(rr.Header().Get("Access-Control-Allow-Methods"), "POST") {
+		t.Error("preflight should list POST as an allowed method")
+	}
+	if !strings.Contains(rr.Header().Get("Access-Control-Allow-Headers"), "Content-Type") {
+		t.Error("preflight should allow the Content-Type header")
+	}
+}
+
+func TestCORSNotAppliedOutsideAPI(t *testing.T) {
+	allowOrigins(t, "https://app.example.com")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("CORS headers should only be set on /api/* routes")
+	}
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	allowOrigins(t, "https://app.example.com", "*")
+
+	request := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/api/users/import", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("https://evil.example.com")
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("the wildcard should answer \"*\", got %q", origin)
+	}
+	if credentials := rr.Header().Get("Access-Control-Allow-Credentials"); credentials != "" {
+		t.Errorf("the wildcard must not allow credentials, got %q", credentials)
+	}
+
+	rr = request("https://app.example.com")
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" || rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("listed origins should keep credentials, got %q", origin)
+	}
+}
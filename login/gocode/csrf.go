@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// csrfProtection (CSRF_PROTECTION) requires a CSRF token on state-changing requests that
+// carry a session cookie; SameSite=Lax cookies alone don't cover every browser
+var csrfProtection = false
+
+// where clients send the token: AJAX requests in a header, HTML forms in a hidden field
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// csrfBinding ties tokens to one session cookie, so a token can't be replayed with another
+func csrfBinding(sessionCookie string) string {
+	sum := sha256.Sum256([]byte(sessionCookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// csrfToken returns a token for the request's session, or "" without a session cookie.
+// Tokens are signed with the cookie keys, so every instance sharing them accepts them.
+func csrfToken(request *http.Request) (string, error) {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	return securecookie.EncodeMulti(csrfField, csrfBinding(cookie.Value), cookieCodecs[:1]...)
+}
+
+// validCSRFToken reports whether the request carries a token issued for its session cookie
+func validCSRFToken(request *http.Request) bool {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+	token := request.Header.Get(csrfHeader)
+	if token == "" && csrfFormBody(request) {
+		token = request.PostFormValue(csrfField)
+	}
+	var binding string
+	if token == "" || securecookie.DecodeMulti(csrfField, token, &binding, cookieCodecs...) != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(binding), []byte(csrfBinding(cookie.Value))) == 1
+}
+
+// csrfFormBody reports whether the request body is a form that may carry the token field;
+// other bodies are left for the route to read
+func csrfFormBody(request *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+// csrfExempt lists the state-changing routes that work without a session, where a stale
+// session cookie must not get in the way
+var csrfExempt = map[string]bool{
+	"/login":     true,
+	"/api/token": true,
+}
+
+// csrfFormCheckKey marks requests whose token has to be read from a form body; bodyLimit
+// checks it, so the form is only read within the route's own limit
+type csrfFormCheckKey struct{}
+
+// csrfFormCheckPending reports whether csrfMiddleware left the request's form token to bodyLimit
+func csrfFormCheckPending(request *http.Request) bool {
+	pending, _ := request.Context().Value(csrfFormCheckKey{}).(bool)
+	return pending
+}
+
+// csrfMiddleware rejects state-changing requests authenticated by a session cookie that
+// lack a valid token (see csrfProtection). Bearer token requests aren't affected, since
+// browsers don't attach those on their own. A token in a form body is left to bodyLimit,
+// which every route taking a body is registered with.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(response, request)
+			return
+		}
+		if csrfProtection && !csrfExempt[request.URL.Path] && getUserName(request) != "" {
+			if request.Header.Get(csrfHeader) == "" && csrfFormBody(request) {
+				request = request.WithContext(context.WithValue(request.Context(), csrfFormCheckKey{}, true))
+			} else if !validCSRFToken(request) {
+				httpError(response, request, http.StatusForbidden, errCodeForbidden, "missing or invalid CSRF token")
+				return
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// csrfFormField is the hidden form field carrying the request's token, empty when
+// protection is off
+func csrfFormField(request *http.Request) string {
+	if !csrfProtection {
+		return ""
+	}
+	token, err := csrfToken(request)
+	if err != nil || token == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n    <input type=\"hidden\" name=\"%s\" value=\"%s\">", csrfField, html.EscapeString(token))
+}
+
+// csrfTokenResponse is the body of GET /csrf-token
+type csrfTokenResponse struct {
+	Token  string `json:"token"`
+	Header string `json:"header"`
+	Field  string `json:"field"`
+}
+
+// csrfTokenHandler hands a fresh token to scripts, for SPA sessions that outlive the
+// page they were loaded with; mount it behind requireAuth
+func csrfTokenHandler(response http.ResponseWriter, request *http.Request) {
+	token, err := csrfToken(request)
+	if err != nil || token == "" {
+		httpError(response, request, http.StatusInternalServerError, errCodeInternal, "failed to issue CSRF token")
+		return
+	}
+	writeJSON(response, http.StatusOK, csrfTokenResponse{Token: token, Header: csrfHeader, Field: csrfField})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// enableCSRFProtection turns on CSRF_PROTECTION for the duration of a test
+func enableCSRFProtection(t *testing.T) {
+	original := csrfProtection
+	csrfProtection = true
+	t.Cleanup(func() { csrfProtection = original })
+}
+
+// fetchCSRFToken asks /csrf-token for a token like a script would
+func fetchCSRFToken(t *testing.T, app *testApp, cookie *http.Cookie) string {
+	req := httptest.NewRequest("GET", "/csrf-token", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := app.do(req, cookie)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 from /csrf-token, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body csrfTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Token == "" || body.Header != csrfHeader {
+		t.Fatalf("unexpected /csrf-token body %+v", body)
+	}
+	return body.Token
+}
+
+func TestCSRFTokenValidatesProtectedPost(t *testing.T) {
+	enableCSRFProtection(t)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+	cookie := app.loginCookie("bob", "secret")
+
+	if rr := app.postForm("/logout", nil, cookie); rr.Code != http.StatusForbidden {
+		t.Errorf("expected a POST without a token to be refused, got %d", rr.Code)
+	}
+
+	token := fetchCSRFToken(t, app, cookie)
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.Header.Set(csrfHeader, token)
+	if rr := app.do(req, cookie); rr.Code != http.StatusFound {
+		t.Errorf("expected the header token to be accepted, got %d", rr.Code)
+	}
+
+	// HTML forms carry it in a hidden field
+	cookie = app.loginCookie("bob", "secret")
+	if rr := app.postForm("/logout", url.Values{csrfField: {fetchCSRFToken(t, app, cookie)}}, cookie); rr.Code != http.StatusFound {
+		t.Errorf("expected the form token to be accepted, got %d", rr.Code)
+	}
+}
+
+func TestCSRFTokenBoundToSession(t *testing.T) {
+	enableCSRFProtection(t)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"}, User{Username: "eve", Password: "secret"})
+	bob := app.loginCookie("bob", "secret")
+	eve := app.loginCookie("eve", "secret")
+
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.Header.Set(csrfHeader, fetchCSRFToken(t, app, eve))
+	if rr := app.do(req, bob); rr.Code != http.StatusForbidden {
+		t.Errorf("expected another session's token to be refused, got %d", rr.Code)
+	}
+}
+
+func TestCSRFTokenRequiresSession(t *testing.T) {
+	app := newTestApp(t)
+
+	req := httptest.NewRequest("GET", "/csrf-token", nil)
+	req.Header.Set("Accept", "application/json")
+	if rr := app.do(req); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rr.Code)
+	}
+}
+
+func TestInternalPageFormsCarryCSRFToken(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob"})
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	if body := app.get("/internal", cookie).Body.String(); strings.Contains(body, csrfField) {
+		t.Error("forms should not carry a token while protection is off")
+	}
+	enableCSRFProtection(t)
+	if body := app.get("/internal", cookie).Body.String(); strings.Count(body, `name="`+csrfField+`"`) != 3 {
+		t.Errorf("expected each of the internal page forms to carry a token, got %s", body)
+	}
+}
+
+func TestCSRFFormTokenReadWithinRouteBodyLimit(t *testing.T) {
+	enableCSRFProtection(t)
+	app := newTestApp(t, User{Username: "bob", Password: "oldpass123"})
+	cookie := app.loginCookie("bob", "oldpass123")
+
+	// within maxBodyBytes but over the route's loginBodyLimit, streamed without a length
+	form := url.Values{
+		csrfField:      {fetchCSRFToken(t, app, cookie)},
+		"old_password": {"oldpass123"},
+		"new_password": {"newpass456"},
+		"padding":      {strings.Repeat("x", int(loginBodyLimit))},
+	}
+	req := httptest.NewRequest("POST", "/change-password", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = -1
+	if rr := app.do(req, cookie); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the route's own limit to apply, got %d", rr.Code)
+	}
+	if !verifyCredentials(context.Background(), "bob", "oldpass123") {
+		t.Error("the password should be unchanged")
+	}
+}
+
+func TestCSRFLeavesRouteBodyLimitAlone(t *testing.T) {
+	enableCSRFProtection(t)
+	app := newTestApp(t, User{Username: username, Password: password, Role: roleAdmin})
+	cookie := app.loginCookie(username, password)
+	token := fetchCSRFToken(t, app, cookie)
+
+	// larger than maxBodyBytes, within importBodyLimit
+	padding := strings.Repeat(" ", int(maxBodyBytes)/2*3)
+	body := `[` + padding + `{"username":"alice","password":"alicepass1"}]`
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, token)
+	rr := app.do(req, cookie)
+
+	var result importResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the import to go through, got %d: %.200s", rr.Code, rr.Body.String())
+	}
+	if result.Imported != 1 {
+		t.Errorf("expected alice to be imported, got %+v", result)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// mongoClient is the client behind usersCollection, kept so it can be disconnected on
+// shutdown. watchDB replaces it while handlers ping it, so like usersCollection it is only
+// accessed through currentMongoClient and setMongoClient.
+var (
+	mongoClientMu sync.RWMutex
+	mongoClient   *mongo.Client
+)
+
+// currentMongoClient returns the MongoDB client, or nil without a database
+func currentMongoClient() *mongo.Client {
+	mongoClientMu.RLock()
+	defer mongoClientMu.RUnlock()
+	return mongoClient
+}
+
+// setMongoClient replaces the MongoDB client, returning the previous one
+func setMongoClient(client *mongo.Client) *mongo.Client {
+	mongoClientMu.Lock()
+	defer mongoClientMu.Unlock()
+	previous := mongoClient
+	mongoClient = client
+	return previous
+}
+
+// dbDrainTimeout bounds how long shutdown waits for in-flight DB operations
+var dbDrainTimeout = 10 * time.Second
+
+// dbInFlight tracks DB operations that are still running
+var dbInFlight sync.WaitGroup
+
+// trackDBOp marks the start of a DB operation and returns the func that marks its end
+func trackDBOp() func() {
+	dbInFlight.Add(1)
+	return dbInFlight.Done
+}
+
+// drainDBOperations waits for in-flight DB operations, returning false if ctx ends first
+func drainDBOperations(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		dbInFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdownDB lets in-flight DB operations finish (up to dbDrainTimeout) and then
+// disconnects the MongoDB client
+func shutdownDB() {
+	ctx, cancel := context.WithTimeout(context.Background(), dbDrainTimeout)
+	defer cancel()
+	if !drainDBOperations(ctx) {
+		slog.Warn("timed out waiting for in-flight database operations")
+	}
+	if err := disconnectDB(ctx); err != nil {
+		slog.Error("failed to disconnect from MongoDB", "error", err)
+	}
+}
+
+// disconnectDB releases the MongoDB client; it is a no-op without a client and safe to
+// call more than once
+func disconnectDB(ctx context.Context) error {
+	client := setMongoClient(nil)
+	if client == nil {
+		return nil
+	}
+	if err := client.Disconnect(ctx); err != nil {
+		return err
+	}
+	slog.Info("disconnected from MongoDB")
+	return nil
+}
+
+// mongoTLS makes connectDB use TLS, as managed MongoDB services require
+var mongoTLS = false
+
+// mongoCAFile is a PEM bundle of CAs to verify the server with; the system roots are
+// used when it is empty
+var mongoCAFile = ""
+
+// mongoURIOptions (MONGO_URI_OPTIONS) is a query string of connection string options,
+// like retryWrites=true&w=majority, appended to the URI built by mongoURI
+var mongoURIOptions = ""
+
+// parseMongoURIOptions validates a MONGO_URI_OPTIONS value, returning it without a
+// leading "?"; every option must be a key=value pair
+func parseMongoURIOptions(raw string) (string, error) {
+	raw = strings.TrimPrefix(strings.TrimSpace(raw), "?")
+	if raw == "" {
+		return "", nil
+	}
+	for _, pair := range strings.Split(raw, "&") {
+		key, _, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return "", fmt.Errorf("expected key=value, got %q", pair)
+		}
+	}
+	if _, err := url.ParseQuery(raw); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// withURIOptions appends query to uri, joining with "?" or "&" as needed
+func withURIOptions(uri string, query string) string {
+	if query == "" {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + query
+	}
+	return uri + "?" + query
+}
+
+// mongoClientOptions builds the client options for uri, adding the TLS config when
+// mongoTLS is set
+func mongoClientOptions(uri string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri)
+	if !mongoTLS {
+		return opts, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if mongoCAFile != "" {
+		pem, err := os.ReadFile(mongoCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MONGO_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MONGO_CA_FILE %s contains no PEM certificates", mongoCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return opts.SetTLSConfig(tlsConfig), nil
+}
+
+// dbWatchInterval is how often watchDB checks the connection; zero disables it
+var dbWatchInterval = 30 * time.Second
+
+// pingFunc checks a collection's connection; swapped out in tests
+var pingFunc = pingCollection
+
+// pingCollection pings the server behind collection
+func pingCollection(ctx context.Context, collection *mongo.Collection) error {
+	defer trackDBOp()()
+	return collection.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// watchDB checks the connection every interval until ctx is done, reconnecting when
+// it is missing or lost
+func watchDB(ctx context.Context, mongodb_ip string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reconnectIfLost(ctx, mongodb_ip)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconnectIfLost pings the current collection and, when there is none or the ping
+// fails, connects anew and swaps in the new collection. A lost collection is kept until
+// the reconnect succeeds, so logins fail rather than fall back to the hardcoded user.
+func reconnectIfLost(ctx context.Context, mongodb_ip string) bool {
+	current := currentUsersCollection()
+	if current != nil {
+		pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := pingFunc(pingCtx, current)
+		cancel()
+		if err == nil {
+			return true
+		}
+		slog.Warn("lost MongoDB connection, reconnecting", "error", err)
+	}
+	collection := connectFunc(mongodb_ip)
+	if collection == nil {
+		return false
+	}
+	setUsersCollection(collection)
+	slog.Info("reconnected to MongoDB")
+	if current == nil {
+		// the app started without a database and never set it up
+		prepareUsersCollection(ctx, collection)
+	} else {
+		current.Database().Client().Disconnect(ctx)
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestShutdownWaitsForInFlightDBOperation(t *testing.T) {
+	originalClient := setMongoClient(nil)
+	defer setMongoClient(originalClient)
+
+	var finished int32
+	started := make(chan struct{})
+	go func() {
+		done := trackDBOp()
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		done()
+	}()
+	<-started
+
+	// simulated shutdown: drain, then the client would be disconnected
+	shutdownDB()
+
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("shutdown should wait for the in-flight DB operation before disconnecting")
+	}
+}
+
+func TestDrainDBOperationsTimesOut(t *testing.T) {
+	done := trackDBOp()
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if drainDBOperations(ctx) {
+		t.Error("drainDBOperations should give up once the timeout elapses")
+	}
+}
+
+func TestDrainDBOperationsIdle(t *testing.T) {
+	if !drainDBOperations(context.Background()) {
+		t.Error("drainDBOperations should return immediately with nothing in flight")
+	}
+}
+
+func TestDisconnectDBWithoutClient(t *testing.T) {
+	originalClient := setMongoClient(nil)
+	defer setMongoClient(originalClient)
+
+	for i := 0; i < 2; i++ {
+		if err := disconnectDB(context.Background()); err != nil {
+			t.Errorf("disconnectDB without a client should be a no-op, call %d returned %v", i+1, err)
+		}
+	}
+}
+
+// useMongoTLS enables TLS with caFile for the duration of a test
+func useMongoTLS(t *testing.T, caFile string) {
+	originalTLS, originalCA := mongoTLS, mongoCAFile
+	mongoTLS, mongoCAFile = true, caFile
+	t.Cleanup(func() { mongoTLS, mongoCAFile = originalTLS, originalCA })
+}
+
+// writeTestCA writes a self-signed CA certificate as PEM and returns its path
+func writeTestCA(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMongoClientOptionsWithoutTLS(t *testing.T) {
+	opts, err := mongoClientOptions("mongodb://localhost:27017/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig != nil {
+		t.Error("TLS should be off unless MONGO_TLS is set")
+	}
+}
+
+func TestMongoClientOptionsWithTLS(t *testing.T) {
+	useMongoTLS(t, "")
+	opts, err := mongoClientOptions("mongodb://localhost:27017/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs != nil {
+		t.Errorf("MONGO_TLS without a CA file should use the system roots, got %+v", opts.TLSConfig)
+	}
+
+	useMongoTLS(t, writeTestCA(t))
+	opts, err = mongoClientOptions("mongodb://localhost:27017/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil {
+		t.Errorf("MONGO_CA_FILE should be used as the root pool, got %+v", opts.TLSConfig)
+	}
+}
+
+func TestMongoClientOptionsBadCAFile(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+
+	for _, path := range []string{filepath.Join(t.TempDir(), "missing.pem"), notPEM} {
+		useMongoTLS(t, path)
+		if _, err := mongoClientOptions("mongodb://localhost:27017/"); err == nil {
+			t.Errorf("CA file %s should be rejected", path)
+		}
+	}
+	if connectDB("localhost") != nil {
+		t.Error("connectDB should fail with an unusable CA file")
+	}
+}
+
+// lazyCollection returns a collection on a client that never dials until used
+func lazyCollection(t *testing.T) *mongo.Collection {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client.Database("test").Collection("users")
+}
+
+func TestReconnectIfLostRecovers(t *testing.T) {
+	originalCollection, originalPing, originalConnect := currentUsersCollection(), pingFunc, connectFunc
+	defer func() {
+		setUsersCollection(originalCollection)
+		pingFunc, connectFunc = originalPing, originalConnect
+	}()
+	lost, recovered := lazyCollection(t), lazyCollection(t)
+	setUsersCollection(lost)
+
+	// the server is down: pings fail and so do reconnects
+	up := false
+	pingFunc = func(ctx context.Context, collection *mongo.Collection) error {
+		if !up || collection != recovered {
+			return errors.New("server selection error")
+		}
+		return nil
+	}
+	connectFunc = func(string) *mongo.Collection {
+		if !up {
+			return nil
+		}
+		return recovered
+	}
+
+	if reconnectIfLost(context.Background(), "db.internal") {
+		t.Error("reconnect should fail while the server is down")
+	}
+	if currentUsersCollection() != lost {
+		t.Error("the lost collection should be kept until a reconnect succeeds")
+	}
+
+	up = true
+	if !reconnectIfLost(context.Background(), "db.internal") || currentUsersCollection() != recovered {
+		t.Error("the accessor should switch to the new collection once the server is back")
+	}
+	if !reconnectIfLost(context.Background(), "db.internal") || currentUsersCollection() != recovered {
+		t.Error("a healthy connection should be left alone")
+	}
+}
+
+func TestReconnectIfLostWithoutCollection(t *testing.T) {
+	originalCollection, originalConnect := currentUsersCollection(), connectFunc
+	defer func() {
+		setUsersCollection(originalCollection)
+		connectFunc = originalConnect
+	}()
+	setUsersCollection(nil)
+	collection := lazyCollection(t)
+	connectFunc = func(string) *mongo.Collection { return collection }
+	originalCreate, originalEnsure, originalSeed, originalSeedUsers := createIndexesFunc, ensureIndexes, seedDefaultUser, seedUsers
+	t.Cleanup(func() {
+		createIndexesFunc, ensureIndexes, seedDefaultUser, seedUsers = originalCreate, originalEnsure, originalSeed, originalSeedUsers
+	})
+	var indexed *mongo.Collection
+	createIndexesFunc = func(_ context.Context, c *mongo.Collection) error {
+		indexed = c
+		return nil
+	}
+	ensureIndexes, seedDefaultUser, seedUsers = true, false, nil
+
+	if !reconnectIfLost(context.Background(), "db.internal") || currentUsersCollection() != collection {
+		t.Error("an app that started without a database should connect once it is reachable")
+	}
+	if indexed != collection {
+		t.Error("the user indexes should be created once the database is reachable")
+	}
+}
+
+func TestWatchDBStopsOnCancel(t *testing.T) {
+	originalCollection, originalConnect := currentUsersCollection(), connectFunc
+	defer func() {
+		setUsersCollection(originalCollection)
+		connectFunc = originalConnect
+	}()
+	setUsersCollection(nil)
+	var attempts int32
+	connectFunc = func(string) *mongo.Collection {
+		atomic.AddInt32(&attempts, 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchDB(ctx, "db.internal", time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchDB should return once its context is cancelled")
+	}
+	if atomic.LoadInt32(&attempts) == 0 {
+		t.Error("watchDB should have tried to reconnect")
+	}
+}
+
+func TestMongoURIOptions(t *testing.T) {
+	original := mongoURIOptions
+	t.Cleanup(func() { mongoURIOptions = original })
+
+	t.Setenv("MONGO_URI_OPTIONS", "?retryWrites=true&w=majority")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got, want := mongoURI("db", "", ""), fmt.Sprintf("mongodb://db:%d/?retryWrites=true&w=majority", mongodb_port); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got, want := mongoURI("db", "admin", "pw"), fmt.Sprintf("mongodb://admin:pw@db:%d/?retryWrites=true&w=majority", mongodb_port); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if _, err := mongoClientOptions(mongoURI("db", "", "")); err != nil {
+		t.Errorf("the driver should accept the URI with options: %v", err)
+	}
+	if got := withURIOptions("mongodb://db/?tls=true", "w=majority"); got != "mongodb://db/?tls=true&w=majority" {
+		t.Errorf("expected options joined with &, got %s", got)
+	}
+
+	for _, malformed := range []string{"retryWrites", "=true", "w=majority&&tls=true", "w=%zz"} {
+		t.Setenv("MONGO_URI_OPTIONS", malformed)
+		if err := loadConfig(); err == nil {
+			t.Errorf("%q: expected malformed options to be rejected", malformed)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// errInvalidEmail is returned for addresses that fail validEmail
+var errInvalidEmail = errors.New("invalid email address")
+
+// validEmail does a basic RFC 5322 check: a bare address (no display name) with a
+// dotted domain
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != strings.TrimSpace(email) {
+		return false
+	}
+	at := strings.LastIndex(address.Address, "@")
+	domain := address.Address[at+1:]
+	return at > 0 && strings.Contains(domain, ".") && !strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// normalizeEmail is how emails are stored and looked up
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// lookupByEmail finds the user owning email, or returns errUserNotFound
+func lookupByEmail(ctx context.Context, email string) (*User, error) {
+	store := currentUserStore()
+	if store == nil {
+		return nil, errUserNotFound
+	}
+	return store.FindUserByEmail(ctx, normalizeEmail(email))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidEmail(t *testing.T) {
+	for _, email := range []string{"alice@example.com", "a.b+tag@mail.example.org"} {
+		if !validEmail(email) {
+			t.Errorf("%q should be valid", email)
+		}
+	}
+	for _, email := range []string{"", "alice", "alice@", "@example.com", "alice@localhost",
+		"alice@example.", "Alice <alice@example.com>", "alice@@example.com"} {
+		if validEmail(email) {
+			t.Errorf("%q should be invalid", email)
+		}
+	}
+}
+
+func TestImportRejectsDuplicateAndInvalidEmail(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "existing", Password: "x", Email: "taken@example.com"}, User{Username: username, Password: password, Role: roleAdmin})
+	useMemoryUserStore(t, store)
+
+	body := `[
+		{"username":"alice","password":"alicepass1","email":"Alice@Example.com"},
+		{"username":"bob","password":"bobpass12","email":"TAKEN@example.com"},
+		{"username":"carol","password":"carolpass1","email":"not-an-email"}
+	]`
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(body))
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	var result importResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if result.Imported != 1 || len(result.Failed) != 2 {
+		t.Fatalf("expected 1 imported and 2 failed, got %+v", result)
+	}
+	if result.Failed[0].Error != errDuplicateEmail.Error() || result.Failed[1].Error != errInvalidEmail.Error() {
+		t.Errorf("unexpected failures: %+v", result.Failed)
+	}
+
+	alice, err := lookupByEmail(context.Background(), " alice@EXAMPLE.com")
+	if err != nil || alice.Username != "alice" {
+		t.Errorf("lookupByEmail should find alice by normalized email, got %+v, %v", alice, err)
+	}
+	if _, err := lookupByEmail(context.Background(), "nobody@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("expected errUserNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// defaultErrorTemplate renders error pages unless ERROR_TEMPLATE_FILE names another one
+//
+//go:embed templates/error.html
+var defaultErrorTemplate string
+
+// errorTemplate renders errorPage values; html/template escapes everything they carry
+var errorTemplate = template.Must(template.New("error").Parse(defaultErrorTemplate))
+
+// errorPage is the data passed to the error template
+type errorPage struct {
+	Status   int
+	Title    string
+	Message  string
+	Link     string
+	LinkText string
+	// Errors are listed below the message, e.g. every problem with a submitted form
+	Errors []string
+}
+
+// loadErrorTemplate replaces the error template with the one in path
+func loadErrorTemplate(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	parsed, err := template.New("error").Parse(string(content))
+	if err != nil {
+		return err
+	}
+	errorTemplate = parsed
+	return nil
+}
+
+// renderErrorPage answers with page rendered by the error template and page.Status
+func renderErrorPage(response http.ResponseWriter, page errorPage) {
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response.WriteHeader(page.Status)
+	if err := errorTemplate.Execute(response, page); err != nil {
+		slog.Error("failed to render error page", "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useErrorTemplate installs the template in content for the rest of the test
+func useErrorTemplate(t *testing.T, content string) {
+	original := errorTemplate
+	t.Cleanup(func() { errorTemplate = original })
+	path := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ERROR_TEMPLATE_FILE", path)
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+}
+
+func TestCustomErrorTemplate(t *testing.T) {
+	useErrorTemplate(t, `<main class="brand"><h2>{{.Title}}</h2><p>{{.Message}}</p><a href="{{.Link}}">{{.LinkText}}</a></main>`)
+
+	rr := httptest.NewRecorder()
+	renderErrorPage(rr, errorPage{Status: http.StatusForbidden, Title: "Nope", Message: "<script>alert(1)</script>", Link: "/login", LinkText: "Back"})
+
+	body := rr.Body.String()
+	if rr.Code != http.StatusForbidden || !strings.Contains(body, `<main class="brand"><h2>Nope</h2>`) {
+		t.Errorf("expected the custom template with status 403, got %d: %s", rr.Code, body)
+	}
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("the message should be escaped, got %s", body)
+	}
+}
+
+func TestInvalidLoginUsesErrorTemplate(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	useErrorTemplate(t, `<div class="brand">{{.Title}}</div>`)
+
+	rr := postLogin("bob", "wrong")
+	if rr.Code != http.StatusUnauthorized || rr.Body.String() != `<div class="brand">Invalid login</div>` {
+		t.Errorf("expected the invalid login to render the custom template, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestLoadConfigRejectsBrokenErrorTemplate(t *testing.T) {
+	original := errorTemplate
+	t.Cleanup(func() { errorTemplate = original })
+	path := filepath.Join(t.TempDir(), "error.html")
+	os.WriteFile(path, []byte(`{{.Title`), 0o600)
+	t.Setenv("ERROR_TEMPLATE_FILE", path)
+	if err := loadConfig(); err == nil {
+		t.Error("a template that doesn't parse should be rejected")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// authentication errors returned by authenticate. Unknown users and wrong passwords
+// are both errInvalidCredentials so responses don't reveal which usernames exist;
+// errAccountDisabled is only returned once the password matched.
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountDisabled    = errors.New("account disabled")
+	errStoreUnavailable   = errors.New("user store unavailable")
+)
+
+// authErrorStatus maps an authentication error to its HTTP status: 401 for bad
+// credentials, 403 for disabled accounts, 500 for anything else, whose details are only logged
+func authErrorStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, errInvalidCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, errAccountDisabled):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// unavailableUserStore fails every lookup as if the database were down
+type unavailableUserStore struct {
+	UserStore
+}
+
+func (unavailableUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestAuthErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{errInvalidCredentials, http.StatusUnauthorized},
+		{fmt.Errorf("login: %w", errInvalidCredentials), http.StatusUnauthorized},
+		{errAccountDisabled, http.StatusForbidden},
+		{errStoreUnavailable, http.StatusInternalServerError},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := authErrorStatus(tt.err); got != tt.want {
+			t.Errorf("authErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateErrors(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	if err := authenticate(context.Background(), "bob", "secret"); err != nil {
+		t.Errorf("valid credentials: got %v", err)
+	}
+	if err := authenticate(context.Background(), "bob", "wrong"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("wrong password: got %v, want errInvalidCredentials", err)
+	}
+	if err := authenticate(context.Background(), "nobody", "secret"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("unknown user: got %v, want errInvalidCredentials", err)
+	}
+
+	useMemoryUserStore(t, unavailableUserStore{})
+	if err := authenticate(context.Background(), "bob", "secret"); !errors.Is(err, errStoreUnavailable) {
+		t.Errorf("failing store: got %v, want errStoreUnavailable", err)
+	}
+}
+
+func TestLoginHandlerInvalidCredentialsIs401(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	rr := postLogin("bob", "wrong")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+}
+
+func TestLoginHandlerStoreUnavailableIs500(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, unavailableUserStore{})
+	recorder := useAuditLogger(t)
+
+	rr := postLogin("bob", "secret")
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rr.Code)
+	}
+	event := recorder.only(t)
+	if event.Reason != "store unavailable" {
+		t.Errorf("audit reason = %q, want %q", event.Reason, "store unavailable")
+	}
+}
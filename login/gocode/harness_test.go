@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testApp is the application wired up for handler tests without MongoDB: users live in
+// an in-memory store, sessions in cookies, and requests go through appHandler and the
+// full router like in production. Globals it changes are restored when the test ends.
+type testApp struct {
+	t       *testing.T
+	store   *memoryUserStore
+	handler http.Handler
+}
+
+// newTestApp returns a testApp whose store holds users, stored under their normalized
+// names like seeding would; their passwords may be plaintext
+func newTestApp(t *testing.T, users ...User) *testApp {
+	t.Helper()
+	for i := range users {
+		users[i].Username = normalizeUsername(users[i].Username)
+	}
+	store := newMemoryUserStore(users...)
+	useMemoryUserStore(t, store)
+	useSessionStore(t, cookieSessionStore{})
+	freshLoginThrottle(t)
+	originalMode := authMode
+	t.Cleanup(func() { authMode = originalMode })
+	authMode = authModeCookie
+	return &testApp{t: t, store: store, handler: appHandler(setupRouter())}
+}
+
+// do serves request with cookies added
+func (a *testApp) do(request *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	a.handler.ServeHTTP(rr, request)
+	return rr
+}
+
+// get serves a GET of path
+func (a *testApp) get(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return a.do(httptest.NewRequest("GET", path, nil), cookies...)
+}
+
+// postForm serves a form POST of form to path
+func (a *testApp) postForm(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return a.do(request, cookies...)
+}
+
+// login posts credentials to /login
+func (a *testApp) login(name string, pass string) *httptest.ResponseRecorder {
+	return a.postForm("/login", url.Values{"name": {name}, "password": {pass}})
+}
+
+// loginCookie logs in and returns the session cookie, failing the test if there is none
+func (a *testApp) loginCookie(name string, pass string) *http.Cookie {
+	a.t.Helper()
+	return a.sessionCookieOf(a.login(name, pass))
+}
+
+// sessionCookieOf returns the session cookie set by a response, failing the test if there is none
+func (a *testApp) sessionCookieOf(rr *httptest.ResponseRecorder) *http.Cookie {
+	a.t.Helper()
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	a.t.Fatalf("no session cookie was set: %d %s", rr.Code, rr.Body.String())
+	return nil
+}
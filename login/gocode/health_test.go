@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useHealthChecks replaces the registered checks for the duration of a test
+func useHealthChecks(t *testing.T) {
+	original := healthChecks
+	healthChecks = nil
+	t.Cleanup(func() { healthChecks = original })
+}
+
+func getReadyz(t *testing.T) (*httptest.ResponseRecorder, healthResponse) {
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	var body healthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rr, body
+}
+
+func TestReadyzAggregatesChecks(t *testing.T) {
+	useHealthChecks(t)
+	registerCheck("passing", CheckerFunc(func(context.Context) error { return nil }))
+
+	rr, body := getReadyz(t)
+	if rr.Code != http.StatusOK || body.Status != "ok" {
+		t.Errorf("all checks passing should give 200 ok, got %d %s", rr.Code, body.Status)
+	}
+
+	registerCheck("failing", CheckerFunc(func(context.Context) error { return errors.New("disk full") }))
+	rr, body = getReadyz(t)
+	if rr.Code != http.StatusServiceUnavailable || body.Status != "unavailable" {
+		t.Errorf("a failing check should give 503 unavailable, got %d %s", rr.Code, body.Status)
+	}
+	if body.Checks["passing"].Status != "ok" {
+		t.Errorf("passing check should report ok, got %+v", body.Checks["passing"])
+	}
+	if failing := body.Checks["failing"]; failing.Status != "error" || failing.Error != "disk full" {
+		t.Errorf("failing check should report its error, got %+v", failing)
+	}
+}
+
+func TestDefaultHealthChecks(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore())
+
+	if rr, body := getReadyz(t); rr.Code != http.StatusOK {
+		t.Errorf("database and cookie codec checks should pass with a store, got %d: %+v", rr.Code, body.Checks)
+	}
+
+	useMemoryUserStore(t, nil)
+	originalClient := setMongoClient(nil)
+	defer setMongoClient(originalClient)
+	if _, body := getReadyz(t); body.Checks["database"].Status != "error" {
+		t.Errorf("database check should fail without a connection, got %+v", body.Checks["database"])
+	}
+}
+
+func TestLivezIgnoresDatabase(t *testing.T) {
+	useMemoryUserStore(t, nil)
+	originalClient := setMongoClient(nil)
+	defer setMongoClient(originalClient)
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/livez", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("/livez should answer 200 without a database, got %d", rr.Code)
+	}
+}
+
+func TestReadyzDatabaseStates(t *testing.T) {
+	originalClient, originalFallback := currentMongoClient(), readyInFallback
+	defer func() {
+		setMongoClient(originalClient)
+		readyInFallback = originalFallback
+	}()
+
+	useMemoryUserStore(t, newMemoryUserStore())
+	if rr, _ := getReadyz(t); rr.Code != http.StatusOK {
+		t.Errorf("a connected store should be ready, got %d", rr.Code)
+	}
+
+	// a client whose connection has gone away
+	useMemoryUserStore(t, nil)
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect(context.Background())
+	setMongoClient(client)
+	if rr, body := getReadyz(t); rr.Code != http.StatusServiceUnavailable || body.Checks["database"].Status != "error" {
+		t.Errorf("a disconnected client should not be ready, got %d: %+v", rr.Code, body.Checks)
+	}
+
+	setMongoClient(nil)
+	if rr, _ := getReadyz(t); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("fallback mode should not be ready by default, got %d", rr.Code)
+	}
+	readyInFallback = true
+	if rr, _ := getReadyz(t); rr.Code != http.StatusOK {
+		t.Errorf("fallback mode should be ready with READY_IN_FALLBACK, got %d", rr.Code)
+	}
+}
+
+// getDBPing requests /db-ping as the admin user
+func getDBPing(t *testing.T) (*httptest.ResponseRecorder, dbPingResponse) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: username, Password: password, Role: roleAdmin}))
+	req := httptest.NewRequest("GET", "/db-ping", nil)
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	var body dbPingResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	return rr, body
+}
+
+func TestDBPingWithoutClient(t *testing.T) {
+	original := currentUsersCollection()
+	setUsersCollection(nil)
+	defer setUsersCollection(original)
+
+	rr, body := getDBPing(t)
+	if rr.Code != http.StatusServiceUnavailable || body.Status != "error" {
+		t.Errorf("expected 503 with an error status, got %d %+v", rr.Code, body)
+	}
+}
+
+func TestDBPingReportsLatency(t *testing.T) {
+	originalCollection, originalPing := currentUsersCollection(), pingFunc
+	defer func() {
+		setUsersCollection(originalCollection)
+		pingFunc = originalPing
+	}()
+	setUsersCollection(lazyCollection(t))
+	pingFunc = func(ctx context.Context, collection *mongo.Collection) error { return nil }
+
+	rr, body := getDBPing(t)
+	if rr.Code != http.StatusOK || body.Status != "ok" {
+		t.Fatalf("expected 200 with an ok status, got %d %+v", rr.Code, body)
+	}
+	if body.DurationMs < 0 {
+		t.Errorf("duration should be non-negative, got %v", body.DurationMs)
+	}
+
+	pingFunc = func(ctx context.Context, collection *mongo.Collection) error {
+		return errors.New("server selection error")
+	}
+	rr, body = getDBPing(t)
+	if rr.Code != http.StatusServiceUnavailable || body.Error != "server selection error" {
+		t.Errorf("a failed ping should answer 503 with the error, got %d %+v", rr.Code, body)
+	}
+}
+
+func TestDBPingRequiresAdmin(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	req := httptest.NewRequest("GET", "/db-ping", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a regular user, got %d", rr.Code)
+	}
+}
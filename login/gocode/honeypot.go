@@ -0,0 +1,32 @@
+package main
+
+import "net/http"
+
+// honeypotEnabled adds a hidden form field that humans leave empty but simple bots fill in
+var honeypotEnabled = false
+
+// honeypotFieldName is the name of the hidden login form field
+const honeypotFieldName = "website"
+
+// honeypotField returns the hidden form field markup, or nothing when the honeypot is off
+func honeypotField() string {
+	if !honeypotEnabled {
+		return ""
+	}
+	return `<div style="display:none" aria-hidden="true">
+        <label for="` + honeypotFieldName + `">Leave this field empty</label>
+        <input type="text" id="` + honeypotFieldName + `" name="` + honeypotFieldName + `" tabindex="-1" autocomplete="off">
+    </div>
+    `
+}
+
+// honeypotTripped reports whether a login submission filled in the honeypot field,
+// logging it as bot activity
+func honeypotTripped(request *http.Request) bool {
+	if !honeypotEnabled || request.FormValue(honeypotFieldName) == "" {
+		return false
+	}
+	requestLogger(request.Context()).Warn("bot activity: honeypot field filled on login",
+		"user", request.FormValue(loginUsernameField), "remote_addr", request.RemoteAddr)
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// enableHoneypot turns the honeypot on for the duration of the test
+func enableHoneypot(t *testing.T) {
+	original := honeypotEnabled
+	honeypotEnabled = true
+	t.Cleanup(func() { honeypotEnabled = original })
+}
+
+func TestHoneypotFilledFailsLogin(t *testing.T) {
+	enableHoneypot(t)
+	useMemoryUserStore(t, nil)
+	setUsersCollection(nil)
+
+	form := url.Values{}
+	form.Add("name", username)
+	form.Add("password", password)
+	form.Add(honeypotFieldName, "http://spam.example")
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "Invalid login") {
+		t.Error("a filled honeypot should fail the login even with valid credentials")
+	}
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == "session" && cookie.Value != "" {
+			t.Error("a filled honeypot must not establish a session")
+		}
+	}
+}
+
+func TestHoneypotEmptyAllowsLogin(t *testing.T) {
+	enableHoneypot(t)
+	useMemoryUserStore(t, nil)
+	setUsersCollection(nil)
+
+	form := url.Values{}
+	form.Add("name", username)
+	form.Add("password", password)
+	form.Add(honeypotFieldName, "")
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/internal" {
+		t.Errorf("an empty honeypot should not block a valid login, got redirect %q", location)
+	}
+}
+
+func TestHoneypotFieldRendering(t *testing.T) {
+	rr := httptest.NewRecorder()
+	indexPageHandler(rr, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(rr.Body.String(), `name="`+honeypotFieldName+`"`) {
+		t.Error("honeypot field should not render when disabled")
+	}
+
+	enableHoneypot(t)
+	rr = httptest.NewRecorder()
+	indexPageHandler(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `name="`+honeypotFieldName+`"`) {
+		t.Error("honeypot field should render when enabled")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// importUser is one entry of the POST /api/users/import body
+type importUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Email    string `json:"email"`
+}
+
+// importFailure reports why an entry could not be imported
+type importFailure struct {
+	Username string `json:"username"`
+	Error    string `json:"error"`
+}
+
+// importResult is the JSON body returned by POST /api/users/import
+type importResult struct {
+	Imported int             `json:"imported"`
+	Failed   []importFailure `json:"failed"`
+}
+
+// importUsersHandler bulk-creates users from a JSON array; mount it behind requireAdmin
+func importUsersHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+
+	var users []importUser
+	if err := json.NewDecoder(request.Body).Decode(&users); err != nil {
+		if isBodyTooLarge(err) {
+			writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+			return
+		}
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, "body must be a JSON array of users")
+		return
+	}
+
+	result := importResult{Failed: []importFailure{}}
+	for _, entry := range users {
+		if err := importOne(request, store, entry); err != nil {
+			result.Failed = append(result.Failed, importFailure{Username: entry.Username, Error: err.Error()})
+			continue
+		}
+		result.Imported++
+	}
+
+	writeJSON(response, http.StatusOK, result)
+}
+
+// importOne validates, hashes and stores a single imported user
+func importOne(request *http.Request, store UserStore, entry importUser) error {
+	user, err := newImportedUser(entry)
+	if err != nil {
+		return err
+	}
+	// the unique username index rejects case variants of existing users
+	return store.CreateUser(request.Context(), user)
+}
+
+// fieldError is one problem with a submitted field
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every problem with a submitted user, so they can all be
+// reported at once
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, problem := range v {
+		messages[i] = problem.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// conflictsOnly reports whether every problem is a username or email already in use
+func (v validationErrors) conflictsOnly() bool {
+	for _, problem := range v {
+		if problem.Message != errDuplicateUser.Error() && problem.Message != errDuplicateEmail.Error() {
+			return false
+		}
+	}
+	return len(v) > 0
+}
+
+// validateImportUser checks every field of entry, returning all problems found
+func validateImportUser(entry importUser) validationErrors {
+	var problems validationErrors
+	if name := normalizeUsername(entry.Username); name == "" {
+		problems = append(problems, fieldError{"username", "username is required"})
+	} else if err := validateUsername(name); err != nil {
+		problems = append(problems, fieldError{"username", err.Error()})
+	}
+	if err := validateNewPassword(entry.Password); err != nil {
+		problems = append(problems, fieldError{"password", err.Error()})
+	}
+	if entry.Role != "" && entry.Role != roleUser && entry.Role != roleAdmin {
+		problems = append(problems, fieldError{"role", fmt.Sprintf("unknown role %q", entry.Role)})
+	}
+	if entry.Email != "" && !validEmail(entry.Email) {
+		problems = append(problems, fieldError{"email", errInvalidEmail.Error()})
+	}
+	return problems
+}
+
+// takenFields reports the username and email of entry that already belong to a user
+func takenFields(ctx context.Context, store UserStore, entry importUser) (validationErrors, error) {
+	var problems validationErrors
+	if name := normalizeUsername(entry.Username); name != "" {
+		_, err := store.FindUser(ctx, name)
+		if err == nil {
+			problems = append(problems, fieldError{"username", errDuplicateUser.Error()})
+		} else if !errors.Is(err, errUserNotFound) {
+			return nil, err
+		}
+	}
+	if entry.Email != "" && validEmail(entry.Email) {
+		_, err := store.FindUserByEmail(ctx, normalizeEmail(entry.Email))
+		if err == nil {
+			problems = append(problems, fieldError{"email", errDuplicateEmail.Error()})
+		} else if !errors.Is(err, errUserNotFound) {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// newImportedUser validates entry and returns the user to store, with its password
+// hashed; invalid entries fail with validationErrors
+func newImportedUser(entry importUser) (User, error) {
+	if problems := validateImportUser(entry); len(problems) > 0 {
+		return User{}, problems
+	}
+	role := entry.Role
+	if role == "" {
+		role = roleUser
+	}
+	email := ""
+	if entry.Email != "" {
+		email = normalizeEmail(entry.Email)
+	}
+	hash, err := hashPassword(entry.Password)
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		Username:    normalizeUsername(entry.Username),
+		DisplayName: displayNameFor(entry.Username),
+		Password:    hash,
+		Role:        role,
+		Email:       email,
+	}, nil
+}
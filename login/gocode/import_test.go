@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImportUsers(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "existing", Password: "x"}, User{Username: username, Password: password, Role: roleAdmin})
+	useMemoryUserStore(t, store)
+
+	body := `[
+		{"username":"alice","password":"alicepass1"},
+		{"username":"boss","password":"bosspass1","role":"admin"},
+		{"username":"weak","password":"short"},
+		{"username":"existing","password":"existing1"}
+	]`
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(body))
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	var result importResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if result.Imported != 2 || len(result.Failed) != 2 {
+		t.Errorf("expected 2 imported and 2 failed, got %+v", result)
+	}
+
+	boss, err := store.FindUser(context.Background(), "boss")
+	if err != nil || boss.Role != roleAdmin || boss.Password == "bosspass1" {
+		t.Errorf("imported user should keep its role and have a hashed password, got %+v", boss)
+	}
+}
+
+func TestImportUsersRequiresAdmin(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob"}))
+
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(`[]`))
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin, got %d", rr.Code)
+	}
+}
+
+func TestImportUsersMalformedBody(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: username, Password: password, Role: roleAdmin}))
+
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(`{"not":"an array"}`))
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed body, got %d", rr.Code)
+	}
+}
+
+func TestImportUsersRejectsCaseVariant(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "alice", Password: "x"}, User{Username: username, Password: password, Role: roleAdmin})
+	useMemoryUserStore(t, store)
+
+	body := `[{"username":"Alice","password":"alicepass1"},{"username":"Carol","password":"carolpass1"}]`
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(body))
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	var result importResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if result.Imported != 1 || len(result.Failed) != 1 {
+		t.Errorf("a case variant of an existing user should be rejected, got %+v", result)
+	}
+
+	carol, err := store.FindUser(context.Background(), "carol")
+	if err != nil || carol.DisplayName != "Carol" {
+		t.Errorf("imported user should be stored lowercased with its display name, got %+v, %v", carol, err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/securecookie"
+)
+
+// jwtSecret signs API tokens (HS256); set JWT_SECRET so tokens survive restarts
+// and validate across instances
+var jwtSecret = securecookie.GenerateRandomKey(32)
+
+// jwtTTL is how long an issued API token stays valid
+var jwtTTL = time.Hour
+
+// jwtMaxTTL rejects tokens that expire further out than this, even when correctly signed
+var jwtMaxTTL = 24 * time.Hour
+
+// verifyTokenUser makes bearerAuth check that the token's user still exists
+var verifyTokenUser = true
+
+// deletedUserTokenStatus is returned for valid tokens of deleted users: 410 Gone
+// by default, or 401 to not reveal that the account existed
+var deletedUserTokenStatus = http.StatusGone
+
+// auth modes: "cookie" keeps sessions in securecookie-encoded cookies, "jwt" stores a
+// signed token in the session cookie and also accepts it as a bearer token
+const (
+	authModeCookie = "cookie"
+	authModeJWT    = "jwt"
+)
+
+// authMode selects how browser sessions are represented
+var authMode = authModeCookie
+
+// tokenClaims are the claims of an issued token
+type tokenClaims struct {
+	Role   string `json:"role,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// tokenResponse is the JSON body returned by POST /api/token
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// issueToken signs a token for userName of tenant with role that expires after jwtTTL
+func issueToken(tenant string, userName string, role string) (string, time.Time, error) {
+	now := clock()
+	expiresAt := now.Add(jwtTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		Role:   role,
+		Tenant: tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userName,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	signed, err := token.SignedString(jwtSecret)
+	return signed, expiresAt, err
+}
+
+// parseToken validates a signed token and returns its claims
+func parseToken(raw string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired(), jwt.WithTimeFunc(clock))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	if claims.ExpiresAt.Sub(clock()) > jwtMaxTTL {
+		return nil, errors.New("token lifetime exceeds the maximum")
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, or ""
+func bearerToken(request *http.Request) string {
+	scheme, token, ok := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// readTokenSession returns the session carried by a bearer token or, failing that, by a
+// token in the session cookie; expired tokens are rejected outright, without a grace period
+func readTokenSession(request *http.Request) map[string]string {
+	raw := bearerToken(request)
+	if raw == "" {
+		cookie, err := request.Cookie(sessionCookieName)
+		if err != nil {
+			return nil
+		}
+		raw = cookie.Value
+	}
+	claims, err := parseToken(raw)
+	if err != nil {
+		return nil
+	}
+	session := Session{Username: claims.Subject, Role: claims.Role, Tenant: claims.Tenant, Expires: claims.ExpiresAt.Time}
+	if claims.IssuedAt != nil {
+		session.Issued = claims.IssuedAt.Time
+	}
+	return session.values()
+}
+
+// setTokenSession stores a freshly issued token in the session cookie
+func setTokenSession(tenant string, userName string, role string, response http.ResponseWriter) (tokenResponse, error) {
+	token, expiresAt, err := issueToken(tenant, userName, role)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	cookie := newSessionCookie(token)
+	cookie.Expires = expiresAt
+	http.SetCookie(response, cookie)
+	return tokenResponse{Token: token, ExpiresAt: expiresAt.UTC()}, nil
+}
+
+// tokenUserRecord returns the user a token was issued to, or nil once it was deleted
+func tokenUserRecord(ctx context.Context, userName string) (*User, error) {
+	store := currentUserStore()
+	if store == nil {
+		if userName != normalizeUsername(username) {
+			return nil, nil
+		}
+		// the hardcoded fallback user is the seeded admin
+		return &User{Username: userName, Role: roleAdmin}, nil
+	}
+	user, err := store.FindUser(ctx, userName)
+	if errors.Is(err, errUserNotFound) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// tokenUserKey is the context key for the user authenticated by bearerAuth
+type tokenUserKey struct{}
+
+// tokenUser returns the user authenticated by bearerAuth, or ""
+func tokenUser(request *http.Request) string {
+	userName, _ := request.Context().Value(tokenUserKey{}).(string)
+	return userName
+}
+
+// bearerAuth only lets requests through that carry a valid bearer token, answering 401
+// otherwise and deletedUserTokenStatus when the token's user has been deleted. Tokens of
+// users since disabled, given another role or whose sessions were ended get 401.
+func bearerAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		preventCaching(response)
+		claims, err := parseToken(bearerToken(request))
+		if err == nil && claims.Tenant != tenantFrom(request.Context()) {
+			err = errors.New("token was issued for another tenant")
+		}
+		if err != nil {
+			writeJSONError(response, http.StatusUnauthorized, errCodeUnauthenticated, "invalid or missing bearer token")
+			return
+		}
+		if verifyTokenUser {
+			user, err := tokenUserRecord(request.Context(), claims.Subject)
+			if err != nil {
+				requestLogger(request.Context()).Error("failed to look up token user", "error", err)
+				writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to verify token")
+				return
+			}
+			if user == nil {
+				code := errCodeGone
+				if deletedUserTokenStatus == http.StatusUnauthorized {
+					code = errCodeUnauthenticated
+				}
+				writeJSONError(response, deletedUserTokenStatus, code, "user no longer exists")
+				return
+			}
+			session := Session{Username: claims.Subject, Role: claims.Role}
+			if claims.IssuedAt != nil {
+				session.LoggedIn = claims.IssuedAt.Time
+			}
+			if session.revokedBy(user) {
+				writeJSONError(response, http.StatusUnauthorized, errCodeUnauthenticated, "token is no longer valid")
+				return
+			}
+		}
+		ctx := context.WithValue(request.Context(), tokenUserKey{}, claims.Subject)
+		next(response, request.WithContext(ctx))
+	}
+}
+
+// tokenHandler exchanges a username and password for an API token
+func tokenHandler(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		writeJSONError(response, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	name := normalizeUsername(request.FormValue("name"))
+	pass := request.FormValue("password")
+	if err := validateUsername(name); err != nil {
+		recordLoginAttempt(loginResultInvalidCredentials)
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	switch attempt := attemptLogin(response, request, name, pass, false); attempt.result {
+	case loginResultLocked:
+		writeJSONError(response, http.StatusTooManyRequests, errCodeLocked, "account temporarily locked")
+		return
+	case loginResultError:
+		writeJSONError(response, authErrorStatus(attempt.err), errCodeUnavailable, "login is temporarily unavailable")
+		return
+	case loginResultDisabled:
+		writeJSONError(response, authErrorStatus(attempt.err), errCodeAccountDisabled, "account disabled")
+		return
+	case loginResultInvalidCredentials:
+		writeJSONError(response, authErrorStatus(attempt.err), errCodeInvalidCredentials, "invalid credentials")
+		return
+	}
+
+	token, expiresAt, err := issueToken(tenantFrom(request.Context()), name, lookupRole(request.Context(), name))
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to sign token", "error", err)
+		writeJSONError(response, http.StatusInternalServerError, errCodeInternal, "failed to issue token")
+		return
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, tokenResponse{Token: token, ExpiresAt: expiresAt.UTC()})
+}
+
+// tokenInfoHandler describes the bearer token's user; mount it behind bearerAuth
+func tokenInfoHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, map[string]string{"username": tokenUser(request)})
+}
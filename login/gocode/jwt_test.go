@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requestToken exchanges credentials for a token through POST /api/token
+func requestToken(t *testing.T, name string, pass string) string {
+	form := url.Values{"name": {name}, "password": {pass}}
+	req := httptest.NewRequest("POST", "/api/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a token, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body tokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Token
+}
+
+// getWithToken calls GET /api/token with the bearer token
+func getWithToken(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/token", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	rr := getWithToken(requestToken(t, "bob", "secret"))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"bob"`) {
+		t.Errorf("a fresh token should authenticate bob, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTokenRejectsBadCredentialsAndTampering(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	form := url.Values{"name": {"bob"}, "password": {"wrong"}}
+	req := httptest.NewRequest("POST", "/api/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password should not issue a token, got %d", rr.Code)
+	}
+
+	token := requestToken(t, "bob", "secret")
+	if rr := getWithToken(token[:len(token)-2] + "xx"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a tampered token should be rejected, got %d", rr.Code)
+	}
+	if rr := getWithToken(""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a missing token should be rejected, got %d", rr.Code)
+	}
+}
+
+func TestTokenOfDeletedUser(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+	useMemoryUserStore(t, store)
+	token := requestToken(t, "bob", "secret")
+	store.DeleteUser(context.Background(), "bob")
+
+	if rr := getWithToken(token); rr.Code != http.StatusGone {
+		t.Errorf("a deleted user's token should get 410, got %d", rr.Code)
+	}
+
+	originalStatus := deletedUserTokenStatus
+	deletedUserTokenStatus = http.StatusUnauthorized
+	defer func() { deletedUserTokenStatus = originalStatus }()
+	if rr := getWithToken(token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("the deleted user status should be configurable, got %d", rr.Code)
+	}
+
+	originalVerify := verifyTokenUser
+	verifyTokenUser = false
+	defer func() { verifyTokenUser = originalVerify }()
+	if rr := getWithToken(token); rr.Code != http.StatusOK {
+		t.Errorf("without user verification the signed token is enough, got %d", rr.Code)
+	}
+}
+
+func TestTokenOfDisabledOrDemotedUser(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: "alice", Password: "secret", Role: roleAdmin})
+	useMemoryUserStore(t, store)
+	bobToken, aliceToken := requestToken(t, "bob", "secret"), requestToken(t, "alice", "secret")
+
+	store.SetEnabled(context.Background(), "bob", false)
+	if rr := getWithToken(bobToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a disabled user's token should get 401, got %d", rr.Code)
+	}
+	store.UpdateRole(context.Background(), "alice", roleUser)
+	if rr := getWithToken(aliceToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a demoted admin's token should get 401, got %d", rr.Code)
+	}
+}
+
+func TestTokenExpiryFollowsConfig(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	originalTTL := jwtTTL
+	jwtTTL = 10 * time.Minute
+	defer func() { jwtTTL = originalTTL }()
+
+	claims, err := parseToken(requestToken(t, "bob", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != jwtTTL {
+		t.Errorf("token lifetime should be JWT_TTL %v, got %v", jwtTTL, lifetime)
+	}
+}
+
+func TestTokenFollowsClock(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	fake := useFakeClock(t)
+
+	token := requestToken(t, "bob", "secret")
+	claims, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.IssuedAt.Equal(fake.Now()) || !claims.ExpiresAt.Equal(fake.Now().Add(jwtTTL)) {
+		t.Errorf("token times should come from the clock, got issued %v expires %v", claims.IssuedAt, claims.ExpiresAt)
+	}
+
+	fake.Advance(jwtTTL)
+	if rr := getWithToken(token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("the token should expire with the clock, got %d", rr.Code)
+	}
+}
+
+func TestTokenOverMaxLifetimeRejected(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	originalTTL := jwtTTL
+	defer func() { jwtTTL = originalTTL }()
+
+	// correctly signed, but valid for a year
+	jwtTTL = 365 * 24 * time.Hour
+	token, _, err := issueToken("", "bob", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := getWithToken(token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("a token beyond JWT_MAX_TTL should be rejected, got %d", rr.Code)
+	}
+}
+
+func useJWTMode(t *testing.T) {
+	original := authMode
+	authMode = authModeJWT
+	t.Cleanup(func() { authMode = original })
+}
+
+func TestJWTModeLoginIssuesToken(t *testing.T) {
+	useJWTMode(t)
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret", Role: roleAdmin}))
+
+	form := url.Values{"name": {"bob"}, "password": {"secret"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a JSON token response, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body tokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != body.Token {
+		t.Fatalf("the session cookie should carry the issued token, got %v", cookies)
+	}
+
+	// the cookie alone and the bearer header alone both authenticate
+	req = httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookies[0])
+	if getUserName(req) != "bob" || getSessionRole(req) != roleAdmin {
+		t.Errorf("the token cookie should carry bob's admin session")
+	}
+	req = httptest.NewRequest("GET", "/internal", nil)
+	req.Header.Set("Authorization", "Bearer "+body.Token)
+	if getUserName(req) != "bob" {
+		t.Errorf("the bearer token should authenticate bob")
+	}
+}
+
+func TestJWTModeRejectsExpiredAndTamperedTokens(t *testing.T) {
+	useJWTMode(t)
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "bob",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	}).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _, err := issueToken("", "bob", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// swap the payload for one claiming a different user, keeping the signature
+	parts := strings.Split(valid, ".")
+	forged, _, _ := issueToken("", "mallory", roleAdmin)
+	parts[1] = strings.Split(forged, ".")[1]
+	tampered := strings.Join(parts, ".")
+
+	for name, token := range map[string]string{"expired": expired, "tampered": tampered} {
+		req := httptest.NewRequest("GET", "/internal", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if userName := getUserName(req); userName != "" {
+			t.Errorf("%s token should be rejected, authenticated %q", name, userName)
+		}
+	}
+}
+
+func TestCookieModeIgnoresBearerToken(t *testing.T) {
+	token, _, err := issueToken("", "bob", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if userName := getUserName(req); userName != "" {
+		t.Errorf("cookie mode should not accept bearer tokens as sessions, got %q", userName)
+	}
+}
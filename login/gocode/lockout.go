@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// lockout settings: this many consecutive failed logins lock the username for lockoutDuration
+var maxFailedLogins = 5
+var lockoutDuration = 15 * time.Minute
+
+// Notifier is told when an account gets locked so the user can be warned (email, SMS, ...)
+type Notifier interface {
+	NotifyLockout(username string, duration time.Duration)
+}
+
+// logNotifier is the default Notifier; it only logs until a real channel is wired up
+type logNotifier struct{}
+
+func (logNotifier) NotifyLockout(username string, duration time.Duration) {
+	slog.Warn("account locked after too many failed logins", "user", username, "duration", duration)
+}
+
+// lockoutNotifier receives lockout events
+var lockoutNotifier Notifier = logNotifier{}
+
+// maxThrottleEntries caps the failure counts and lockouts loginThrottle keeps, so failed
+// logins for endless made-up usernames can't exhaust memory. Past it, arbitrary entries
+// are forgotten; real users are still counted and locked in the store.
+var maxThrottleEntries = 100000
+
+// throttleSweepInterval is how often loginThrottle drops counts and lockouts that ran out
+var throttleSweepInterval = time.Minute
+
+// failureCount is a username's run of failed logins
+type failureCount struct {
+	count int
+	last  time.Time
+}
+
+// loginThrottle counts consecutive failed logins in memory, per tenantUsername. A run of
+// failures is forgotten lockoutDuration after its last failure.
+type loginThrottle struct {
+	mu          sync.Mutex
+	failures    map[string]failureCount
+	lockedUntil map[string]time.Time
+	lastSweep   time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		failures:    make(map[string]failureCount),
+		lockedUntil: make(map[string]time.Time),
+	}
+}
+
+// loginAttempts tracks failed logins for all users
+var loginAttempts = newLoginThrottle()
+
+// lockedFor returns how long username stays locked, if it is locked
+func (t *loginThrottle) lockedFor(username string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.lockedUntil[username]
+	if !ok {
+		return 0, false
+	}
+	remaining := until.Sub(clock())
+	if remaining <= 0 {
+		delete(t.lockedUntil, username)
+		return 0, false
+	}
+	return remaining, true
+}
+
+// recordFailure counts a failed login and locks the username once maxFailedLogins is reached.
+// It reports whether this failure caused a lockout.
+func (t *loginThrottle) recordFailure(username string) bool {
+	now := clock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	failures, ok := t.failures[username]
+	if !ok && len(t.failures) >= maxThrottleEntries {
+		for name := range t.failures {
+			delete(t.failures, name)
+			break
+		}
+	}
+	if now.Sub(failures.last) >= lockoutDuration {
+		failures.count = 0
+	}
+	failures = failureCount{count: failures.count + 1, last: now}
+	locked := maxFailedLogins > 0 && failures.count >= maxFailedLogins
+	if !locked {
+		t.failures[username] = failures
+		return false
+	}
+	delete(t.failures, username)
+	if _, ok := t.lockedUntil[username]; !ok && len(t.lockedUntil) >= maxThrottleEntries {
+		for name := range t.lockedUntil {
+			delete(t.lockedUntil, name)
+			break
+		}
+	}
+	t.lockedUntil[username] = now.Add(lockoutDuration)
+	return true
+}
+
+// sweep drops failure runs and lockouts that ran out, at most once per
+// throttleSweepInterval; callers hold t.mu
+func (t *loginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < throttleSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for name, failures := range t.failures {
+		if now.Sub(failures.last) >= lockoutDuration {
+			delete(t.failures, name)
+		}
+	}
+	for name, until := range t.lockedUntil {
+		if !now.Before(until) {
+			delete(t.lockedUntil, name)
+		}
+	}
+}
+
+// recordSuccess clears the failure count after a successful login
+func (t *loginThrottle) recordSuccess(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, username)
+}
+
+// storedLockedFor returns how long the user's persisted lockout has left, if any
+func storedLockedFor(ctx context.Context, username string) (time.Duration, bool) {
+	store := currentUserStore()
+	if store == nil {
+		return 0, false
+	}
+	user, err := store.FindUser(ctx, username)
+	if err != nil {
+		return 0, false
+	}
+	remaining := user.LockedUntil.Sub(clock())
+	return remaining, remaining > 0
+}
+
+// recordStoredFailure persists a failed login for known users and reports whether it
+// locked the account
+func recordStoredFailure(ctx context.Context, username string) bool {
+	store := currentUserStore()
+	if store == nil {
+		return false
+	}
+	locked, err := store.RecordFailedLogin(ctx, username, maxFailedLogins, lockoutDuration)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		requestLogger(ctx).Error("failed to record failed login", "error", err)
+	}
+	return locked
+}
+
+// clearStoredFailures resets the persisted failed login count after a successful login
+func clearStoredFailures(ctx context.Context, username string) {
+	if store := currentUserStore(); store != nil {
+		if err := store.ClearFailedLogins(ctx, username); err != nil {
+			requestLogger(ctx).Error("failed to clear failed logins", "error", err)
+		}
+	}
+}
+
+// accountLockedFor returns how long username stays locked, checking the in-memory
+// throttle first and then the persisted lockout
+func accountLockedFor(ctx context.Context, username string) (time.Duration, bool) {
+	if remaining, locked := loginAttempts.lockedFor(tenantUsername(ctx, username)); locked {
+		return remaining, true
+	}
+	return storedLockedFor(ctx, username)
+}
+
+// recordLoginFailure counts a failed login in memory and in the store, notifying once
+// if either locks the account
+func recordLoginFailure(ctx context.Context, username string) {
+	lockedHere := loginAttempts.recordFailure(tenantUsername(ctx, username))
+	// the persisted count may cross the threshold first, e.g. after a restart
+	if lockedStored := recordStoredFailure(ctx, username); lockedHere || lockedStored {
+		lockoutNotifier.NotifyLockout(username, lockoutDuration)
+	}
+}
+
+// recordLoginSuccess clears the in-memory and persisted failure counts
+func recordLoginSuccess(ctx context.Context, username string) {
+	loginAttempts.recordSuccess(tenantUsername(ctx, username))
+	clearStoredFailures(ctx, username)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingNotifier remembers every lockout it is told about
+type recordingNotifier struct {
+	mu       sync.Mutex
+	lockouts []string
+	duration time.Duration
+}
+
+func (n *recordingNotifier) NotifyLockout(username string, duration time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lockouts = append(n.lockouts, username)
+	n.duration = duration
+}
+
+// freshLoginThrottle resets failed-login tracking for the duration of the test
+func freshLoginThrottle(t *testing.T) {
+	original := loginAttempts
+	loginAttempts = newLoginThrottle()
+	t.Cleanup(func() { loginAttempts = original })
+}
+
+func postLogin(name string, pass string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	form.Add("name", name)
+	form.Add("password", pass)
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+	return rr
+}
+
+func TestLockoutNotifiesOnLockout(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	notifier := &recordingNotifier{}
+	originalNotifier := lockoutNotifier
+	lockoutNotifier = notifier
+	defer func() { lockoutNotifier = originalNotifier }()
+
+	for i := 0; i < maxFailedLogins; i++ {
+		postLogin("bob", "wrong")
+	}
+
+	if len(notifier.lockouts) != 1 || notifier.lockouts[0] != "bob" {
+		t.Fatalf("notifier should be called once for bob, got %v", notifier.lockouts)
+	}
+	if notifier.duration != lockoutDuration {
+		t.Errorf("notifier should receive the lockout duration %v, got %v", lockoutDuration, notifier.duration)
+	}
+
+	rr := postLogin("bob", "secret")
+	if !strings.Contains(rr.Body.String(), "locked") {
+		t.Error("a locked account should be rejected even with the right password")
+	}
+}
+
+func TestLockoutResetsOnSuccess(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	for i := 0; i < maxFailedLogins-1; i++ {
+		postLogin("bob", "wrong")
+	}
+	postLogin("bob", "secret")
+	postLogin("bob", "wrong")
+
+	if _, locked := loginAttempts.lockedFor("bob"); locked {
+		t.Error("a successful login should reset the failure count")
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	throttle := newLoginThrottle()
+	throttle.lockedUntil["bob"] = time.Now().Add(-time.Second)
+
+	if _, locked := throttle.lockedFor("bob"); locked {
+		t.Error("lockout should end once its duration has passed")
+	}
+}
+
+func TestStoredLockoutSurvivesRestart(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+	useMemoryUserStore(t, store)
+
+	for i := 0; i < maxFailedLogins; i++ {
+		postLogin("bob", "wrong")
+	}
+	user, _ := store.FindUser(context.Background(), "bob")
+	if !user.LockedUntil.After(time.Now()) {
+		t.Fatalf("lockout should be persisted on the user, got locked_until %v", user.LockedUntil)
+	}
+
+	// a restart forgets the in-memory throttle but not the stored lockout
+	loginAttempts = newLoginThrottle()
+	if rr := postLogin("bob", "secret"); !strings.Contains(rr.Body.String(), "locked") {
+		t.Error("a persisted lockout should reject the right password after a restart")
+	}
+}
+
+func TestStoredLockoutAcrossInstances(t *testing.T) {
+	freshLoginThrottle(t)
+	// another instance already counted the earlier failures
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret", FailedAttempts: maxFailedLogins - 1})
+	useMemoryUserStore(t, store)
+	notifier := &recordingNotifier{}
+	originalNotifier := lockoutNotifier
+	lockoutNotifier = notifier
+	defer func() { lockoutNotifier = originalNotifier }()
+
+	postLogin("bob", "wrong")
+
+	if len(notifier.lockouts) != 1 {
+		t.Errorf("crossing the stored threshold should notify once, got %v", notifier.lockouts)
+	}
+	if rr := postLogin("bob", "secret"); !strings.Contains(rr.Body.String(), "locked") {
+		t.Error("the stored lockout should apply on this instance too")
+	}
+}
+
+func TestStoredLockoutUnlocksAfterWindow(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret",
+		FailedAttempts: 2, LockedUntil: time.Now().Add(-time.Second)})
+	useMemoryUserStore(t, store)
+
+	rr := postLogin("bob", "secret")
+	if location := rr.Header().Get("Location"); location != "/internal" {
+		t.Fatalf("login should succeed once the lockout window has passed, redirected to %q", location)
+	}
+	user, _ := store.FindUser(context.Background(), "bob")
+	if user.FailedAttempts != 0 || !user.LockedUntil.IsZero() {
+		t.Errorf("a successful login should clear the stored counter, got %d / %v", user.FailedAttempts, user.LockedUntil)
+	}
+}
+
+func TestLockoutRespondsWithRetryAfter(t *testing.T) {
+	fake := useFakeClock(t)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+	for i := 0; i < maxFailedLogins; i++ {
+		app.login("bob", "wrong")
+	}
+	fake.Advance(90 * time.Second)
+	want := strconv.Itoa(int((lockoutDuration - 90*time.Second).Seconds()))
+
+	rr := app.login("bob", "secret")
+	if rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "locked") {
+		t.Errorf("expected a 429 page explaining the lockout, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Retry-After"); got != want {
+		t.Errorf("expected Retry-After %s, got %q", want, got)
+	}
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"name":"bob","password":"secret"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = app.do(req)
+	if rr.Code != http.StatusTooManyRequests || decodeAPIError(t, rr).Code != errCodeLocked || rr.Header().Get("Retry-After") != want {
+		t.Errorf("expected a 429 JSON lockout with Retry-After %s, got %d %q", want, rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	rr = app.postForm("/api/token", url.Values{"name": {"bob"}, "password": {"secret"}})
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != want {
+		t.Errorf("expected the token endpoint to answer 429 with Retry-After %s, got %d %q", want, rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestFailuresAreForgottenAfterLockoutDuration(t *testing.T) {
+	fake := useFakeClock(t)
+	throttle := newLoginThrottle()
+	for i := 0; i < maxFailedLogins-1; i++ {
+		throttle.recordFailure("bob")
+	}
+
+	fake.Advance(lockoutDuration)
+	if throttle.recordFailure("bob") {
+		t.Error("failures older than the lockout duration should not add up to a lockout")
+	}
+}
+
+func TestThrottleSweepsStaleEntries(t *testing.T) {
+	fake := useFakeClock(t)
+	throttle := newLoginThrottle()
+	throttle.recordFailure("alice")
+	for i := 0; i < maxFailedLogins; i++ {
+		throttle.recordFailure("bob")
+	}
+
+	fake.Advance(lockoutDuration + throttleSweepInterval)
+	throttle.recordFailure("carol")
+	if len(throttle.failures) != 1 || len(throttle.lockedUntil) != 0 {
+		t.Errorf("expected only carol's failure to be kept, got %v and %v", throttle.failures, throttle.lockedUntil)
+	}
+}
+
+func TestThrottleIsBounded(t *testing.T) {
+	original := maxThrottleEntries
+	maxThrottleEntries = 3
+	t.Cleanup(func() { maxThrottleEntries = original })
+	throttle := newLoginThrottle()
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("user%d", i)
+		for j := 0; j < maxFailedLogins; j++ {
+			throttle.recordFailure(name)
+		}
+		throttle.recordFailure(name + "-typo")
+	}
+	if len(throttle.failures) > maxThrottleEntries || len(throttle.lockedUntil) > maxThrottleEntries {
+		t.Errorf("expected at most %d entries each, got %d failures and %d lockouts", maxThrottleEntries, len(throttle.failures), len(throttle.lockedUntil))
+	}
+	if _, locked := throttle.lockedFor("user9"); !locked {
+		t.Error("the newest lockout should be kept")
+	}
+}
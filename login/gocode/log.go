@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level that gets logged; LOG_LEVEL sets it to debug, info, warn or error
+var logLevel = new(slog.LevelVar)
+
+// logFormat selects the log handler: "text" (default) or "json"
+var logFormat = "text"
+
+// newLogger builds a logger for logFormat and logLevel writing to w
+func newLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// configureLogging applies LOG_LEVEL and LOG_FORMAT and installs the default logger
+func configureLogging() {
+	if value := os.Getenv("LOG_FORMAT"); value == "text" || value == "json" {
+		logFormat = value
+	} else if value != "" {
+		slog.Warn("invalid LOG_FORMAT, expected text or json", "value", value)
+	}
+	slog.SetDefault(newLogger(os.Stdout))
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+			slog.Warn("invalid LOG_LEVEL, expected debug, info, warn or error", "value", value)
+			return
+		}
+		logLevel.Set(level)
+	}
+}
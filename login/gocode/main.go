@@ -6,16 +6,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
@@ -25,244 +36,1018 @@ var http_port = 8000
 var mongodb_port = 27017
 var database_name = "login_app"
 var collection_name = "users"
+
+// username and password are the seed and fallback user; the built-in values are public,
+// so they are only seeded in development (see loadConfig)
 var username = "Ahmad"
 var password = "Pass123"
+
+// appEnv is the deployment environment ("development" or "production")
+var appEnv = "development"
+
+// seedDefaultUser controls whether createUsers inserts the username/password seed user
+var seedDefaultUser = true
 var mongodb_username = ""
 var mongodb_password = ""
-var usersCollection *mongo.Collection
 
-// cookie handling
-var cookieHandler = securecookie.New(
+// usersCollection is swapped by initializeApp and tests while handlers read it, so
+// it is only accessed through currentUsersCollection and setUsersCollection
+var (
+	usersCollectionMu sync.RWMutex
+	usersCollection   *mongo.Collection
+)
+
+// currentUsersCollection returns the users collection, or nil without a database
+func currentUsersCollection() *mongo.Collection {
+	usersCollectionMu.RLock()
+	defer usersCollectionMu.RUnlock()
+	return usersCollection
+}
+
+// setUsersCollection replaces the users collection
+func setUsersCollection(collection *mongo.Collection) {
+	usersCollectionMu.Lock()
+	defer usersCollectionMu.Unlock()
+	usersCollection = collection
+}
+
+// connection retry settings, useful when MongoDB starts after the app (e.g. docker-compose)
+var mongoConnectAttempts = 1
+var mongoConnectBaseDelay = 500 * time.Millisecond
+var mongoConnectTimeout = 10 * time.Second
+
+// mongoHost is the MongoDB host initializeApp connected to, reused by watchDB
+var mongoHost = localhost
+
+// connectFunc and sleepFunc are swapped out in tests to simulate a slow-starting database
+var connectFunc = connectDB
+var sleepFunc = time.Sleep
+
+// cookie handling: the first codec signs new sessions, the rest only verify older ones
+var cookieCodecs = securecookie.CodecsFromPairs(
 	securecookie.GenerateRandomKey(64),
 	securecookie.GenerateRandomKey(32))
 
-func getUserName(request *http.Request) (userName string) {
-	if cookie, err := request.Cookie("session"); err == nil {
-		cookieValue := make(map[string]string)
-		if err = cookieHandler.Decode("session", cookie.Value, &cookieValue); err == nil {
-			userName = cookieValue["name"]
+// sessionCookieName names the session cookie; instances sharing a domain need distinct names
+var sessionCookieName = "session"
+
+// clock is the time source for session, lockout and token timestamps; tests swap it to move time
+var clock = time.Now
+
+// sessionSameSite is the SameSite mode of the session cookie; Strict also drops it on
+// cross-site navigations to the app
+var sessionSameSite = http.SameSiteLaxMode
+
+// sessionCookieDomain and sessionCookiePath scope the session cookie; set the domain to
+// share sessions across subdomains, or the path to confine them to a subpath
+var sessionCookieDomain = ""
+var sessionCookiePath = "/"
+
+// validCookieDomain reports whether domain is a host name usable as a cookie Domain,
+// optionally with the leading dot older browsers expect
+func validCookieDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
 		}
 	}
-	return userName
+	return true
 }
 
-func setSession(userName string, response http.ResponseWriter) {
-	value := map[string]string{
-		"name": userName,
+// validCookiePath reports whether path is an absolute path usable as a cookie Path
+func validCookiePath(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
 	}
-	if encoded, err := cookieHandler.Encode("session", value); err == nil {
-		cookie := &http.Cookie{
-			Name:  "session",
-			Value: encoded,
-			Path:  "/",
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f || c == ';' || c == ' ' {
+			return false
 		}
-		http.SetCookie(response, cookie)
 	}
+	return true
 }
 
-func clearSession(response http.ResponseWriter) {
-	cookie := &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
+// newSessionCookie returns the session cookie carrying value; setting and clearing it both go
+// through here so the browser sees matching Path and Domain attributes
+func newSessionCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     sessionCookiePath,
+		Domain:   sessionCookieDomain,
+		HttpOnly: true,
+		SameSite: sessionSameSite,
+	}
+}
+
+// sessionTTL is how long a session stays valid after login
+var sessionTTL = 24 * time.Hour
+
+// sessionGracePeriod keeps expired sessions readable for a while after sessionTTL so
+// the internal page can ask users to log in again; zero disables it
+var sessionGracePeriod time.Duration
+
+// readSession decodes the session cookie, returning nil when it is missing, invalid,
+// expired beyond the grace period or issued for another tenant
+func readSession(request *http.Request) map[string]string {
+	session := decodeSession(request)
+	if session == nil || session["tenant"] != tenantFrom(request.Context()) {
+		return nil
+	}
+	return session
+}
+
+// decodeSession decodes the session cookie or bearer token of the request
+func decodeSession(request *http.Request) map[string]string {
+	if authMode == authModeJWT {
+		return readTokenSession(request)
+	}
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
 	}
+	cookieValue := sessionStore.Load(cookie.Value)
+	if cookieValue == nil {
+		return nil
+	}
+	expiry, ok := sessionExpiry(cookieValue)
+	if !ok || !clock().Before(expiry.Add(sessionGracePeriod)) {
+		return nil
+	}
+	return cookieValue
+}
+
+// sessionExpired reports whether the request's session is past its expiry but still
+// within the grace period, in which case it may only be used read-only
+func sessionExpired(request *http.Request) bool {
+	expiry, ok := getSessionExpiry(request)
+	return ok && !clock().Before(expiry)
+}
+
+// sessionExpiry computes when a session expires: the token's own expiry in JWT mode,
+// otherwise its issue timestamp plus sessionTTL
+func sessionExpiry(cookieValue map[string]string) (time.Time, bool) {
+	session, ok := sessionFromValues(cookieValue)
+	if !ok {
+		return time.Time{}, false
+	}
+	return session.expiry()
+}
+
+// getSession returns the request's session, false when it has none (see readSession)
+func getSession(request *http.Request) (Session, bool) {
+	if sessionRevoked(request) {
+		return Session{}, false
+	}
+	values := readSession(request)
+	if values == nil {
+		return Session{}, false
+	}
+	return sessionFromValues(values)
+}
+
+func getUserName(request *http.Request) string {
+	session, _ := getSession(request)
+	return session.Username
+}
+
+// getSessionRole returns the role stored in the session, defaulting to a regular user
+func getSessionRole(request *http.Request) string {
+	if session, ok := getSession(request); ok && session.Role != "" {
+		return session.Role
+	}
+	return roleUser
+}
+
+// getSessionExpiry returns when the request's session expires
+func getSessionExpiry(request *http.Request) (time.Time, bool) {
+	if session, ok := getSession(request); ok {
+		return session.expiry()
+	}
+	return time.Time{}, false
+}
+
+func setSession(userName string, response http.ResponseWriter) error {
+	return setSessionWithRole(userName, roleUser, response)
+}
+
+// setSessionWithRole stores both the username and its role in the session cookie
+func setSessionWithRole(userName string, role string, response http.ResponseWriter) error {
+	_, err := setTenantSession("", userName, role, response)
+	return err
+}
+
+// setTenantSession stores the username, its role and its tenant in the session cookie;
+// readSession only accepts the session for requests of that tenant. It returns the
+// session's ID for registerSession, "" when sessions aren't counted.
+func setTenantSession(tenant string, userName string, role string, response http.ResponseWriter) (string, error) {
+	now := clock()
+	session := Session{Username: userName, Role: role, Tenant: tenant, Issued: now, LoggedIn: now, ID: newLimitedSessionID()}
+	if err := saveSession(session, response); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+// saveSession stores session and sets the cookie pointing at it
+func saveSession(session Session, response http.ResponseWriter) error {
+	encoded, err := sessionStore.Save(session.values())
+	if err != nil {
+		return err
+	}
+	cookie := newSessionCookie(encoded)
+	cookie.MaxAge = sessionCookieMaxAge()
+	http.SetCookie(response, cookie)
+	return nil
+}
+
+// sessionCookieMaxAge is the browser lifetime of session cookies in seconds: as long as
+// readSession accepts them, so the cookie and its embedded expiry can't drift apart
+func sessionCookieMaxAge() int {
+	return int((sessionTTL + sessionGracePeriod).Seconds())
+}
+
+func clearSession(response http.ResponseWriter) {
+	cookie := newSessionCookie("")
+	cookie.MaxAge = -1
 	http.SetCookie(response, cookie)
 }
 
+// loginAttempt is the outcome of attemptLogin
+type loginAttempt struct {
+	// result is one of the loginResult* metric labels
+	result string
+	// err is authenticate's error, for authErrorStatus
+	err error
+	// retryAfter is the rest of the lockout when result is loginResultLocked
+	retryAfter time.Duration
+}
+
+// attemptLogin checks name's lockout and password and records the outcome: the login
+// metric, the audit event and the lockout counters, plus Retry-After on response while the
+// account is locked. With tripped set (a filled honeypot) it fails like a wrong password.
+func attemptLogin(response http.ResponseWriter, request *http.Request, name string, pass string, tripped bool) loginAttempt {
+	if remaining, locked := accountLockedFor(request.Context(), name); locked {
+		recordLoginAttempt(loginResultLocked)
+		audit(request, auditLoginFailure, name, "locked")
+		setRetryAfter(response, remaining)
+		return loginAttempt{result: loginResultLocked, retryAfter: remaining}
+	}
+	err := errInvalidCredentials
+	if !tripped {
+		err = authenticate(request.Context(), name, pass)
+	}
+	switch {
+	case errors.Is(err, errStoreUnavailable):
+		// not the user's fault, so it doesn't count towards a lockout
+		requestLogger(request.Context()).Error("failed to verify credentials", "error", err)
+		recordLoginAttempt(loginResultError)
+		audit(request, auditLoginFailure, name, "store unavailable")
+		return loginAttempt{result: loginResultError, err: err}
+	case errors.Is(err, errAccountDisabled):
+		// the password was right, so it doesn't count towards a lockout either
+		recordLoginAttempt(loginResultDisabled)
+		audit(request, auditLoginFailure, name, "account disabled")
+		return loginAttempt{result: loginResultDisabled, err: err}
+	case err != nil:
+		recordLoginFailure(request.Context(), name)
+		recordLoginAttempt(loginResultInvalidCredentials)
+		audit(request, auditLoginFailure, name, "invalid credentials")
+		return loginAttempt{result: loginResultInvalidCredentials, err: err}
+	}
+	recordLoginSuccess(request.Context(), name)
+	recordLoginAttempt(loginResultSuccess)
+	audit(request, auditLoginSuccess, name, "")
+	return loginAttempt{result: loginResultSuccess}
+}
+
 // login handler
 
+// form field names the login form posts the credentials in, configurable so they don't
+// collide with the fields of external forms embedding it
+var loginUsernameField = "name"
+var loginPasswordField = "password"
+
+// loginResponse is the body of successful JSON logins in cookie mode
+type loginResponse struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Redirect string `json:"redirect"`
+}
+
+// loginContentTypes (LOGIN_CONTENT_TYPES) are the media types POST /login accepts; other
+// bodies would silently yield empty credentials, so they get 415 instead
+var loginContentTypes = []string{"application/x-www-form-urlencoded", "multipart/form-data", "application/json"}
+
+// acceptedLoginContent reports whether the request body has one of loginContentTypes
+func acceptedLoginContent(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, accepted := range loginContentTypes {
+		if strings.EqualFold(mediaType, accepted) {
+			return true
+		}
+	}
+	return false
+}
+
+// isJSONContent reports whether the request body is JSON
+func isJSONContent(request *http.Request) bool {
+	return strings.HasPrefix(request.Header.Get("Content-Type"), "application/json")
+}
+
+// loginFields returns the submitted username, password and next page, read from a JSON
+// object keyed like the form fields for JSON requests and from the form otherwise
+func loginFields(request *http.Request) (string, string, string, error) {
+	if !isJSONContent(request) {
+		// parses urlencoded forms too; FormValue alone would skip multipart once ParseForm ran
+		if err := request.ParseMultipartForm(loginBodyLimit); isBodyTooLarge(err) {
+			return "", "", "", err
+		}
+		return request.FormValue(loginUsernameField), request.FormValue(loginPasswordField), request.FormValue("next"), nil
+	}
+	var body map[string]string
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		return "", "", "", err
+	}
+	return body[loginUsernameField], body[loginPasswordField], body["next"], nil
+}
+
+// loginHandler serves both the login form and API clients: requests that send JSON or
+// accept it get a JSON body and status code, everyone else gets pages and redirects
 func loginHandler(response http.ResponseWriter, request *http.Request) {
-	name := request.FormValue("name")
-	pass := request.FormValue("password")
-	redirectTarget := "/"
-	ok := verifyCredentials(name, pass)
-	if ok {
-
-		setSession(name, response)
-		redirectTarget = "/internal"
+	asJSON := isJSONContent(request) || wantsJSON(request)
+	if !acceptedLoginContent(request) {
+		message := "unsupported content type, expected one of " + strings.Join(loginContentTypes, ", ")
+		if asJSON {
+			writeJSONError(response, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, message)
+			return
+		}
+		http.Error(response, message, http.StatusUnsupportedMediaType)
+		return
+	}
+	rawName, pass, rawNext, err := loginFields(request)
+	if isBodyTooLarge(err) {
+		httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+		return
+	}
+	if err != nil {
+		writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, "expected a JSON object of strings")
+		return
+	}
+	name := normalizeUsername(rawName)
+	next := safeNext(rawNext)
+	if err := validateUsername(name); err != nil {
+		recordLoginAttempt(loginResultInvalidCredentials)
+		if asJSON {
+			writeJSONError(response, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		renderErrorPage(response, errorPage{
+			Status:   http.StatusBadRequest,
+			Title:    "Invalid login",
+			Message:  fmt.Sprintf("User names are %d to %d characters long.", minUsernameLength, maxUsernameLength),
+			Link:     loginURL("", next),
+			LinkText: "Try again",
+		})
+		return
+	}
+	// a filled honeypot field fails silently, whatever the credentials
+	attempt := attemptLogin(response, request, name, pass, honeypotTripped(request))
+	switch attempt.result {
+	case loginResultLocked:
+		if asJSON {
+			writeJSONError(response, http.StatusTooManyRequests, errCodeLocked, "account temporarily locked")
+			return
+		}
+		renderErrorPage(response, errorPage{
+			Status:   http.StatusTooManyRequests,
+			Title:    "Account temporarily locked",
+			Message:  fmt.Sprintf("Too many failed attempts, try again in %v.", attempt.retryAfter.Round(time.Second)),
+			Link:     loginURL("locked", next),
+			LinkText: "Back",
+		})
+		return
+	case loginResultError:
+		if asJSON {
+			writeJSONError(response, authErrorStatus(attempt.err), errCodeUnavailable, "login is temporarily unavailable")
+			return
+		}
+		http.Error(response, "login is temporarily unavailable", authErrorStatus(attempt.err))
+		return
+	case loginResultDisabled:
+		if asJSON {
+			writeJSONError(response, authErrorStatus(attempt.err), errCodeAccountDisabled, "account disabled")
+			return
+		}
+		renderErrorPage(response, errorPage{
+			Status:   authErrorStatus(attempt.err),
+			Title:    "Account disabled",
+			Message:  "Contact an administrator to enable it again.",
+			Link:     loginURL("", next),
+			LinkText: "Back",
+		})
+		return
+	case loginResultInvalidCredentials:
+		if asJSON {
+			writeJSONError(response, authErrorStatus(attempt.err), errCodeInvalidCredentials, "invalid credentials")
+			return
+		}
+		renderErrorPage(response, errorPage{
+			Status:   authErrorStatus(attempt.err),
+			Title:    "Invalid login",
+			Link:     loginURL("invalid", next),
+			LinkText: "Try again",
+		})
+		return
+	}
+
+	role := lookupRole(request.Context(), name)
+	redirectTarget := landingPage(role)
+	if next != "" {
+		redirectTarget = next
+	}
+	if authMode == authModeJWT {
+		body, err := setTokenSession(tenantFrom(request.Context()), name, role, response)
+		if err != nil {
+			requestLogger(request.Context()).Error("failed to sign token", "error", err)
+			httpError(response, request, http.StatusInternalServerError, errCodeInternal, "failed to issue token")
+			return
+		}
+		if asJSON {
+			response.Header().Set("Cache-Control", "no-store")
+			writeJSON(response, http.StatusOK, body)
+			return
+		}
 	} else {
-		// print invalid login
-		fmt.Fprintf(response, "<h1>Invalid login</h1><a href=\"/\">Try again</a>")
+		sessionID, err := setTenantSession(tenantFrom(request.Context()), name, role, response)
+		if err != nil {
+			requestLogger(request.Context()).Error("failed to save session", "error", err)
+			httpError(response, request, http.StatusInternalServerError, errCodeInternal, "failed to start session")
+			return
+		}
+		registerSession(request.Context(), name, sessionID)
+		if asJSON {
+			writeJSON(response, http.StatusOK, loginResponse{Username: name, Role: role, Redirect: redirectTarget})
+			return
+		}
 	}
 	http.Redirect(response, request, redirectTarget, http.StatusFound)
 }
 
 // logout handler
 
+// logoutRedirect is where users land after logging out; like ?next= it must be a local path
+var logoutRedirect = "/"
+
+// logoutConfirm serves a confirmation form on GET /logout, so prefetched or followed
+// links can't log users out
+var logoutConfirm = false
+
+const logoutPage = `
+<link rel="stylesheet" href="/static/style.css">
+<h1>Logout</h1>
+<p>Do you want to log out?</p>
+<form method="post" action="/logout">%s
+    <button type="submit">Logout</button>
+</form>
+<a href="/internal">Cancel</a>
+`
+
 func logoutHandler(response http.ResponseWriter, request *http.Request) {
-	clearSession(response)
-	http.Redirect(response, request, "/", http.StatusFound)
+	if userName := getUserName(request); userName != "" {
+		audit(request, auditLogout, userName, "")
+	}
+	destroySession(response, request)
+	redirectTarget := safeNext(logoutRedirect)
+	if redirectTarget == "" {
+		redirectTarget = "/"
+	}
+	http.Redirect(response, request, redirectTarget, http.StatusFound)
+}
+
+// logoutPageHandler asks for confirmation before the POST /logout
+func logoutPageHandler(response http.ResponseWriter, request *http.Request) {
+	fmt.Fprintf(response, logoutPage, csrfFormField(request))
 }
 
 // index page
 
 const indexPage = `
+<link rel="stylesheet" href="/static/style.css">
 <h1>Login</h1>
 <form method="post" action="/login">
     <label for="name">User name</label>
-    <input type="text" id="name" name="name">
+    <input type="text" id="name" name="%s">
     <label for="password">Password</label>
-    <input type="password" id="password" name="password">
-    <button type="submit">Login</button>
+    <input type="password" id="password" name="%s">
+    %s<button type="submit">Login</button>
 </form>
 `
 
 func indexPageHandler(response http.ResponseWriter, request *http.Request) {
-	fmt.Fprint(response, indexPage)
+	fmt.Fprintf(response, indexPage, html.EscapeString(loginUsernameField), html.EscapeString(loginPasswordField), honeypotField())
+}
+
+// loginPage is the login form served by GET /login, with an optional error message
+const loginPage = `
+<link rel="stylesheet" href="/static/style.css">
+<h1>Login</h1>
+%s<form method="post" action="%s">
+    <label for="name">User name</label>
+    <input type="text" id="name" name="%s">
+    <label for="password">Password</label>
+    <input type="password" id="password" name="%s">
+    %s<button type="submit">Login</button>
+</form>
+`
+
+// loginErrors maps the ?error= codes to messages; unknown codes show nothing
+var loginErrors = map[string]string{
+	"invalid": "Invalid user name or password.",
+	"locked":  "Too many failed attempts, please try again later.",
+	"expired": "Your session has expired, please log in again.",
+	"sso":     "Single sign-on failed, please try again.",
+}
+
+// safeNext returns next when it is a local path, so the login form can't be used to
+// redirect users to another site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	return next
+}
+
+// loginURL links to the login page with an error code and the page to return to
+func loginURL(errorCode string, next string) string {
+	query := url.Values{}
+	if errorCode != "" {
+		query.Set("error", errorCode)
+	}
+	if next = safeNext(next); next != "" {
+		query.Set("next", next)
+	}
+	if len(query) == 0 {
+		return "/login"
+	}
+	return "/login?" + query.Encode()
+}
+
+// loginPageHandler renders the login form, keeping ?next= in the form action
+func loginPageHandler(response http.ResponseWriter, request *http.Request) {
+	errorBlock := ""
+	if message, ok := loginErrors[request.FormValue("error")]; ok {
+		errorBlock = "<p class=\"error\">" + message + "</p>\n"
+	}
+	action := "/login"
+	if next := safeNext(request.FormValue("next")); next != "" {
+		action += "?next=" + url.QueryEscape(next)
+	}
+	fmt.Fprintf(response, loginPage, errorBlock, html.EscapeString(action),
+		html.EscapeString(loginUsernameField), html.EscapeString(loginPasswordField), honeypotField())
 }
 
 // internal page
 
 const internalPage = `
-<h1>Internal</h1>
+%s<h1>Internal</h1>
+<hr>
+<small>%s</small>
+<p>Role: %s</p>
+<p>Session expires: %s</p>
+<form method="post" action="/logout">%[5]s
+    <button type="submit">Logout</button>
+</form>
+<h2>Change password</h2>
+<form method="post" action="/change-password">%[5]s
+    <label for="old_password">Current password</label>
+    <input type="password" id="old_password" name="old_password">
+    <label for="new_password">New password</label>
+    <input type="password" id="new_password" name="new_password">
+    <button type="submit">Change password</button>
+</form>
+<h2>Delete account</h2>
+<form method="post" action="/delete-account">%[5]s
+    <label for="delete_password">Password</label>
+    <input type="password" id="delete_password" name="password">
+    <button type="submit">Delete account</button>
+</form>
+`
+
+// expiredInternalPage is the read-only internal page served during the session grace period
+const expiredInternalPage = `
+%s<h1>Internal</h1>
 <hr>
-<small>You're welcome %s</small>
-<form method="post" action="/logout">
+<p><strong>Your session has expired, please log in again.</strong></p>
+<small>%s</small>
+<p>Role: %s</p>
+<p>Session expired: %s</p>
+<form method="post" action="/logout">%[5]s
     <button type="submit">Logout</button>
 </form>
 `
 
+// internalPageInfo is the JSON variant of the internal page
+type internalPageInfo struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired,omitempty"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// internalPageHandler shows the logged-in user's page; mount it behind requireAuth
 func internalPageHandler(response http.ResponseWriter, request *http.Request) {
-	userName := getUserName(request)
-	if userName != "" {
-		fmt.Fprintf(response, internalPage, userName)
-	} else {
-		http.Redirect(response, request, "/", http.StatusFound)
+	userName := authUser(request)
+	expiry, _ := getSessionExpiry(request)
+	role := getSessionRole(request)
+	expired := sessionExpired(request)
+	if wantsJSON(request) {
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode(internalPageInfo{Username: userName, Role: role, ExpiresAt: expiry.UTC(), Expired: expired})
+		return
 	}
+	page := internalPage
+	if expired {
+		page = expiredInternalPage
+	}
+	fmt.Fprintf(response, page, brandHeader(), welcomeMessage(userName, role), html.EscapeString(role), expiry.UTC().Format(time.RFC1123), csrfFormField(request))
 }
 
 // server main method
 
 var router = mux.NewRouter()
 
-// getMongoDBIP parses command line arguments and returns the MongoDB IP
+// getMongoDBIP parses the command line flags and returns the MongoDB host
 func getMongoDBIP() string {
-	var mongodb_ip string
-	if len(os.Args) > 1 {
-		if os.Args[1] == "" {
-			mongodb_ip = localhost
-		} else {
-			mongodb_ip = os.Args[1]
-		}
-	} else {
-		mongodb_ip = localhost
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	mongodb_ip, err := parseFlags(fs, os.Args[1:])
+	if err != nil {
+		slog.Warn("invalid command line, using defaults", "error", err)
+		return localhost
 	}
 	return mongodb_ip
 }
 
-// getMongoDBCredentials reads MongoDB username and password from environment variables
+// getMongoDBCredentials reads MongoDB username and password from environment variables,
+// preferring the files named by MONGODB_USERNAME_FILE/MONGODB_PASSWORD_FILE (Docker secrets)
 func getMongoDBCredentials() (string, string) {
-	username := os.Getenv("MONGODB_USERNAME")
-	password := os.Getenv("MONGODB_PASSWORD")
+	username := getEnvOrFile("MONGODB_USERNAME")
+	password := getEnvOrFile("MONGODB_PASSWORD")
 	return username, password
 }
 
 // initializeApp sets up the database connection and creates users
 func initializeApp(mongodb_ip string) {
-	fmt.Println("Mongodb IP: ", mongodb_ip)
+	if storeBackend == storeBackendSQL {
+		slog.Info("initializing", "store_backend", storeBackend, "sql_driver", sqlDriver)
+		if err := createUsers(context.Background()); err != nil {
+			slog.Error("failed to create user", "error", err)
+		}
+		return
+	}
+	mongoHost = mongodb_ip
+	slog.Info("initializing", "mongodb_ip", mongodb_ip)
 	mongodb_username, mongodb_password = getMongoDBCredentials()
-	usersCollection = connectDB(mongodb_ip)
-	if usersCollection != nil {
-		createUsers()
+	collection := connectWithRetry(mongodb_ip)
+	setUsersCollection(collection)
+	if collection != nil {
+		prepareUsersCollection(context.Background(), collection)
 	} else {
-		fmt.Println("Warning: Running without database connection. Login will use hardcoded credentials.")
+		slog.Warn("running without database connection, login will use hardcoded credentials")
+	}
+}
+
+// prepareUsersCollection normalizes legacy usernames and creates the user indexes and seed
+// users in a freshly connected collection; it runs at startup and when the app recovers
+// from running without a database
+func prepareUsersCollection(ctx context.Context, collection *mongo.Collection) {
+	// before seeding, which would otherwise add "ahmad" next to a stored "Ahmad"
+	normalizeStoredUsernames(ctx, collection)
+	prepareUserIndexes(ctx, collection)
+	if err := createUsers(ctx); err != nil {
+		slog.Error("failed to create user", "error", err)
 	}
 }
 
 // setupRouter configures all the HTTP routes
 func setupRouter() *mux.Router {
+	router = mux.NewRouter()
+	router.Use(tenantMiddleware)
+	router.Use(sessionMiddleware)
+	router.Use(activeSessionMiddleware)
+	router.Use(slidingSessionMiddleware)
+	router.Use(corsMiddleware)
+	router.Use(csrfMiddleware)
+	router.PathPrefix("/api/").Methods("OPTIONS").HandlerFunc(preflightHandler)
 	router.HandleFunc("/", indexPageHandler)
-	router.HandleFunc("/internal", internalPageHandler)
-	router.HandleFunc("/login", loginHandler).Methods("POST")
-	router.HandleFunc("/logout", logoutHandler).Methods("POST")
+	router.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/livez", livezHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", readyzHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.PathPrefix("/static/").Handler(staticHandler()).Methods("GET", "HEAD")
+	router.HandleFunc("/internal", requireAuth(internalPageHandler))
+	router.HandleFunc("/login", loginPageHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/login", bodyLimit(loginBodyLimit, loginHandler)).Methods("POST")
+	router.HandleFunc("/logout", bodyLimit(maxBodyBytes, logoutHandler)).Methods("POST")
+	if logoutConfirm {
+		router.HandleFunc("/logout", logoutPageHandler).Methods("GET")
+	}
+	router.HandleFunc("/change-password", bodyLimit(loginBodyLimit, requireAuth(changePasswordHandler))).Methods("POST")
+	router.HandleFunc("/forgot-password", bodyLimit(loginBodyLimit, forgotPasswordHandler)).Methods("POST")
+	router.HandleFunc("/reset-password", bodyLimit(loginBodyLimit, resetPasswordHandler)).Methods("POST")
+	router.HandleFunc("/delete-account", bodyLimit(loginBodyLimit, requireAuth(deleteAccountHandler))).Methods("POST")
+	router.HandleFunc("/users", requireAdmin(usersHandler)).Methods("GET")
+	router.HandleFunc("/db-ping", requireAdmin(dbPingHandler)).Methods("GET")
+	router.HandleFunc("/api/me", requireAuth(meHandler)).Methods("GET")
+	router.HandleFunc("/csrf-token", requireAuth(csrfTokenHandler)).Methods("GET")
+	router.HandleFunc("/auth/validate", authValidateHandler).Methods("GET")
+	router.HandleFunc("/auth/oidc/start", oidcStartHandler).Methods("GET")
+	router.HandleFunc("/auth/oidc/callback", oidcCallbackHandler).Methods("GET")
+	router.HandleFunc("/api/token", bodyLimit(loginBodyLimit, tokenHandler)).Methods("POST")
+	router.HandleFunc("/api/token", bearerAuth(tokenInfoHandler)).Methods("GET")
+	router.HandleFunc("/api/users/import", bodyLimit(importBodyLimit, requireAdmin(importUsersHandler))).Methods("POST")
+	router.HandleFunc("/api/users", bodyLimit(maxBodyBytes, requireAdmin(createUserHandler))).Methods("POST")
+	router.HandleFunc("/api/users/{username}/role", bodyLimit(maxBodyBytes, requireAdmin(updateRoleHandler))).Methods("PUT", "PATCH")
+	router.HandleFunc("/api/users/{username}/enabled", bodyLimit(maxBodyBytes, requireAdmin(updateEnabledHandler))).Methods("PUT", "PATCH")
+	router.HandleFunc("/api/users/{username}", bodyLimit(maxBodyBytes, requireAdmin(deleteUserHandler))).Methods("DELETE")
+	router.HandleFunc("/admin/users/{username}/reset-password", bodyLimit(maxBodyBytes, requireAdmin(adminResetPasswordHandler))).Methods("POST")
 	return router
 }
 
-// startServer starts the HTTP server on the specified port
+// appHandler wraps the router with the middleware that must run before routing
+func appHandler(router *mux.Router) http.Handler {
+	return requestIDMiddleware(headRequests(recoverPanics(securityHeaders(rateLimit(limitInflight(methodOverride(router)))))))
+}
+
+// shutdownTimeout bounds how long shutdown waits for in-flight HTTP requests
+var shutdownTimeout = 15 * time.Second
+
+// HTTP server timeouts, so slow clients can't hold connections open indefinitely
+var httpReadHeaderTimeout = 5 * time.Second
+var httpReadTimeout = 15 * time.Second
+var httpWriteTimeout = 30 * time.Second
+var httpIdleTimeout = 120 * time.Second
+
+// newServer builds the HTTP server serving handler with the configured timeouts
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// bindAddr is the IP address to listen on; empty listens on all interfaces
+var bindAddr = ""
+
+// listen opens the server socket on bindAddr and port
+func listen(port int) (net.Listener, error) {
+	if bindAddr != "" && bindAddr != "localhost" && net.ParseIP(bindAddr) == nil {
+		return nil, fmt.Errorf("invalid bind address %q: expected an IP address", bindAddr)
+	}
+	return net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+}
+
+// shutdownServer stops server gracefully, waiting up to timeout for in-flight requests;
+// connections still busy after that are closed so a hung handler can't block shutdown
+func shutdownServer(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("requests still running after the shutdown timeout, closing their connections", "timeout", timeout)
+		err = server.Close()
+	}
+	if err != nil {
+		slog.Error("HTTP shutdown error", "error", err)
+	}
+}
+
+// startServer starts the HTTP server on the specified port and, on SIGINT/SIGTERM,
+// stops accepting requests, waits for in-flight ones and releases the database
 func startServer(port int) error {
-	http.Handle("/", router)
-	fmt.Printf("Server starting on port %d...\n", port)
-	return http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	listener, err := listen(port)
+	if err != nil {
+		return err
+	}
+	server := newServer(appHandler(router))
+
+	warnStop := make(chan struct{})
+	defer close(warnStop)
+	go warnWhileFallback(warnStop, fallbackWarnInterval)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if storeBackend == storeBackendMongo {
+		go watchDB(watchCtx, mongoHost, dbWatchInterval)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		slog.Info("shutting down")
+
+		shutdownServer(server, shutdownTimeout)
+		// stop reconnecting before the client is released
+		stopWatch()
+		shutdownDB()
+	}()
+
+	slog.Info("server starting", "addr", listener.Addr().String())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
 }
 
 // runApp is the main application logic, separated for testing
-func runApp() {
+func runApp() error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
 	mongodb_ip := getMongoDBIP()
+	logEffectiveConfig(mongodb_ip)
 	initializeApp(mongodb_ip)
 	setupRouter()
+	return nil
 }
 
 func main() {
-	runApp()
+	if ran, err := runCommand(os.Args[1:], os.Stdout); ran {
+		if err != nil {
+			slog.Error("command failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := runApp(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
 
 	err := startServer(http_port)
 	if err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
+		slog.Error("failed to start server", "error", err)
 	}
 }
 
+// mongoURI builds the connection string for host, with authentication if credentials are
+// provided and mongoURIOptions as its query
+func mongoURI(host string, user string, pass string) string {
+	uri := fmt.Sprintf("mongodb://%s:%d/", host, mongodb_port)
+	if user != "" && pass != "" {
+		uri = fmt.Sprintf("mongodb://%s:%s@%s:%d/", user, pass, host, mongodb_port)
+	}
+	return withURIOptions(uri, mongoURIOptions)
+}
+
 func connectDB(mongodb_ip string) *mongo.Collection {
-	fmt.Println(mongodb_ip)
+	slog.Debug("connecting to MongoDB", "host", mongodb_ip, "port", mongodb_port)
 
-	// Build connection string with authentication if credentials are provided
-	var uri string
-	if mongodb_username != "" && mongodb_password != "" {
-		uri = fmt.Sprintf("mongodb://%s:%s@%s:%d/", mongodb_username, mongodb_password, mongodb_ip, mongodb_port)
-	} else {
-		uri = fmt.Sprintf("mongodb://%s:%d/", mongodb_ip, mongodb_port)
-	}
+	uri := mongoURI(mongodb_ip, mongodb_username, mongodb_password)
 
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+
+	opts, err := mongoClientOptions(uri)
+	if err != nil {
+		slog.Error("invalid MongoDB TLS configuration", "error", err)
+		return nil
+	}
+	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		fmt.Printf("Failed to connect to MongoDB: %v\n", err)
+		slog.Error("failed to connect to MongoDB", "error", err)
 		return nil
 	}
-	if err := client.Ping(context.TODO(), readpref.Primary()); err != nil {
-		fmt.Printf("Failed to ping MongoDB: %v\n", err)
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		slog.Error("failed to ping MongoDB", "error", err)
+		client.Disconnect(context.Background())
 		return nil
 	}
 
+	setMongoClient(client)
 	db := client.Database(database_name)
 	db.CreateCollection(context.TODO(), collection_name)
-	fmt.Println("Successfully connected to MongoDB")
+	slog.Info("connected to MongoDB", "database", database_name)
 	return db.Collection(collection_name)
 }
 
-func createUsers() {
-	if usersCollection == nil {
-		fmt.Println("Skipping user creation - no database connection")
-		return
+// connectWithRetry calls connectFunc up to mongoConnectAttempts times, doubling the
+// delay between attempts, and returns nil once all attempts have failed
+func connectWithRetry(mongodb_ip string) *mongo.Collection {
+	attempts := mongoConnectAttempts
+	if attempts < 1 {
+		attempts = 1
 	}
-	// insert a single document into a collection
-	// create a bson.D object
-	user := bson.D{{Key: "username", Value: username}, {Key: "password", Value: password}}
-	// insert the bson object using InsertOne()
-	_, err := usersCollection.InsertOne(context.TODO(), user)
-	// check for errors in the insertion
-	if err != nil {
-		fmt.Printf("Failed to create user: %v\n", err)
-	} else {
-		fmt.Println("Default user created successfully")
+	delay := mongoConnectBaseDelay
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if collection := connectFunc(mongodb_ip); collection != nil {
+			return collection
+		}
+		slog.Warn("MongoDB connection attempt failed", "attempt", attempt, "attempts", attempts)
+		if attempt < attempts {
+			slog.Info("retrying MongoDB connection", "delay", delay)
+			sleepFunc(delay)
+			delay *= 2
+		}
 	}
+	return nil
 }
 
-func verifyCredentials(user string, pass string) bool {
-	// If no database connection, use hardcoded credentials for demonstration
-	if usersCollection == nil {
-		fmt.Println("Using hardcoded credentials (no database)")
-		return user == username && pass == password
+// createUsers seeds the users of SEED_USERS_FILE or, without one, the default user when
+// SEED_DEFAULT_USER is on. Seeding is an upsert, so it is safe on every start and picks
+// up changed passwords. The writes are bound to ctx, so a cancelled context aborts them
+// with the context's error.
+func createUsers(ctx context.Context) error {
+	if len(seedUsers) == 0 && !seedDefaultUser {
+		slog.Info("skipping default user seeding (SEED_DEFAULT_USER is off)")
+		return nil
 	}
-
-	// retrieve single and multiple documents with a specified filter using FindOne() and Find()
-	// create a search filer
-	//filter := bson.D{{Key: "username:", Value: user}, {Key: "password", Value: pass}}
-	filter := bson.D{
-		{Key: "username", Value: user},
-		{Key: "password", Value: pass},
+	store := currentUserStore()
+	if store == nil {
+		slog.Info("skipping user creation, no database connection")
+		return nil
+	}
+	if len(seedUsers) > 0 {
+		for _, user := range seedUsers {
+			if err := upsertSeedUser(ctx, store, user.Username, user.Password, user.Role); err != nil {
+				return fmt.Errorf("seeding %s: %w", user.Username, err)
+			}
+		}
+		slog.Info("seed users seeded", "count", len(seedUsers))
+		return nil
+	}
+	if username == "" || password == "" {
+		slog.Warn("skipping default user seeding, SEED_USERNAME/SEED_PASSWORD not set")
+		return nil
 	}
+	if err := upsertSeedUser(ctx, store, username, password, roleAdmin); err != nil {
+		return err
+	}
+	slog.Info("default user seeded")
+	return nil
+}
 
-	var result bson.D
-	err := usersCollection.FindOne(context.TODO(), filter).Decode(&result)
+// verifyCredentials reports whether user/pass authenticate; see authenticate for why not
+func verifyCredentials(ctx context.Context, user string, pass string) bool {
+	err := authenticate(ctx, user, pass)
+	if errors.Is(err, errStoreUnavailable) {
+		requestLogger(ctx).Error("failed to look up user", "error", err)
+	}
 	return err == nil
 }
+
+// authenticate checks user/pass against the store, returning errInvalidCredentials,
+// errAccountDisabled or errStoreUnavailable on failure; the lookup is bound to ctx (normally the request
+// context) so a client disconnect cancels it
+func authenticate(ctx context.Context, user string, pass string) error {
+	store := currentUserStore()
+	// If no database connection, use hardcoded credentials for demonstration
+	if store == nil {
+		requestLogger(ctx).Debug("using hardcoded credentials (no database)")
+		if !verifyFallbackCredentials(user, pass) {
+			return errInvalidCredentials
+		}
+		return nil
+	}
+
+	// retrieve the user document by username and compare against the stored (hashed) password
+	found, err := store.FindUser(ctx, normalizeUsername(user))
+	if errors.Is(err, errUserNotFound) {
+		// as slow as a wrong password, so timing doesn't tell which usernames exist
+		rejectPassword(pass)
+		return errInvalidCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStoreUnavailable, err)
+	}
+	if !passwordMatches(found.Password, pass) {
+		return errInvalidCredentials
+	}
+	if !found.isEnabled() {
+		return errAccountDisabled
+	}
+	return nil
+}
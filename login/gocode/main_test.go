@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -50,24 +54,16 @@ func TestIndexPageHandler(t *testing.T) {
 }
 
 func TestInternalPageHandlerWithoutSession(t *testing.T) {
-	req, err := http.NewRequest("GET", "/internal", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	app := newTestApp(t)
 
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(internalPageHandler)
-
-	handler.ServeHTTP(rr, req)
+	rr := app.get("/internal")
 
 	// Should redirect to "/" when no session
 	if status := rr.Code; status != http.StatusFound {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusFound)
 	}
-
-	location := rr.Header().Get("Location")
-	if location != "/" {
+	if location := rr.Header().Get("Location"); location != "/" {
 		t.Errorf("handler returned wrong redirect location: got %v want %v",
 			location, "/")
 	}
@@ -150,6 +146,39 @@ func TestLogoutHandler(t *testing.T) {
 	}
 }
 
+func TestLogoutHandlerConfiguredRedirect(t *testing.T) {
+	original := logoutRedirect
+	defer func() { logoutRedirect = original }()
+
+	for configured, want := range map[string]string{
+		"/goodbye":            "/goodbye",
+		"//evil.example.com":  "/",
+		"https://example.com": "/",
+	} {
+		logoutRedirect = configured
+		rr := httptest.NewRecorder()
+		logoutHandler(rr, httptest.NewRequest("POST", "/logout", nil))
+		if location := rr.Header().Get("Location"); location != want {
+			t.Errorf("LOGOUT_REDIRECT %q: expected redirect to %q, got %q", configured, want, location)
+		}
+	}
+}
+
+func TestLogoutConfirmationPage(t *testing.T) {
+	original := logoutConfirm
+	logoutConfirm = true
+	defer func() { logoutConfirm = original }()
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/logout", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `<form method="post" action="/logout">`) {
+		t.Errorf("GET /logout should render the confirmation form, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(rr.Result().Cookies()) != 0 {
+		t.Error("GET /logout must not clear the session")
+	}
+}
+
 // Test session management functions
 func TestSetSession(t *testing.T) {
 	rr := httptest.NewRecorder()
@@ -240,7 +269,7 @@ func TestClearSession(t *testing.T) {
 // Test login with valid credentials (no database)
 func TestLoginHandlerWithValidCredentialsNoDatabase(t *testing.T) {
 	// Make sure usersCollection is nil to use hardcoded credentials
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	form := url.Values{}
 	form.Add("name", username)
@@ -284,39 +313,19 @@ func TestLoginHandlerWithValidCredentialsNoDatabase(t *testing.T) {
 
 // Test internal page handler with valid session
 func TestInternalPageHandlerWithSession(t *testing.T) {
-	// First, create a session
-	rr := httptest.NewRecorder()
-	userName := "testuser"
-	setSession(userName, rr)
-
-	// Get the cookie that was set
-	cookies := rr.Result().Cookies()
-	if len(cookies) == 0 {
-		t.Fatal("No cookies were set")
-	}
+	app := newTestApp(t, User{Username: "testuser", Password: "secret"})
+	cookie := app.loginCookie("testuser", "secret")
 
-	// Create a new request with the cookie
-	req, err := http.NewRequest("GET", "/internal", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.AddCookie(cookies[0])
-
-	// Test internalPageHandler
-	rr2 := httptest.NewRecorder()
-	handler := http.HandlerFunc(internalPageHandler)
-	handler.ServeHTTP(rr2, req)
+	rr := app.get("/internal", cookie)
 
-	// Should return 200 OK
-	if status := rr2.Code; status != http.StatusOK {
+	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
-
 	// Check that the page contains the username
-	body := rr2.Body.String()
-	if !strings.Contains(body, userName) {
-		t.Errorf("internal page should contain username: %v", userName)
+	body := rr.Body.String()
+	if !strings.Contains(body, "testuser") {
+		t.Errorf("internal page should contain username: %v", "testuser")
 	}
 	if !strings.Contains(body, "Internal") {
 		t.Error("internal page should contain 'Internal' heading")
@@ -325,16 +334,16 @@ func TestInternalPageHandlerWithSession(t *testing.T) {
 
 // Test verifyCredentials with hardcoded credentials
 func TestVerifyCredentialsNoDatabase(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	// Test valid credentials
-	result := verifyCredentials(username, password)
+	result := verifyCredentials(context.Background(), username, password)
 	if !result {
 		t.Error("verifyCredentials should return true for valid hardcoded credentials")
 	}
 
 	// Test invalid credentials
-	result = verifyCredentials("wronguser", "wrongpass")
+	result = verifyCredentials(context.Background(), "wronguser", "wrongpass")
 	if result {
 		t.Error("verifyCredentials should return false for invalid credentials")
 	}
@@ -375,17 +384,18 @@ func TestConnectDBSuccess(t *testing.T) {
 	// Clean up
 	if collection != nil {
 		collection.Database().Drop(context.Background())
+		disconnectDB(context.Background())
 	}
 }
 
 // Test createUsers without database connection
 func TestCreateUsersNoDatabase(t *testing.T) {
-	originalCollection := usersCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
 
-	usersCollection = nil
+	setUsersCollection(nil)
 	// This should not panic
-	createUsers()
+	createUsers(context.Background())
 }
 
 // Integration tests with MongoDB
@@ -442,12 +452,12 @@ func TestCreateUsersWithMongoDB(t *testing.T) {
 	defer cleanup()
 
 	// Set the global collection
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	setUsersCollection(testCollection)
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Create users
-	createUsers()
+	createUsers(context.Background())
 
 	// Verify user was created by checking count
 	count, err := testCollection.CountDocuments(context.Background(), map[string]interface{}{})
@@ -468,12 +478,12 @@ func TestCreateUsersErrorHandling(t *testing.T) {
 	defer cleanup()
 
 	// Set the global collection
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	setUsersCollection(testCollection)
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// First create a user
-	createUsers()
+	createUsers(context.Background())
 
 	// Create a unique index on username to force duplicate key error
 	ctx := context.Background()
@@ -487,8 +497,8 @@ func TestCreateUsersErrorHandling(t *testing.T) {
 		return
 	}
 
-	// Try to create users again - should get error but not panic
-	createUsers()
+	// Try to create users again - the upsert must not insert a duplicate
+	createUsers(context.Background())
 
 	// Verify we only have one user (the duplicate wasn't inserted)
 	count, err := testCollection.CountDocuments(ctx, map[string]interface{}{})
@@ -510,102 +520,48 @@ func TestVerifyCredentialsWithMongoDB(t *testing.T) {
 	defer cleanup()
 
 	// Set the global collection
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	setUsersCollection(testCollection)
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Create a test user
-	createUsers()
+	createUsers(context.Background())
 
 	// Test with correct credentials
-	result := verifyCredentials(username, password)
+	result := verifyCredentials(context.Background(), username, password)
 	if !result {
 		t.Error("verifyCredentials should return true for valid credentials in database")
 	}
 
 	// Test with incorrect credentials
-	result = verifyCredentials("wronguser", "wrongpass")
+	result = verifyCredentials(context.Background(), "wronguser", "wrongpass")
 	if result {
 		t.Error("verifyCredentials should return false for invalid credentials")
 	}
 }
 
-func TestLoginHandlerWithValidCredentialsWithDatabase(t *testing.T) {
-	testCollection, cleanup := setupTestMongoDB(t)
-	if testCollection == nil {
-		return
-	}
-	defer cleanup()
-
-	// Set the global collection
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
-
-	// Create a test user
-	createUsers()
-
-	// Test login with valid credentials
-	form := url.Values{}
-	form.Add("name", username)
-	form.Add("password", password)
-
-	req, err := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+func TestLoginHandlerWithValidCredentialsWithStore(t *testing.T) {
+	app := newTestApp(t, User{Username: username, Password: password})
 
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(loginHandler)
-	handler.ServeHTTP(rr, req)
+	rr := app.login(username, password)
 
 	// Should redirect to /internal
 	if status := rr.Code; status != http.StatusFound {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusFound)
 	}
-
-	location := rr.Header().Get("Location")
-	if location != "/internal" {
+	if location := rr.Header().Get("Location"); location != "/internal" {
 		t.Errorf("handler returned wrong redirect location: got %v want %v",
 			location, "/internal")
 	}
 }
 
-func TestLoginHandlerInvalidCredentialsWithDatabase(t *testing.T) {
-	testCollection, cleanup := setupTestMongoDB(t)
-	if testCollection == nil {
-		return
-	}
-	defer cleanup()
-
-	// Set the global collection
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
-
-	// Create a test user
-	createUsers()
-
-	// Test login with invalid credentials
-	form := url.Values{}
-	form.Add("name", "wronguser")
-	form.Add("password", "wrongpass")
-
-	req, err := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+func TestLoginHandlerInvalidCredentialsWithStore(t *testing.T) {
+	app := newTestApp(t, User{Username: username, Password: password})
 
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(loginHandler)
-	handler.ServeHTTP(rr, req)
+	rr := app.login("wronguser", "wrongpass")
 
-	// Check that response contains "Invalid login"
-	body := rr.Body.String()
-	if !strings.Contains(body, "Invalid login") {
+	if !strings.Contains(rr.Body.String(), "Invalid login") {
 		t.Error("response should contain 'Invalid login' message")
 	}
 }
@@ -613,7 +569,7 @@ func TestLoginHandlerInvalidCredentialsWithDatabase(t *testing.T) {
 // Additional edge case tests to increase coverage
 
 func TestLoginHandlerEmptyCredentials(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	form := url.Values{}
 	form.Add("name", "")
@@ -637,7 +593,7 @@ func TestLoginHandlerEmptyCredentials(t *testing.T) {
 }
 
 func TestLoginHandlerOnlyUsername(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	form := url.Values{}
 	form.Add("name", username)
@@ -661,16 +617,16 @@ func TestLoginHandlerOnlyUsername(t *testing.T) {
 }
 
 func TestVerifyCredentialsPartialMatch(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	// Test with correct username but wrong password
-	result := verifyCredentials(username, "wrongpass")
+	result := verifyCredentials(context.Background(), username, "wrongpass")
 	if result {
 		t.Error("verifyCredentials should return false for wrong password")
 	}
 
 	// Test with wrong username but correct password
-	result = verifyCredentials("wronguser", password)
+	result = verifyCredentials(context.Background(), "wronguser", password)
 	if result {
 		t.Error("verifyCredentials should return false for wrong username")
 	}
@@ -760,7 +716,7 @@ func TestInternalPageHandlerWithExpiredSession(t *testing.T) {
 	req.AddCookie(cookie)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(internalPageHandler)
+	handler := requireAuth(internalPageHandler)
 	handler.ServeHTTP(rr, req)
 
 	// Should redirect when session is expired/invalid
@@ -772,7 +728,7 @@ func TestInternalPageHandlerWithExpiredSession(t *testing.T) {
 
 // Test form submission with special characters
 func TestLoginHandlerSpecialCharacters(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	testCases := []struct {
 		name     string
@@ -811,14 +767,14 @@ func TestLoginHandlerSpecialCharacters(t *testing.T) {
 
 // Test new initialization functions
 func TestInitializeAppWithoutDatabase(t *testing.T) {
-	originalCollection := usersCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Initialize with invalid IP - should work with hardcoded credentials
 	initializeApp("invalid-ip")
 
 	// usersCollection should be nil
-	if usersCollection != nil {
+	if currentUsersCollection() != nil {
 		t.Error("usersCollection should be nil for invalid IP")
 	}
 }
@@ -840,12 +796,12 @@ func TestInitializeAppWithDatabase(t *testing.T) {
 		return
 	}
 
-	originalCollection := usersCollection
+	originalCollection := currentUsersCollection()
 	defer func() {
-		usersCollection = originalCollection
+		setUsersCollection(originalCollection)
 		// Clean up test database
-		if usersCollection != nil {
-			usersCollection.Database().Drop(context.Background())
+		if currentUsersCollection() != nil {
+			currentUsersCollection().Database().Drop(context.Background())
 		}
 	}()
 
@@ -853,7 +809,7 @@ func TestInitializeAppWithDatabase(t *testing.T) {
 	initializeApp("localhost")
 
 	// usersCollection should be set
-	if usersCollection == nil {
+	if currentUsersCollection() == nil {
 		t.Error("usersCollection should not be nil for valid MongoDB connection")
 	}
 }
@@ -896,13 +852,13 @@ func TestSetupRouter(t *testing.T) {
 func TestSetupRouterMethodRestrictions(t *testing.T) {
 	r := setupRouter()
 
-	// Test that GET to /login returns method not allowed
-	req, _ := http.NewRequest("GET", "/login", nil)
+	// Test that DELETE to /login returns method not allowed (GET renders the form)
+	req, _ := http.NewRequest("DELETE", "/login", nil)
 	rr := httptest.NewRecorder()
 	r.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusMethodNotAllowed {
-		t.Errorf("GET to /login should return 405, got %d", rr.Code)
+		t.Errorf("DELETE to /login should return 405, got %d", rr.Code)
 	}
 
 	// Test that GET to /logout returns method not allowed
@@ -929,8 +885,8 @@ func TestInitializeAppWithDifferentIPs(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			originalCollection := usersCollection
-			defer func() { usersCollection = originalCollection }()
+			originalCollection := currentUsersCollection()
+			defer func() { setUsersCollection(originalCollection) }()
 
 			// This should not panic regardless of IP
 			initializeApp(tc.ip)
@@ -940,85 +896,41 @@ func TestInitializeAppWithDifferentIPs(t *testing.T) {
 
 // Test full login/logout flow end-to-end
 func TestFullLoginLogoutFlow(t *testing.T) {
-	// Set up clean state
-	usersCollection = nil
-	r := setupRouter()
+	app := newTestApp(t, User{Username: username, Password: password})
 
 	// Step 1: Access index page
-	req := httptest.NewRequest("GET", "/", nil)
-	rr := httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusOK {
+	if rr := app.get("/"); rr.Code != http.StatusOK {
 		t.Errorf("Index page should return 200, got %d", rr.Code)
 	}
 
 	// Step 2: Try to access internal page without login (should redirect)
-	req = httptest.NewRequest("GET", "/internal", nil)
-	rr = httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusFound {
+	if rr := app.get("/internal"); rr.Code != http.StatusFound {
 		t.Errorf("Internal page without login should redirect, got %d", rr.Code)
 	}
 
 	// Step 3: Login with valid credentials
-	form := url.Values{}
-	form.Add("name", username)
-	form.Add("password", password)
-	req = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	// Should redirect to /internal
-	if rr.Code != http.StatusFound {
-		t.Errorf("Valid login should redirect, got %d", rr.Code)
-	}
-
-	// Get the session cookie
-	cookies := rr.Result().Cookies()
-	if len(cookies) == 0 {
-		t.Fatal("Login should set a session cookie")
-	}
+	cookie := app.loginCookie(username, password)
 
 	// Step 4: Access internal page with session cookie
-	req = httptest.NewRequest("GET", "/internal", nil)
-	req.AddCookie(cookies[0])
-	rr = httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusOK {
+	if rr := app.get("/internal", cookie); rr.Code != http.StatusOK {
 		t.Errorf("Internal page with valid session should return 200, got %d", rr.Code)
 	}
 
 	// Step 5: Logout
-	req = httptest.NewRequest("POST", "/logout", nil)
-	req.AddCookie(cookies[0])
-	rr = httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
+	rr := app.postForm("/logout", nil, cookie)
 	if rr.Code != http.StatusFound {
 		t.Errorf("Logout should redirect, got %d", rr.Code)
 	}
 
 	// Step 6: Try to access internal page after logout (should redirect)
-	logoutCookies := rr.Result().Cookies()
-	req = httptest.NewRequest("GET", "/internal", nil)
-	for _, cookie := range logoutCookies {
-		req.AddCookie(cookie)
-	}
-	rr = httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusFound {
+	if rr := app.get("/internal", rr.Result().Cookies()...); rr.Code != http.StatusFound {
 		t.Errorf("Internal page after logout should redirect, got %d", rr.Code)
 	}
 }
 
 // Test concurrent session handling
 func TestConcurrentSessions(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 	r := setupRouter()
 
 	// Create multiple sessions concurrently
@@ -1055,9 +967,9 @@ func TestVerifyCredentialsWithMultipleUsersInDatabase(t *testing.T) {
 	}
 	defer cleanup()
 
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	setUsersCollection(testCollection)
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Insert multiple users
 	ctx := context.Background()
@@ -1072,65 +984,34 @@ func TestVerifyCredentialsWithMultipleUsersInDatabase(t *testing.T) {
 	}
 
 	// Test verification with each user
-	if !verifyCredentials("user1", "pass1") {
+	if !verifyCredentials(context.Background(), "user1", "pass1") {
 		t.Error("Should verify user1 credentials")
 	}
-	if !verifyCredentials("user2", "pass2") {
+	if !verifyCredentials(context.Background(), "user2", "pass2") {
 		t.Error("Should verify user2 credentials")
 	}
-	if !verifyCredentials(username, password) {
+	if !verifyCredentials(context.Background(), username, password) {
 		t.Error("Should verify default credentials")
 	}
 
 	// Test with wrong credentials
-	if verifyCredentials("user1", "pass2") {
+	if verifyCredentials(context.Background(), "user1", "pass2") {
 		t.Error("Should not verify mismatched credentials")
 	}
 }
 
-func TestLoginHandlerWithDatabaseMultipleAttempts(t *testing.T) {
-	testCollection, cleanup := setupTestMongoDB(t)
-	if testCollection == nil {
-		return
-	}
-	defer cleanup()
-
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
-
-	// Create default user
-	createUsers()
-
-	r := setupRouter()
+func TestLoginHandlerWithStoreMultipleAttempts(t *testing.T) {
+	app := newTestApp(t, User{Username: username, Password: password})
 
 	// Try multiple failed login attempts
 	for i := 0; i < 5; i++ {
-		form := url.Values{}
-		form.Add("name", "wronguser")
-		form.Add("password", "wrongpass")
-
-		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-		rr := httptest.NewRecorder()
-		r.ServeHTTP(rr, req)
-
-		if !strings.Contains(rr.Body.String(), "Invalid login") {
+		if rr := app.login("wronguser", "wrongpass"); !strings.Contains(rr.Body.String(), "Invalid login") {
 			t.Errorf("Attempt %d: Should show invalid login message", i+1)
 		}
 	}
 
 	// Then try successful login
-	form := url.Values{}
-	form.Add("name", username)
-	form.Add("password", password)
-
-	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	rr := httptest.NewRecorder()
-	r.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusFound {
+	if rr := app.login(username, password); rr.Code != http.StatusFound {
 		t.Error("Valid login after failed attempts should succeed")
 	}
 }
@@ -1142,12 +1023,12 @@ func TestCreateUsersIdempotency(t *testing.T) {
 	}
 	defer cleanup()
 
-	originalCollection := usersCollection
-	usersCollection = testCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	setUsersCollection(testCollection)
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// First creation should succeed
-	createUsers()
+	createUsers(context.Background())
 
 	ctx := context.Background()
 	count1, err := testCollection.CountDocuments(ctx, map[string]interface{}{})
@@ -1155,17 +1036,54 @@ func TestCreateUsersIdempotency(t *testing.T) {
 		t.Fatalf("Failed to count documents: %v", err)
 	}
 
-	// Second creation will fail with duplicate key, but shouldn't panic
-	createUsers()
+	// Second creation upserts the same document
+	if err := createUsers(context.Background()); err != nil {
+		t.Errorf("re-seeding should succeed, got %v", err)
+	}
 
 	count2, err := testCollection.CountDocuments(ctx, map[string]interface{}{})
 	if err != nil {
 		t.Fatalf("Failed to count documents: %v", err)
 	}
 
-	// Count might be same or increase depending on error handling
-	if count2 < count1 {
-		t.Errorf("Document count decreased: %d -> %d", count1, count2)
+	if count1 != 1 || count2 != 1 {
+		t.Errorf("expected exactly one seed user, got %d then %d", count1, count2)
+	}
+}
+
+func TestCreateUsersUpdatesChangedPassword(t *testing.T) {
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+	originalPassword := password
+	defer func() { password = originalPassword }()
+
+	ctx := context.Background()
+	seedName := normalizeUsername(username)
+	for i := 0; i < 2; i++ {
+		if err := createUsers(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if usernames, _ := store.ListUsernames(ctx); len(usernames) != 1 {
+		t.Fatalf("seeding twice should leave one user, got %v", usernames)
+	}
+	seeded, _ := store.FindUser(ctx, seedName)
+	if seeded.Password == password || !passwordMatches(seeded.Password, password) {
+		t.Error("the seed password should be stored as a hash")
+	}
+
+	// a demoted seed user keeps its role when the password changes
+	store.UpdateRole(ctx, seedName, roleUser)
+	password = "changed-seed-1"
+	if err := createUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	updated, _ := store.FindUser(ctx, seedName)
+	if !passwordMatches(updated.Password, "changed-seed-1") {
+		t.Error("re-seeding should update the password when SEED_PASSWORD changes")
+	}
+	if updated.Role != roleUser {
+		t.Errorf("re-seeding should not reset the role, got %q", updated.Role)
 	}
 }
 
@@ -1184,7 +1102,7 @@ func TestRouterNotFoundPath(t *testing.T) {
 }
 
 func TestLoginHandlerWithVariousFormats(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	testCases := []struct {
 		name        string
@@ -1290,33 +1208,34 @@ func TestConnectDBWithIPv6(t *testing.T) {
 	if collection != nil {
 		// If it connects, clean up
 		collection.Database().Drop(context.Background())
+		disconnectDB(context.Background())
 	}
 }
 
 func TestVerifyCredentialsEmptyStrings(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	// Test with empty strings
-	result := verifyCredentials("", "")
+	result := verifyCredentials(context.Background(), "", "")
 	if result {
 		t.Error("verifyCredentials should return false for empty credentials")
 	}
 
 	// Test with only empty password
-	result = verifyCredentials(username, "")
+	result = verifyCredentials(context.Background(), username, "")
 	if result {
 		t.Error("verifyCredentials should return false for empty password")
 	}
 
 	// Test with only empty username
-	result = verifyCredentials("", password)
+	result = verifyCredentials(context.Background(), "", password)
 	if result {
 		t.Error("verifyCredentials should return false for empty username")
 	}
 }
 
 func TestLoginHandlerWithURLEncodedSpecialChars(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	// Test with URL-encoded special characters
 	form := url.Values{}
@@ -1337,6 +1256,23 @@ func TestLoginHandlerWithURLEncodedSpecialChars(t *testing.T) {
 	}
 }
 
+func TestInternalPageNotCached(t *testing.T) {
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store, no-cache" {
+		t.Errorf("expected Cache-Control no-store, no-cache, got %q", cacheControl)
+	}
+	if pragma := rr.Header().Get("Pragma"); pragma != "no-cache" {
+		t.Errorf("expected Pragma no-cache, got %q", pragma)
+	}
+}
+
 func TestInternalPageResponseContent(t *testing.T) {
 	// Create a session
 	rr := httptest.NewRecorder()
@@ -1353,7 +1289,7 @@ func TestInternalPageResponseContent(t *testing.T) {
 	req.AddCookie(cookies[0])
 
 	rr2 := httptest.NewRecorder()
-	handler := http.HandlerFunc(internalPageHandler)
+	handler := requireAuth(internalPageHandler)
 	handler.ServeHTTP(rr2, req)
 
 	body := rr2.Body.String()
@@ -1401,7 +1337,7 @@ func TestIndexPageResponseContent(t *testing.T) {
 }
 
 func TestSessionPersistenceAcrossRequests(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 	r := setupRouter()
 
 	// Login
@@ -1487,7 +1423,7 @@ func TestGetUserNameWithDifferentCookieNames(t *testing.T) {
 }
 
 func TestLoginHandlerRedirectBehavior(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	testCases := []struct {
 		name           string
@@ -1555,8 +1491,8 @@ func TestLogoutHandlerClearsCookieProperly(t *testing.T) {
 }
 
 func TestInitializeAppCleanup(t *testing.T) {
-	originalCollection := usersCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Test initialization and cleanup multiple times
 	ips := []string{"localhost", "127.0.0.1"}
@@ -1564,16 +1500,17 @@ func TestInitializeAppCleanup(t *testing.T) {
 	for _, ip := range ips {
 		initializeApp(ip)
 
-		if usersCollection != nil {
+		if currentUsersCollection() != nil {
 			// Clean up
-			usersCollection.Database().Drop(context.Background())
-			usersCollection = nil
+			currentUsersCollection().Database().Drop(context.Background())
+			setUsersCollection(nil)
+			disconnectDB(context.Background())
 		}
 	}
 }
 
 func TestVerifyCredentialsWithSpecialCharacters(t *testing.T) {
-	usersCollection = nil
+	setUsersCollection(nil)
 
 	specialCases := []struct {
 		username string
@@ -1586,7 +1523,7 @@ func TestVerifyCredentialsWithSpecialCharacters(t *testing.T) {
 	}
 
 	for _, tc := range specialCases {
-		result := verifyCredentials(tc.username, tc.password)
+		result := verifyCredentials(context.Background(), tc.username, tc.password)
 		if result {
 			t.Errorf("verifyCredentials should reject special chars: %s/%s", tc.username, tc.password)
 		}
@@ -1599,14 +1536,16 @@ func TestRunApp(t *testing.T) {
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
 
-	originalCollection := usersCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Set up test environment
 	os.Args = []string{"main", "localhost"}
 
 	// This should not panic
-	runApp()
+	if err := runApp(); err != nil {
+		t.Fatalf("runApp: %v", err)
+	}
 
 	// Verify that router is set up
 	if router == nil {
@@ -1619,14 +1558,16 @@ func TestRunAppWithoutDatabase(t *testing.T) {
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
 
-	originalCollection := usersCollection
-	defer func() { usersCollection = originalCollection }()
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
 
 	// Set up test environment with invalid IP
 	os.Args = []string{"main", "invalid-host-that-does-not-exist"}
 
 	// This should not panic - should fall back to hardcoded credentials
-	runApp()
+	if err := runApp(); err != nil {
+		t.Fatalf("runApp: %v", err)
+	}
 }
 
 // Test MongoDB authentication credentials
@@ -1688,6 +1629,7 @@ func TestConnectDBWithAuthentication(t *testing.T) {
 	if collection != nil {
 		// If it somehow connects, clean up
 		collection.Database().Drop(context.Background())
+		disconnectDB(context.Background())
 	}
 }
 
@@ -1717,11 +1659,11 @@ func TestInitializeAppWithCredentials(t *testing.T) {
 	// Save original state
 	oldUsername := os.Getenv("MONGODB_USERNAME")
 	oldPassword := os.Getenv("MONGODB_PASSWORD")
-	originalCollection := usersCollection
+	originalCollection := currentUsersCollection()
 	defer func() {
 		os.Setenv("MONGODB_USERNAME", oldUsername)
 		os.Setenv("MONGODB_PASSWORD", oldPassword)
-		usersCollection = originalCollection
+		setUsersCollection(originalCollection)
 	}()
 
 	// Set test credentials
@@ -1781,3 +1723,807 @@ func TestMongoDBURIConstruction(t *testing.T) {
 		})
 	}
 }
+
+// Test connection retry with exponential backoff
+func TestConnectWithRetryEventuallyConnects(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	fakeCollection := client.Database("test_login_app").Collection("test_users")
+
+	originalConnect, originalSleep := connectFunc, sleepFunc
+	originalAttempts, originalDelay := mongoConnectAttempts, mongoConnectBaseDelay
+	defer func() {
+		connectFunc, sleepFunc = originalConnect, originalSleep
+		mongoConnectAttempts, mongoConnectBaseDelay = originalAttempts, originalDelay
+	}()
+
+	// The mock dialer fails the first two attempts, then succeeds
+	calls := 0
+	connectFunc = func(mongodb_ip string) *mongo.Collection {
+		calls++
+		if calls < 3 {
+			return nil
+		}
+		return fakeCollection
+	}
+	var delays []time.Duration
+	sleepFunc = func(d time.Duration) { delays = append(delays, d) }
+	mongoConnectAttempts = 5
+	mongoConnectBaseDelay = 100 * time.Millisecond
+
+	collection := connectWithRetry("localhost")
+	if collection != fakeCollection {
+		t.Fatal("connectWithRetry should return the collection once an attempt succeeds")
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 connection attempts, got %d", calls)
+	}
+	if len(delays) != 2 || delays[0] != 100*time.Millisecond || delays[1] != 200*time.Millisecond {
+		t.Errorf("expected exponential backoff delays [100ms 200ms], got %v", delays)
+	}
+}
+
+func TestConnectWithRetryGivesUp(t *testing.T) {
+	originalConnect, originalSleep := connectFunc, sleepFunc
+	originalAttempts := mongoConnectAttempts
+	defer func() {
+		connectFunc, sleepFunc = originalConnect, originalSleep
+		mongoConnectAttempts = originalAttempts
+	}()
+
+	calls := 0
+	connectFunc = func(mongodb_ip string) *mongo.Collection {
+		calls++
+		return nil
+	}
+	sleepFunc = func(time.Duration) {}
+	mongoConnectAttempts = 3
+
+	if collection := connectWithRetry("localhost"); collection != nil {
+		t.Error("connectWithRetry should return nil when every attempt fails")
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 connection attempts, got %d", calls)
+	}
+}
+
+// Test session expiry display on the internal page
+func TestInternalPageShowsSessionExpiry(t *testing.T) {
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	cookies := rr.Result().Cookies()
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookies[0])
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	requireAuth(internalPageHandler)(rr, req)
+
+	var info internalPageInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("JSON variant should decode: %v", err)
+	}
+	expected := time.Now().Add(sessionTTL)
+	if info.ExpiresAt.Before(expected.Add(-time.Minute)) || info.ExpiresAt.After(expected.Add(time.Minute)) {
+		t.Errorf("expiry %v should be about %v for a fresh session", info.ExpiresAt, expected)
+	}
+
+	req = httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	requireAuth(internalPageHandler)(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "Session expires: "+info.ExpiresAt.Format(time.RFC1123)) {
+		t.Errorf("internal page should render the session expiry, got %s", rr.Body.String())
+	}
+}
+
+func TestGetUserNameRejectsExpiredSession(t *testing.T) {
+	originalTTL := sessionTTL
+	defer func() { sessionTTL = originalTTL }()
+
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	cookies := rr.Result().Cookies()
+
+	sessionTTL = -time.Second
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if userName := getUserName(req); userName != "" {
+		t.Errorf("expired session should not yield a username, got %s", userName)
+	}
+}
+
+func TestCustomSessionCookieName(t *testing.T) {
+	original := sessionCookieName
+	sessionCookieName = "app2_session"
+	defer func() { sessionCookieName = original }()
+
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "app2_session" {
+		t.Fatalf("expected a single app2_session cookie, got %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if userName := getUserName(req); userName != "testuser" {
+		t.Errorf("custom cookie name should round-trip, got %q", userName)
+	}
+
+	// the same value under the old name belongs to another instance
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: cookies[0].Value})
+	if userName := getUserName(req); userName != "" {
+		t.Errorf("cookie under the old name should be ignored, got %q", userName)
+	}
+}
+
+func TestSessionGracePeriod(t *testing.T) {
+	originalTTL, originalGrace := sessionTTL, sessionGracePeriod
+	defer func() { sessionTTL, sessionGracePeriod = originalTTL, originalGrace }()
+	sessionGracePeriod = time.Hour
+
+	cookie := sessionCookieFor(t, "testuser", roleAdmin)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	// expired a minute ago: still inside the grace window
+	sessionTTL = -time.Minute
+	rr := get("/internal")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "please log in again") {
+		t.Errorf("expected the read-only internal page within the grace period, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "/change-password") {
+		t.Error("read-only internal page should not offer a password change")
+	}
+	if rr := get("/users"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("admin routes should reject sessions in the grace period, got %d", rr.Code)
+	}
+
+	// expired two hours ago: past the grace window
+	sessionTTL = -2 * time.Hour
+	if rr := get("/internal"); rr.Code != http.StatusFound {
+		t.Errorf("expected redirect after the grace period, got %d", rr.Code)
+	}
+}
+
+// Test default user seeding toggle
+func TestCreateUsersSeedingEnabled(t *testing.T) {
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+	originalSeed := seedDefaultUser
+	seedDefaultUser = true
+	defer func() { seedDefaultUser = originalSeed }()
+
+	createUsers(context.Background())
+
+	seeded, err := store.FindUser(context.Background(), normalizeUsername(username))
+	if err != nil {
+		t.Fatalf("seed user should exist when seeding is enabled: %v", err)
+	}
+	if seeded.Role != roleAdmin {
+		t.Errorf("seed user should be an admin, got role %q", seeded.Role)
+	}
+}
+
+func TestCreateUsersSeedingDisabled(t *testing.T) {
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+	originalSeed := seedDefaultUser
+	seedDefaultUser = false
+	defer func() { seedDefaultUser = originalSeed }()
+
+	createUsers(context.Background())
+
+	if usernames, _ := store.ListUsernames(context.Background()); len(usernames) != 0 {
+		t.Errorf("createUsers should be a no-op when seeding is disabled, got %v", usernames)
+	}
+}
+
+func TestLoadConfigSeedSettings(t *testing.T) {
+	originalSeed, originalEnv := seedDefaultUser, appEnv
+	originalUsername, originalPassword := username, password
+	defer func() {
+		seedDefaultUser, appEnv = originalSeed, originalEnv
+		username, password = originalUsername, originalPassword
+	}()
+
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("SEED_USERNAME", "seeduser")
+	t.Setenv("SEED_PASSWORD", "seedpass1")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if seedDefaultUser {
+		t.Error("seeding should default to off in production")
+	}
+	if username != "seeduser" || password != "seedpass1" {
+		t.Errorf("seed credentials should come from the environment, got %s/%s", username, password)
+	}
+
+	t.Setenv("SEED_DEFAULT_USER", "true")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !seedDefaultUser {
+		t.Error("SEED_DEFAULT_USER=true should enable seeding in production")
+	}
+}
+
+func TestLoadConfigRefusesBuiltInSeedCredentialsOutsideDevelopment(t *testing.T) {
+	originalSeed, originalEnv := seedDefaultUser, appEnv
+	originalUsername, originalPassword := username, password
+	defer func() {
+		seedDefaultUser, appEnv = originalSeed, originalEnv
+		username, password = originalUsername, originalPassword
+	}()
+
+	t.Setenv("APP_ENV", "staging")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if seedDefaultUser {
+		t.Error("seeding should default to off outside development")
+	}
+
+	t.Setenv("SEED_DEFAULT_USER", "true")
+	if err := loadConfig(); err == nil {
+		t.Error("seeding the built-in credentials outside development should be refused")
+	}
+	t.Setenv("SEED_USERNAME", "seeduser")
+	t.Setenv("SEED_PASSWORD", "seedpass1")
+	if err := loadConfig(); err != nil || !seedDefaultUser {
+		t.Errorf("seeding explicit credentials should be allowed, got %v", err)
+	}
+
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("SEED_DEFAULT_USER", "")
+	if err := loadConfig(); err != nil || !seedDefaultUser {
+		t.Errorf("development should seed by default, got %v", err)
+	}
+}
+
+// Test command line flag parsing
+func TestParseFlags(t *testing.T) {
+	originalPort, originalDB := http_port, database_name
+	defer func() { http_port, database_name = originalPort, originalDB }()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	host, err := parseFlags(fs, []string{"-mongo-host", "db.internal", "-http-port", "9090", "-db-name", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "db.internal" || http_port != 9090 || database_name != "other" {
+		t.Errorf("flags not applied: host=%s port=%d db=%s", host, http_port, database_name)
+	}
+}
+
+func TestParseFlagsEnvFallbackAndPositional(t *testing.T) {
+	originalPort, originalDB := http_port, database_name
+	defer func() { http_port, database_name = originalPort, originalDB }()
+	t.Setenv("MONGODB_IP", "env-host")
+	t.Setenv("HTTP_PORT", "8081")
+
+	host, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "env-host" || http_port != 8081 {
+		t.Errorf("env should be the fallback, got host=%s port=%d", host, http_port)
+	}
+
+	// the legacy positional host still wins over the env
+	host, _ = parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"10.0.0.1"})
+	if host != "10.0.0.1" {
+		t.Errorf("positional host should still work, got %s", host)
+	}
+
+	if _, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-http-port", "nope"}); err == nil {
+		t.Error("an invalid port should be a parse error")
+	}
+}
+
+// Test the configurable bind address
+func TestListenOnLoopback(t *testing.T) {
+	original := bindAddr
+	bindAddr = "127.0.0.1"
+	defer func() { bindAddr = original }()
+
+	listener, err := listen(0)
+	if err != nil {
+		t.Fatalf("binding to loopback should succeed: %v", err)
+	}
+	defer listener.Close()
+	if host, _, _ := net.SplitHostPort(listener.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("expected to listen on 127.0.0.1, got %s", listener.Addr())
+	}
+}
+
+func TestListenRejectsBogusAddress(t *testing.T) {
+	original := bindAddr
+	defer func() { bindAddr = original }()
+
+	for _, addr := range []string{"999.1.1.1", "not an address", "127.0.0.1:80"} {
+		bindAddr = addr
+		if listener, err := listen(0); err == nil {
+			listener.Close()
+			t.Errorf("bind address %q should be rejected", addr)
+		}
+	}
+}
+
+// fakeClock is a manually advanced time source
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// useFakeClock swaps the package clock for one that only moves when advanced
+func useFakeClock(t *testing.T) *fakeClock {
+	fake := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	original := clock
+	clock = fake.Now
+	t.Cleanup(func() { clock = original })
+	return fake
+}
+
+func TestSessionExpiresWithClock(t *testing.T) {
+	fake := useFakeClock(t)
+	cookie := sessionCookieFor(t, "testuser", roleUser)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+
+	fake.Advance(sessionTTL - time.Minute)
+	if userName := getUserName(req); userName != "testuser" {
+		t.Errorf("session should still be valid just before the TTL, got %q", userName)
+	}
+
+	fake.Advance(2 * time.Minute)
+	if userName := getUserName(req); userName != "" {
+		t.Errorf("session should expire once the clock passes the TTL, got %q", userName)
+	}
+}
+
+func TestLockoutEndsWithClock(t *testing.T) {
+	fake := useFakeClock(t)
+	throttle := newLoginThrottle()
+	for i := 0; i < maxFailedLogins; i++ {
+		throttle.recordFailure("bob")
+	}
+	if _, locked := throttle.lockedFor("bob"); !locked {
+		t.Fatal("bob should be locked")
+	}
+
+	fake.Advance(lockoutDuration + time.Second)
+	if _, locked := throttle.lockedFor("bob"); locked {
+		t.Error("lockout should end once the clock passes the lockout duration")
+	}
+}
+
+// Test MongoDB credentials read from secret files
+func TestGetMongoDBCredentialsFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	userFile := dir + "/username"
+	passFile := dir + "/password"
+	if err := os.WriteFile(userFile, []byte("fileuser\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(passFile, []byte("  filepass  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MONGODB_USERNAME", "envuser")
+	t.Setenv("MONGODB_PASSWORD", "envpass")
+	if user, pass := getMongoDBCredentials(); user != "envuser" || pass != "envpass" {
+		t.Errorf("plain vars should be used without files, got %s/%s", user, pass)
+	}
+
+	t.Setenv("MONGODB_USERNAME_FILE", userFile)
+	t.Setenv("MONGODB_PASSWORD_FILE", passFile)
+	if user, pass := getMongoDBCredentials(); user != "fileuser" || pass != "filepass" {
+		t.Errorf("trimmed file contents should take precedence, got %q/%q", user, pass)
+	}
+
+	t.Setenv("MONGODB_PASSWORD_FILE", dir+"/missing")
+	if user, pass := getMongoDBCredentials(); user != "fileuser" || pass != "envpass" {
+		t.Errorf("a missing file should fall back to the plain var, got %q/%q", user, pass)
+	}
+}
+
+// Test the GET /login form page
+func TestLoginPageShowsError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/login?error=invalid", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), loginErrors["invalid"]) {
+		t.Errorf("error message should render, got %s", rr.Body.String())
+	}
+}
+
+func TestLoginPageWithoutError(t *testing.T) {
+	for _, path := range []string{"/login", "/login?error=<script>"} {
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+
+		if strings.Contains(rr.Body.String(), `class="error"`) {
+			t.Errorf("%s should not render an error, got %s", path, rr.Body.String())
+		}
+	}
+}
+
+func TestLoginPagePreservesNext(t *testing.T) {
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/login?next=/internal", nil))
+	if !strings.Contains(rr.Body.String(), `action="/login?next=%2Finternal"`) {
+		t.Errorf("form action should carry next, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/login?next=//evil.example", nil))
+	if !strings.Contains(rr.Body.String(), `action="/login"`) {
+		t.Errorf("an off-site next should be dropped, got %s", rr.Body.String())
+	}
+}
+
+func TestLoginRedirectsToNext(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	form := url.Values{"name": {"bob"}, "password": {"secret"}}
+	req := httptest.NewRequest("POST", "/login?next=/users", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/users" {
+		t.Errorf("successful login should return to next, got %q", location)
+	}
+}
+
+// useSessionCookieScope sets the session cookie Domain and Path for the duration of the test
+func useSessionCookieScope(t *testing.T, domain string, path string) {
+	originalDomain, originalPath := sessionCookieDomain, sessionCookiePath
+	sessionCookieDomain, sessionCookiePath = domain, path
+	t.Cleanup(func() { sessionCookieDomain, sessionCookiePath = originalDomain, originalPath })
+}
+
+func TestSessionCookieDomainAndPath(t *testing.T) {
+	useSessionCookieScope(t, "example.com", "/app")
+
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	header := rr.Header().Get("Set-Cookie")
+	if !strings.Contains(header, "Domain=example.com") || !strings.Contains(header, "Path=/app") {
+		t.Errorf("Set-Cookie should carry the configured Domain and Path, got %q", header)
+	}
+
+	rr = httptest.NewRecorder()
+	clearSession(rr)
+	cleared := rr.Result().Cookies()[0]
+	if cleared.Domain != "example.com" || cleared.Path != "/app" || cleared.MaxAge != -1 {
+		t.Errorf("clearSession must use the same Domain and Path, got %+v", cleared)
+	}
+}
+
+func TestLoadConfigSessionCookieScope(t *testing.T) {
+	useSessionCookieScope(t, "", "/")
+
+	t.Setenv("SESSION_COOKIE_DOMAIN", ".example.com")
+	t.Setenv("SESSION_COOKIE_PATH", "/app")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if sessionCookieDomain != ".example.com" || sessionCookiePath != "/app" {
+		t.Errorf("got domain %q path %q, want .example.com and /app", sessionCookieDomain, sessionCookiePath)
+	}
+
+	useSessionCookieScope(t, "", "/")
+	t.Setenv("SESSION_COOKIE_DOMAIN", "exa mple.com")
+	t.Setenv("SESSION_COOKIE_PATH", "app;secure")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if sessionCookieDomain != "" || sessionCookiePath != "/" {
+		t.Errorf("invalid values should be ignored, got domain %q path %q", sessionCookieDomain, sessionCookiePath)
+	}
+}
+
+func TestValidCookieDomain(t *testing.T) {
+	for domain, want := range map[string]bool{
+		"example.com":      true,
+		".example.com":     true,
+		"auth.example.com": true,
+		"localhost":        true,
+		"":                 false,
+		".":                false,
+		"example..com":     false,
+		"-example.com":     false,
+		"example.com/path": false,
+		"exa mple.com":     false,
+	} {
+		if got := validCookieDomain(domain); got != want {
+			t.Errorf("validCookieDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestLoginHandlerIgnoresUsernameCase(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	form := url.Values{"name": {"BoB"}, "password": {"secret"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/internal" {
+		t.Fatalf("login with different casing should succeed, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	check := httptest.NewRequest("GET", "/internal", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		check.AddCookie(cookie)
+	}
+	if got := getUserName(check); got != "bob" {
+		t.Errorf("the session should carry the normalized username, got %q", got)
+	}
+}
+
+func TestLoginCustomFieldNames(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	originalUser, originalPass := loginUsernameField, loginPasswordField
+	t.Cleanup(func() { loginUsernameField, loginPasswordField = originalUser, originalPass })
+	loginUsernameField, loginPasswordField = "login_user", "login_pass"
+
+	rr := httptest.NewRecorder()
+	indexPageHandler(rr, httptest.NewRequest("GET", "/", nil))
+	for _, want := range []string{`name="login_user"`, `name="login_pass"`} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("the login form should use the configured field names, missing %s", want)
+		}
+	}
+
+	login := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		loginHandler(rr, req)
+		return rr
+	}
+	if rr := login(url.Values{"login_user": {"bob"}, "login_pass": {"secret"}}); rr.Header().Get("Location") != "/internal" {
+		t.Errorf("credentials in the configured fields should log in, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := login(url.Values{"name": {"bob"}, "password": {"secret"}}); rr.Header().Get("Location") == "/internal" {
+		t.Error("the default field names should no longer be read")
+	}
+}
+
+func TestLoginRespondsByContentType(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("application/x-www-form-urlencoded", "name=bob&password=secret")
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/internal" {
+		t.Errorf("a form login should redirect, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = post("application/json", `{"name":"bob","password":"secret","next":"/users"}`)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("a JSON login should answer 200 with JSON, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	var body loginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Username != "bob" || body.Redirect != "/users" {
+		t.Errorf("unexpected JSON login response %+v", body)
+	}
+	if len(rr.Result().Cookies()) == 0 {
+		t.Error("a JSON login should still set the session cookie")
+	}
+
+	rr = post("application/json", `{"name":"bob","password":"wrong"}`)
+	if rr.Code != http.StatusUnauthorized || decodeAPIError(t, rr).Code != errCodeInvalidCredentials {
+		t.Errorf("a failed JSON login should answer 401 invalid_credentials, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("application/json", `{"name":`); rr.Code != http.StatusBadRequest {
+		t.Errorf("malformed JSON should answer 400, got %d", rr.Code)
+	}
+}
+
+func TestSessionCookieMaxAgeMatchesTTL(t *testing.T) {
+	originalTTL, originalGrace := sessionTTL, sessionGracePeriod
+	defer func() { sessionTTL, sessionGracePeriod = originalTTL, originalGrace }()
+	sessionTTL, sessionGracePeriod = 90*time.Minute, 0
+
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	if cookie := rr.Result().Cookies()[0]; cookie.MaxAge != 5400 {
+		t.Errorf("expected the cookie to live for the session TTL of 5400s, got MaxAge %d", cookie.MaxAge)
+	}
+
+	// expired sessions stay readable during the grace period, so the cookie has to as well
+	sessionGracePeriod = 10 * time.Minute
+	rr = httptest.NewRecorder()
+	setSession("testuser", rr)
+	if cookie := rr.Result().Cookies()[0]; cookie.MaxAge != 6000 {
+		t.Errorf("expected the cookie to outlive the TTL by the grace period, got MaxAge %d", cookie.MaxAge)
+	}
+}
+
+func TestNewServerTimeoutsFromConfig(t *testing.T) {
+	originalHeader, originalRead, originalWrite, originalIdle := httpReadHeaderTimeout, httpReadTimeout, httpWriteTimeout, httpIdleTimeout
+	defer func() {
+		httpReadHeaderTimeout, httpReadTimeout, httpWriteTimeout, httpIdleTimeout = originalHeader, originalRead, originalWrite, originalIdle
+	}()
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("HTTP_READ_TIMEOUT", "10s")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "20s")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "1m")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	server := newServer(http.NotFoundHandler())
+	if server.ReadHeaderTimeout != 2*time.Second || server.ReadTimeout != 10*time.Second ||
+		server.WriteTimeout != 20*time.Second || server.IdleTimeout != time.Minute {
+		t.Errorf("unexpected timeouts: header %v, read %v, write %v, idle %v",
+			server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+}
+
+func TestLoginRejectsUsernameLength(t *testing.T) {
+	// a lookup would fail, so a 400 shows the name was rejected before reaching the store
+	app := newTestApp(t)
+	useMemoryUserStore(t, unavailableUserStore{})
+
+	for _, name := range []string{"ab", strings.Repeat("a", 65)} {
+		rr := app.login(name, "secret")
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "3 to 64 characters") {
+			t.Errorf("%d characters: expected 400 naming the bounds, got %d: %s", len(name), rr.Code, rr.Body.String())
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Errorf("%d characters: no session should be set", len(name))
+		}
+	}
+	if rr := app.login("bob", "secret"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("a valid name should reach the store, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/token", strings.NewReader(url.Values{"name": {"ab"}, "password": {"secret"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rr := app.do(req); rr.Code != http.StatusBadRequest || decodeAPIError(t, rr).Code != errCodeInvalidRequest {
+		t.Errorf("expected the token endpoint to reject a short name with 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateUserRejectsUsernameLength(t *testing.T) {
+	app := newTestApp(t, User{Username: username, Password: password, Role: roleAdmin})
+	cookie := app.loginCookie(username, password)
+
+	for name, want := range map[string]int{"ab": http.StatusBadRequest, strings.Repeat("a", 65): http.StatusBadRequest, "abc": http.StatusCreated} {
+		req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"username":"`+name+`","password":"s3cret-pass"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if rr := app.do(req, cookie); rr.Code != want {
+			t.Errorf("%d characters: expected %d, got %d: %s", len(name), want, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestShutdownServerClosesHungRequests(t *testing.T) {
+	logs := captureLogs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server := newServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+	}))
+	go server.Serve(listener)
+
+	requestDone := make(chan error, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err == nil {
+			response.Body.Close()
+		}
+		requestDone <- err
+	}()
+	<-started
+
+	begin := time.Now()
+	shutdownServer(server, 50*time.Millisecond)
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("expected shutdown to give up after the timeout, took %v", elapsed)
+	}
+	select {
+	case err := <-requestDone:
+		if err == nil {
+			t.Error("expected the hung request's connection to be closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the hung request's connection was left open")
+	}
+	if !strings.Contains(logs.String(), "closing their connections") {
+		t.Errorf("expected a warning about the forced close, got %s", logs.String())
+	}
+}
+
+func TestShutdownTimeoutFromConfig(t *testing.T) {
+	original := shutdownTimeout
+	defer func() { shutdownTimeout = original }()
+	t.Setenv("SHUTDOWN_TIMEOUT", "3s")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if shutdownTimeout != 3*time.Second {
+		t.Errorf("expected a 3s shutdown timeout, got %v", shutdownTimeout)
+	}
+}
+
+func TestLoginContentTypes(t *testing.T) {
+	original := loginContentTypes
+	t.Cleanup(func() { loginContentTypes = original })
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return app.do(req)
+	}
+
+	if rr := app.login("bob", "secret"); rr.Code != http.StatusFound {
+		t.Errorf("a urlencoded form should log in, got %d", rr.Code)
+	}
+	var multipartBody strings.Builder
+	writer := multipart.NewWriter(&multipartBody)
+	writer.WriteField("name", "bob")
+	writer.WriteField("password", "secret")
+	writer.Close()
+	if rr := post(writer.FormDataContentType(), multipartBody.String()); rr.Code != http.StatusFound {
+		t.Errorf("a multipart form should log in, got %d", rr.Code)
+	}
+	for _, contentType := range []string{"text/plain", ""} {
+		if rr := post(contentType, "name=bob&password=secret"); rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: expected 415, got %d", contentType, rr.Code)
+		}
+	}
+
+	t.Setenv("LOGIN_CONTENT_TYPES", "application/x-www-form-urlencoded")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	rr := post("application/json", `{"name":"bob","password":"secret"}`)
+	if rr.Code != http.StatusUnsupportedMediaType || decodeAPIError(t, rr).Code != errCodeUnsupportedMediaType {
+		t.Errorf("expected JSON to get a 415 once it isn't configured, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// counterVec is a Prometheus counter with labels. Label values must come from a small
+// fixed set (never usernames or IPs) so the number of series stays bounded.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, counts: make(map[string]uint64)}
+}
+
+// inc adds one to the series with the given label values, in the order of c.labels
+func (c *counterVec) inc(values ...string) {
+	pairs := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts["{"+strings.Join(pairs, ",")+"}"]++
+}
+
+// write renders the counter in the Prometheus text format, series sorted for stable output
+func (c *counterVec) write(w *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	series := make([]string, 0, len(c.counts))
+	for labels := range c.counts {
+		series = append(series, labels)
+	}
+	sort.Strings(series)
+	for _, labels := range series {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labels, c.counts[labels])
+	}
+}
+
+// login results recorded by loginAttemptsTotal
+const (
+	loginResultSuccess            = "success"
+	loginResultInvalidCredentials = "invalid_credentials"
+	loginResultLocked             = "locked"
+	loginResultDisabled           = "disabled"
+	loginResultError              = "error"
+)
+
+// loginAttemptsTotal counts logins by result and by whether a database was connected, so
+// dashboards can tell fallback-mode logins apart
+var loginAttemptsTotal = newCounterVec("login_attempts_total", "Login attempts by result and storage mode.", "result", "has_db")
+
+// recordLoginAttempt counts a login attempt with one of the loginResult values
+func recordLoginAttempt(result string) {
+	loginAttemptsTotal.inc(result, strconv.FormatBool(storageMode() == modeDatabase))
+}
+
+// metricsHandler serves the counters in the Prometheus text format
+func metricsHandler(response http.ResponseWriter, request *http.Request) {
+	var body strings.Builder
+	loginAttemptsTotal.write(&body)
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	response.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(response, body.String())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric returns the value of a series on /metrics, 0 when it is absent
+func scrapeMetric(t *testing.T, series string) int {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatalf("invalid value for %s: %q", series, value)
+			}
+			return count
+		}
+	}
+	return 0
+}
+
+func loginSeries(result string, hasDB bool) string {
+	return `login_attempts_total{result="` + result + `",has_db="` + strconv.FormatBool(hasDB) + `"}`
+}
+
+func TestLoginAttemptMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		result string
+		login  func()
+	}{
+		{loginResultSuccess, func() { postLogin("bob", "secret") }},
+		{loginResultInvalidCredentials, func() { postLogin("bob", "wrong") }},
+		{loginResultLocked, func() {
+			for i := 0; i < maxFailedLogins; i++ {
+				postLogin("bob", "wrong")
+			}
+			postLogin("bob", "secret")
+		}},
+		{loginResultError, func() {
+			useMemoryUserStore(t, unavailableUserStore{})
+			postLogin("bob", "secret")
+		}},
+	} {
+		freshLoginThrottle(t)
+		useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+		series := loginSeries(tc.result, true)
+		before := scrapeMetric(t, series)
+		tc.login()
+		if after := scrapeMetric(t, series); after != before+1 {
+			t.Errorf("%s: expected %s to go from %d to %d, got %d", tc.result, series, before, before+1, after)
+		}
+	}
+}
+
+func TestLoginAttemptMetricsInFallbackMode(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, nil)
+	originalCollection := currentUsersCollection()
+	setUsersCollection(nil)
+	defer func() { setUsersCollection(originalCollection) }()
+
+	series := loginSeries(loginResultSuccess, false)
+	before := scrapeMetric(t, series)
+	postLogin(username, password)
+	if after := scrapeMetric(t, series); after != before+1 {
+		t.Errorf("a fallback login should count under has_db=\"false\", got %d -> %d", before, after)
+	}
+}
+
+func TestMetricsHaveNoUserLabels(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore())
+	postLogin("some-unique-user", "wrong")
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rr.Body.String(), "some-unique-user") {
+		t.Error("usernames must not appear in metric labels")
+	}
+	if !strings.Contains(rr.Body.String(), "# TYPE login_attempts_total counter") {
+		t.Errorf("expected the Prometheus type line, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// clearInvalidSessions controls whether session cookies that can no longer be decoded
+// (e.g. after the cookie keys changed) are cleared and the user sent back to login
+var clearInvalidSessions = true
+
+// hasInvalidSession reports whether the request carries a session cookie that fails to decode
+func hasInvalidSession(request *http.Request) bool {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	if authMode == authModeJWT {
+		_, err := parseToken(cookie.Value)
+		return err != nil
+	}
+	return sessionStore.Load(cookie.Value) == nil
+}
+
+// sessionMiddleware clears undecodable session cookies so users get a clean state
+// instead of a broken session. Login submissions pass through untouched since a
+// successful login overwrites the cookie anyway, and API and /auth/validate requests are
+// not redirected so they can answer with a status code instead.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if clearInvalidSessions && request.URL.Path != "/login" && hasInvalidSession(request) {
+			clearSession(response)
+			if request.URL.Path != "/" && request.URL.Path != "/auth/validate" && !strings.HasPrefix(request.URL.Path, "/api/") {
+				http.Redirect(response, request, "/", http.StatusFound)
+				return
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// per-route request body limits: a login form is tiny, a bulk import is large
+var loginBodyLimit int64 = 16 << 10
+var importBodyLimit int64 = 5 << 20
+
+// maxBodyBytes caps request bodies on the routes that have no limit of their own
+var maxBodyBytes int64 = 1 << 20
+
+// bodyLimit caps the request body at limit bytes. Requests that declare a larger
+// Content-Length get 413 straight away; handlers detect streamed overruns with isBodyTooLarge.
+// It also checks CSRF tokens sent in forms (see csrfMiddleware).
+func bodyLimit(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if request.ContentLength > limit {
+			httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+			return
+		}
+		request.Body = http.MaxBytesReader(response, request.Body, limit)
+		if csrfFormCheckPending(request) {
+			// ParseMultipartForm drops the error of parsing an urlencoded form
+			if err := request.ParseForm(); isBodyTooLarge(err) {
+				httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+				return
+			}
+			if err := request.ParseMultipartForm(limit); isBodyTooLarge(err) {
+				httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+				return
+			}
+			if !validCSRFToken(request) {
+				httpError(response, request, http.StatusForbidden, errCodeForbidden, "missing or invalid CSRF token")
+				return
+			}
+		}
+		next(response, request)
+	}
+}
+
+// isBodyTooLarge reports whether err came from reading past a bodyLimit
+func isBodyTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// recoverPanics turns a panicking handler into a plain 500, logging the panic with its
+// stack trace instead of leaving the details to the client. http.ErrAbortHandler is
+// passed on since it is the way handlers deliberately abort a response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			requestLogger(request.Context()).Error("handler panicked", "panic", recovered,
+				"method", request.Method, "path", request.URL.Path, "stack", string(debug.Stack()))
+			httpError(response, request, http.StatusInternalServerError, errCodeInternal, "internal server error")
+		}()
+		next.ServeHTTP(response, request)
+	})
+}
+
+// headResponseWriter answers a HEAD request with the headers of the GET response: it
+// drops the body, counting it for Content-Length and sniffing its Content-Type like
+// net/http would, and holds the status until the end
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (w *headResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headResponseWriter) Write(body []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.length == 0 && len(body) > 0 && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(body))
+	}
+	w.length += len(body)
+	return len(body), nil
+}
+
+// headRequests lets GET handlers serve HEAD requests: the client gets the status and
+// headers, including the Content-Length, that the same GET would have produced, but no body
+func headRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodHead {
+			next.ServeHTTP(response, request)
+			return
+		}
+		writer := &headResponseWriter{ResponseWriter: response}
+		next.ServeHTTP(writer, request)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		// handlers that know HEAD themselves (http.ServeContent) set it and write nothing
+		if response.Header().Get("Content-Length") == "" && writer.status != http.StatusNoContent && writer.status != http.StatusNotModified {
+			response.Header().Set("Content-Length", strconv.Itoa(writer.length))
+		}
+		response.WriteHeader(writer.status)
+	})
+}
+
+// contentSecurityPolicy is sent on every response; the pages are plain HTML forms
+// without scripts, so everything but same-origin forms and /static/ stylesheets is locked down
+var contentSecurityPolicy = "default-src 'none'; style-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// securityHeaders sets the common security headers on all responses
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		// the login form must not be framed (clickjacking)
+		header.Set("X-Frame-Options", "DENY")
+		if contentSecurityPolicy != "" {
+			header.Set("Content-Security-Policy", contentSecurityPolicy)
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// methodOverrideEnabled lets POST requests carry their real method in the
+// X-HTTP-Method-Override header or a _method form field, for HTML forms that
+// can only send GET and POST
+var methodOverrideEnabled = false
+
+// overridableMethods is the safe set of methods a POST may be rewritten to
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// methodOverride rewrites the method of overridden POST requests to the /api/ admin
+// endpoints; it has to wrap the router since routing matches on the method
+func methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if methodOverrideEnabled && request.Method == http.MethodPost && strings.HasPrefix(request.URL.Path, "/api/") {
+			override := request.Header.Get("X-HTTP-Method-Override")
+			if override == "" && isFormContent(request) {
+				// the form is parsed before routing, so no per-route limit applies yet
+				if request.ContentLength > maxBodyBytes {
+					httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+					return
+				}
+				request.Body = http.MaxBytesReader(response, request.Body, maxBodyBytes)
+				if err := request.ParseForm(); isBodyTooLarge(err) {
+					httpError(response, request, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "request body too large")
+					return
+				}
+				override = request.PostFormValue("_method")
+			}
+			if override = strings.ToUpper(override); overridableMethods[override] {
+				request.Method = override
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// isFormContent reports whether the request body is an HTML form submission
+func isFormContent(request *http.Request) bool {
+	contentType := request.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/x-www-form-urlencoded") ||
+		strings.HasPrefix(contentType, "multipart/form-data")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+// encodeWithUnknownKey builds a session cookie signed with keys the server doesn't know,
+// as happens after the cookie secret changes
+func encodeWithUnknownKey(t *testing.T, userName string) *http.Cookie {
+	otherHandler := securecookie.New(
+		securecookie.GenerateRandomKey(64),
+		securecookie.GenerateRandomKey(32))
+	encoded, err := otherHandler.Encode("session", map[string]string{"name": userName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "session", Value: encoded, Path: "/"}
+}
+
+func TestSessionMiddlewareClearsUnknownKeyCookie(t *testing.T) {
+	r := setupRouter()
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(encodeWithUnknownKey(t, "testuser"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusFound {
+		t.Errorf("expected redirect for undecodable session, got %d", rr.Code)
+	}
+	if location := rr.Header().Get("Location"); location != "/" {
+		t.Errorf("expected redirect to /, got %s", location)
+	}
+
+	cleared := false
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == "session" && cookie.MaxAge == -1 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("undecodable session cookie should be cleared")
+	}
+}
+
+func TestSessionMiddlewareIndexClearsWithoutRedirect(t *testing.T) {
+	r := setupRouter()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(encodeWithUnknownKey(t, "testuser"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("login page should still render, got %d", rr.Code)
+	}
+	if len(rr.Result().Cookies()) == 0 {
+		t.Error("undecodable session cookie should be cleared on the login page")
+	}
+}
+
+func TestSessionMiddlewareLeavesValidSession(t *testing.T) {
+	r := setupRouter()
+
+	rr := httptest.NewRecorder()
+	setSession("testuser", rr)
+	cookies := rr.Result().Cookies()
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("valid session should reach the internal page, got %d", rr.Code)
+	}
+	if len(rr.Result().Cookies()) != 0 {
+		t.Error("valid session cookie should not be touched")
+	}
+}
+
+func TestSessionMiddlewareDisabled(t *testing.T) {
+	original := clearInvalidSessions
+	clearInvalidSessions = false
+	defer func() { clearInvalidSessions = original }()
+
+	r := setupRouter()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(encodeWithUnknownKey(t, "testuser"))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if len(rr.Result().Cookies()) != 0 {
+		t.Error("cookie should be left alone when clearing is disabled")
+	}
+}
+
+func TestBodyLimitPerRoute(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: username, Password: password, Role: roleAdmin}))
+	originalLogin, originalImport := loginBodyLimit, importBodyLimit
+	loginBodyLimit, importBodyLimit = 1<<10, 1<<20
+	defer func() { loginBodyLimit, importBodyLimit = originalLogin, originalImport }()
+	r := setupRouter()
+
+	// a few KB of users: fine for a bulk import, far too much for a login form
+	var entries []string
+	for i := 0; i < 30; i++ {
+		entries = append(entries, fmt.Sprintf(`{"username":"user%02d","password":"password%02d"}`, i, i))
+	}
+	body := "[" + strings.Join(entries, ",") + "]"
+
+	req := httptest.NewRequest("POST", "/api/users/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("import should accept a %d byte body, got %d: %s", len(body), rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/login", strings.NewReader("name=x&password="+strings.Repeat("a", len(body))))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("login should reject a %d byte body with 413, got %d", len(body), rr.Code)
+	}
+}
+
+func TestBodyLimitStreamedBody(t *testing.T) {
+	handler := bodyLimit(8, func(response http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); isBodyTooLarge(err) {
+			response.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	// an unknown length skips the Content-Length shortcut and trips MaxBytesReader instead
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("name=averylongusername"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = -1
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a streamed oversized body, got %d", rr.Code)
+	}
+}
+
+func TestMaxBodyBytesOnRoutesWithoutOwnLimit(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: username, Password: password, Role: roleAdmin}))
+	enableMethodOverride(t)
+	original := maxBodyBytes
+	maxBodyBytes = 1 << 10
+	defer func() { maxBodyBytes = original }()
+	oversized := strings.Repeat("a", 2<<10)
+
+	for name, build := range map[string]func() *http.Request{
+		"logout": func() *http.Request {
+			req := httptest.NewRequest("POST", "/logout", strings.NewReader("x="+oversized))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		},
+		"role update": func() *http.Request {
+			return httptest.NewRequest("PUT", "/api/users/bob/role", strings.NewReader(`{"role":"`+oversized+`"}`))
+		},
+		"streamed role update": func() *http.Request {
+			req := httptest.NewRequest("PUT", "/api/users/bob/role", strings.NewReader(`{"role":"`+oversized+`"}`))
+			req.ContentLength = -1
+			return req
+		},
+		"method override form": func() *http.Request {
+			req := httptest.NewRequest("POST", "/api/users/bob", strings.NewReader("_method=DELETE&x="+oversized))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		},
+	} {
+		req := build()
+		req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+		rr := httptest.NewRecorder()
+		appHandler(setupRouter()).ServeHTTP(rr, req)
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected 413 for a body over MAX_BODY_BYTES, got %d", name, rr.Code)
+		}
+	}
+}
+
+// enableMethodOverride turns on METHOD_OVERRIDE for the duration of a test
+func enableMethodOverride(t *testing.T) {
+	original := methodOverrideEnabled
+	methodOverrideEnabled = true
+	t.Cleanup(func() { methodOverrideEnabled = original })
+}
+
+func TestMethodOverrideRoutesToDelete(t *testing.T) {
+	enableMethodOverride(t)
+	cookie := sessionCookieFor(t, username, roleAdmin)
+
+	for name, build := range map[string]func() *http.Request{
+		"header": func() *http.Request {
+			req := httptest.NewRequest("POST", "/api/users/bob", nil)
+			req.Header.Set("X-HTTP-Method-Override", "DELETE")
+			return req
+		},
+		"form field": func() *http.Request {
+			req := httptest.NewRequest("POST", "/api/users/bob", strings.NewReader("_method=delete"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		},
+	} {
+		store := newMemoryUserStore(User{Username: "bob", Password: "secret"}, User{Username: username, Password: password, Role: roleAdmin})
+		useMemoryUserStore(t, store)
+
+		req := build()
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		appHandler(setupRouter()).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: expected 204 from the delete handler, got %d", name, rr.Code)
+		}
+		if _, err := store.FindUser(req.Context(), "bob"); err != errUserNotFound {
+			t.Errorf("%s: user should have been deleted, got %v", name, err)
+		}
+	}
+}
+
+func TestMethodOverrideDisabled(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	req := httptest.NewRequest("POST", "/api/users/bob", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+	rr := httptest.NewRecorder()
+	appHandler(setupRouter()).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("override should be ignored when disabled, got %d", rr.Code)
+	}
+}
+
+func TestMethodOverrideRejectsUnsafeMethod(t *testing.T) {
+	enableMethodOverride(t)
+
+	var seen string
+	handler := methodOverride(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		seen = request.Method
+	}))
+	for _, override := range []string{"GET", "CONNECT", "TRACE"} {
+		req := httptest.NewRequest("POST", "/api/users/bob", nil)
+		req.Header.Set("X-HTTP-Method-Override", override)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if seen != "POST" {
+			t.Errorf("override to %s should be ignored, got %s", override, seen)
+		}
+	}
+}
+
+func TestSecurityHeadersOnPages(t *testing.T) {
+	cookie := sessionCookieFor(t, username, roleUser)
+	for _, path := range []string{"/", "/internal", "/missing"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		appHandler(setupRouter()).ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options nosniff, got %q", path, got)
+		}
+		if got := rr.Header().Get("X-Frame-Options"); got != "DENY" {
+			t.Errorf("%s: expected X-Frame-Options DENY, got %q", path, got)
+		}
+		csp := rr.Header().Get("Content-Security-Policy")
+		if !strings.Contains(csp, "form-action 'self'") || !strings.Contains(csp, "frame-ancestors 'none'") {
+			t.Errorf("%s: unexpected Content-Security-Policy %q", path, csp)
+		}
+	}
+}
+
+func TestSecurityHeadersCustomPolicy(t *testing.T) {
+	original := contentSecurityPolicy
+	contentSecurityPolicy = "default-src 'self'"
+	defer func() { contentSecurityPolicy = original }()
+
+	rr := httptest.NewRecorder()
+	appHandler(setupRouter()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if got := rr.Header().Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("expected the configured policy, got %q", got)
+	}
+}
+
+func TestSessionCookieSameSite(t *testing.T) {
+	original := sessionSameSite
+	sessionSameSite = http.SameSiteStrictMode
+	defer func() { sessionSameSite = original }()
+
+	rr := httptest.NewRecorder()
+	setSession(username, rr)
+	cookie := rr.Result().Cookies()[0]
+	if cookie.SameSite != http.SameSiteStrictMode || !cookie.HttpOnly {
+		t.Errorf("expected an HttpOnly SameSite=Strict cookie, got %+v", cookie)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLogs(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/boom", func(http.ResponseWriter, *http.Request) {
+		panic("secret internal state")
+	})
+	handler := appHandler(router)
+
+	for _, accept := range []string{"text/html", "application/json"} {
+		req := httptest.NewRequest("GET", "/boom", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected 500 from a panicking handler, got %d", accept, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "secret internal state") || strings.Contains(rr.Body.String(), "goroutine") {
+			t.Errorf("%s: the panic should not leak to the client, got %q", accept, rr.Body.String())
+		}
+		if isJSON := strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json"); isJSON != (accept == "application/json") {
+			t.Errorf("%s: unexpected Content-Type %q", accept, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "handler panicked") || !strings.Contains(output, "secret internal state") || !strings.Contains(output, "goroutine") {
+		t.Errorf("the panic should be logged with its stack trace, got:\n%s", output)
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob"})
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	for _, path := range []string{"/", "/internal", "/healthz", "/login"} {
+		get := app.get(path, cookie)
+		head := app.do(httptest.NewRequest("HEAD", path, nil), cookie)
+
+		if head.Code != get.Code {
+			t.Errorf("HEAD %s: expected status %d like GET, got %d", path, get.Code, head.Code)
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf("HEAD %s: expected no body, got %q", path, head.Body.String())
+		}
+		if want := strconv.Itoa(get.Body.Len()); head.Header().Get("Content-Length") != want {
+			t.Errorf("HEAD %s: expected Content-Length %s, got %q", path, want, head.Header().Get("Content-Length"))
+		}
+		if head.Header().Get("Content-Type") != get.Header().Get("Content-Type") {
+			t.Errorf("HEAD %s: expected Content-Type %q, got %q", path, get.Header().Get("Content-Type"), head.Header().Get("Content-Type"))
+		}
+	}
+
+	// redirects keep their status and location
+	head := app.do(httptest.NewRequest("HEAD", "/internal", nil))
+	if head.Code != http.StatusFound || head.Header().Get("Location") != "/" || head.Body.Len() != 0 {
+		t.Errorf("expected a bodiless redirect for HEAD /internal without a session, got %d %q", head.Code, head.Body.String())
+	}
+}
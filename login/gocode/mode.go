@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// storage modes reported by /healthz
+const (
+	modeDatabase = "database"
+	modeFallback = "fallback"
+)
+
+// fallbackWarnInterval is how often a warning is logged while running on fallback credentials
+var fallbackWarnInterval = 5 * time.Minute
+
+// storageMode reports whether users come from the database or the hardcoded fallback
+func storageMode() string {
+	if baseUserStore() == nil {
+		return modeFallback
+	}
+	return modeDatabase
+}
+
+// warnWhileFallback logs a warning every interval while in fallback mode, until stop is closed
+func warnWhileFallback(stop <-chan struct{}, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if storageMode() == modeFallback {
+				slog.Warn("no database connection, still serving logins from the hardcoded fallback credentials")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writableStore returns the user store for handlers that change users. In fallback mode
+// there is nothing to write to, so it answers 503 and returns false; handlers must not
+// pretend to succeed.
+func writableStore(response http.ResponseWriter, request *http.Request) (UserStore, bool) {
+	store := currentUserStore()
+	if store == nil {
+		httpError(response, request, http.StatusServiceUnavailable, errCodeUnavailable, "service running without a database")
+		return nil, false
+	}
+	return store, true
+}
+
+// healthzResponse is the JSON body returned by /healthz
+type healthzResponse struct {
+	Status string `json:"status"`
+	Mode   string `json:"mode"`
+}
+
+// healthzHandler reports that the process is up and which storage mode it is in
+func healthzHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(response).Encode(healthzResponse{Status: "ok", Mode: storageMode()})
+}
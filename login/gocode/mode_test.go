@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestStorageModeFollowsCollection(t *testing.T) {
+	useMemoryUserStore(t, nil)
+	originalCollection := currentUsersCollection()
+	defer func() { setUsersCollection(originalCollection) }()
+
+	setUsersCollection(nil)
+	if mode := storageMode(); mode != modeFallback {
+		t.Errorf("expected fallback mode without a collection, got %s", mode)
+	}
+
+	setUsersCollection(&mongo.Collection{})
+	if mode := storageMode(); mode != modeDatabase {
+		t.Errorf("expected database mode with a collection, got %s", mode)
+	}
+}
+
+func TestHealthzReportsMode(t *testing.T) {
+	useMemoryUserStore(t, nil)
+	originalCollection := currentUsersCollection()
+	setUsersCollection(nil)
+	defer func() { setUsersCollection(originalCollection) }()
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+
+	var body healthzResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "ok" || body.Mode != modeFallback {
+		t.Errorf("expected ok in fallback mode, got %+v", body)
+	}
+}
+
+func TestWriteHandlersRejectedInFallbackMode(t *testing.T) {
+	useMemoryUserStore(t, nil)
+	originalCollection := currentUsersCollection()
+	setUsersCollection(nil)
+	defer func() { setUsersCollection(originalCollection) }()
+
+	form := url.Values{"password": {password}, "old_password": {password}, "new_password": {"newpass123"}, "name": {username}, "token": {"x"}}
+	testCases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/change-password", form.Encode()},
+		{"POST", "/delete-account", form.Encode()},
+		{"POST", "/forgot-password", form.Encode()},
+		{"POST", "/reset-password", form.Encode()},
+		{"POST", "/api/users/import", `[{"username":"alice","password":"alicepass1"}]`},
+		{"PUT", "/api/users/bob/role", `{"role":"admin"}`},
+		{"DELETE", "/api/users/bob", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if strings.HasPrefix(tc.body, "[") || strings.HasPrefix(tc.body, "{") {
+				req.Header.Set("Content-Type", "application/json")
+			} else {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.AddCookie(sessionCookieFor(t, username, roleAdmin))
+			rr := httptest.NewRecorder()
+			setupRouter().ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected 503 in fallback mode, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), "service running without a database") {
+				t.Errorf("expected the fallback mode message, got %s", rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+)
+
+// OIDC single sign-on settings; the routes are only served once client ID, secret and
+// issuer are all configured (see loadOIDCConfig)
+var oidcIssuer = ""
+var oidcClientID = ""
+var oidcClientSecret = ""
+var oidcRedirectURL = ""
+var oidcScopes = "openid email profile"
+
+// oidcLinkExisting (OIDC_LINK_EXISTING) lets single sign-on log in to a regular user that
+// was created otherwise and has the provider's email; off by default, since anyone who
+// can claim that email at the provider would take the account over. Admins are never
+// linked: they have to be provisioned through single sign-on.
+var oidcLinkExisting = false
+
+// oidcEndpoints is the part of the provider's discovery document used by the
+// authorization code flow and to verify ID tokens
+type oidcEndpoints struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserinfoURL string `json:"userinfo_endpoint"`
+	JWKSURL     string `json:"jwks_uri"`
+
+	// keys caches the provider's signing keys
+	keys *oidcKeySet
+}
+
+// oidcProvider is the configured provider; nil disables single sign-on
+var oidcProvider *oidcEndpoints
+
+// oidcHTTPClient talks to the provider's discovery, JWKS, token and userinfo endpoints
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// cookies carrying the state and nonce parameters between /auth/oidc/start and the callback
+const (
+	oidcStateCookie = "oidc_state"
+	oidcNonceCookie = "oidc_nonce"
+)
+
+// errOIDCLogin covers every way the provider round trip can fail; details are only logged
+var errOIDCLogin = errors.New("single sign-on failed")
+
+// loadOIDCConfig reads the OIDC_* settings and discovers the provider endpoints. It is a
+// no-op unless OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_ISSUER are all set.
+func loadOIDCConfig() error {
+	oidcIssuer = getEnvString("OIDC_ISSUER", oidcIssuer)
+	oidcClientID = getEnvString("OIDC_CLIENT_ID", oidcClientID)
+	if secret := getEnvOrFile("OIDC_CLIENT_SECRET"); secret != "" {
+		oidcClientSecret = secret
+	}
+	oidcRedirectURL = getEnvString("OIDC_REDIRECT_URL", oidcRedirectURL)
+	oidcScopes = getEnvString("OIDC_SCOPES", oidcScopes)
+	oidcLinkExisting = getEnvBool("OIDC_LINK_EXISTING", oidcLinkExisting)
+	if oidcIssuer == "" || oidcClientID == "" || oidcClientSecret == "" {
+		return nil
+	}
+	if oidcRedirectURL == "" {
+		return fmt.Errorf("OIDC_REDIRECT_URL is required with OIDC_ISSUER")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oidcHTTPClient.Timeout)
+	defer cancel()
+	provider, err := discoverOIDC(ctx, oidcIssuer)
+	if err != nil {
+		return err
+	}
+	oidcProvider = provider
+	return nil
+}
+
+// discoverOIDC fetches the endpoints from issuer's discovery document
+func discoverOIDC(ctx context.Context, issuer string) (*oidcEndpoints, error) {
+	var endpoints oidcEndpoints
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := oidcGetJSON(ctx, oidcHTTPClient, wellKnown, &endpoints); err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", issuer, err)
+	}
+	if endpoints.AuthURL == "" || endpoints.TokenURL == "" || endpoints.UserinfoURL == "" || endpoints.JWKSURL == "" {
+		return nil, fmt.Errorf("discovering %s: incomplete discovery document", issuer)
+	}
+	// ID tokens name the issuer exactly as the discovery document does
+	if strings.TrimSuffix(endpoints.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovering %s: the document is for issuer %q", issuer, endpoints.Issuer)
+	}
+	endpoints.keys = &oidcKeySet{jwksURL: endpoints.JWKSURL}
+	return &endpoints, nil
+}
+
+// oidcGetJSON decodes the JSON answer to a GET of target sent with client
+func oidcGetJSON(ctx context.Context, client *http.Client, target string, into interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", request.URL.Redacted(), response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(into)
+}
+
+// oidcOAuthConfig is the authorization code flow against the configured provider
+func oidcOAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		RedirectURL:  oidcRedirectURL,
+		Scopes:       strings.Fields(oidcScopes),
+		Endpoint:     oauth2.Endpoint{AuthURL: oidcProvider.AuthURL, TokenURL: oidcProvider.TokenURL},
+	}
+}
+
+// oidcKeyRefreshInterval is how often the JWKS is fetched again at most when an ID token
+// names a signing key that isn't cached, e.g. after the provider rotated its keys
+var oidcKeyRefreshInterval = time.Minute
+
+// oidcKeySet caches the public keys of a provider's JWKS by key ID
+type oidcKeySet struct {
+	jwksURL string
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+// key returns the signing key named kid, refetching the JWKS when it isn't cached. A token
+// without a key ID is checked against the only key of a single-key JWKS.
+func (s *oidcKeySet) key(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.Lock()
+	keys, fetched := s.keys, s.fetched
+	s.mu.Unlock()
+	if key, ok := lookupOIDCKey(keys, kid); ok {
+		return key, nil
+	}
+	if !fetched.IsZero() && clock().Sub(fetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := fetchOIDCKeys(ctx, s.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.keys, s.fetched = keys, clock()
+	s.mu.Unlock()
+	if key, ok := lookupOIDCKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func lookupOIDCKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// jsonWebKey is the part of a JWK describing an RSA or EC public key
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchOIDCKeys returns the signing keys of the JWKS at jwksURL by key ID, skipping keys
+// of other uses and types
+func fetchOIDCKeys(ctx context.Context, jwksURL string) (map[string]interface{}, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, oidcHTTPClient, jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key, or returns nil for key types ID tokens aren't checked with
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(field string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(field)
+		if err != nil || len(raw) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("malformed key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, nil
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+// oidcIDClaims are the ID token claims checked before the userinfo is trusted
+type oidcIDClaims struct {
+	Nonce string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// verifyIDToken checks the ID token's signature against the provider's keys, its issuer,
+// audience and expiry, and that it carries the nonce sent with the authorization request
+func verifyIDToken(ctx context.Context, raw string, nonce string) (*oidcIDClaims, error) {
+	claims := &oidcIDClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcProvider.keys.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(oidcProvider.Issuer), jwt.WithAudience(oidcClientID),
+		jwt.WithExpirationRequired(), jwt.WithTimeFunc(clock))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcUserinfo is the part of the userinfo response used to match users
+type oidcUserinfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+// oidcStartHandler sends the browser to the provider to log in
+func oidcStartHandler(response http.ResponseWriter, request *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(response, request)
+		return
+	}
+	state, nonce := securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)
+	if state == nil || nonce == nil {
+		http.Error(response, "failed to start single sign-on", http.StatusInternalServerError)
+		return
+	}
+	encodedState, encodedNonce := fmt.Sprintf("%x", state), fmt.Sprintf("%x", nonce)
+	for name, value := range map[string]string{oidcStateCookie: encodedState, oidcNonceCookie: encodedNonce} {
+		http.SetCookie(response, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/auth/oidc",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   request.TLS != nil,
+			// the provider redirects back with a top-level GET, which Lax allows
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	target := oidcOAuthConfig().AuthCodeURL(encodedState, oauth2.SetAuthURLParam("nonce", encodedNonce))
+	http.Redirect(response, request, target, http.StatusFound)
+}
+
+// oidcCallbackHandler completes the authorization code flow: it checks the state, looks up
+// the user by the provider's verified email, creating one on first login (see oidcUser),
+// and starts a session like a password login would
+func oidcCallbackHandler(response http.ResponseWriter, request *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(response, request)
+		return
+	}
+	cookie, err := request.Cookie(oidcStateCookie)
+	state := request.URL.Query().Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(response, "invalid single sign-on state", http.StatusBadRequest)
+		return
+	}
+	var nonce string
+	if cookie, err := request.Cookie(oidcNonceCookie); err == nil {
+		nonce = cookie.Value
+	}
+	http.SetCookie(response, &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc", MaxAge: -1})
+	http.SetCookie(response, &http.Cookie{Name: oidcNonceCookie, Path: "/auth/oidc", MaxAge: -1})
+	if providerError := request.URL.Query().Get("error"); providerError != "" {
+		requestLogger(request.Context()).Warn("single sign-on refused by provider", "error", providerError)
+		http.Redirect(response, request, loginURL("sso", ""), http.StatusFound)
+		return
+	}
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+
+	user, err := oidcUser(request.Context(), store, request.URL.Query().Get("code"), nonce)
+	if errors.Is(err, errAccountDisabled) {
+		audit(request, auditLoginFailure, user.Username, "account disabled")
+		http.Error(response, "account disabled", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("single sign-on failed", "error", err)
+		http.Redirect(response, request, loginURL("sso", ""), http.StatusFound)
+		return
+	}
+	role := user.Role
+	if role == "" {
+		role = roleUser
+	}
+	recordLoginSuccess(request.Context(), user.Username)
+	audit(request, auditLoginSuccess, user.Username, "oidc")
+	if authMode == authModeJWT {
+		if _, err := setTokenSession(tenantFrom(request.Context()), user.Username, role, response); err != nil {
+			requestLogger(request.Context()).Error("failed to sign token", "error", err)
+			http.Error(response, "failed to issue token", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		sessionID, err := setTenantSession(tenantFrom(request.Context()), user.Username, role, response)
+		if err != nil {
+			requestLogger(request.Context()).Error("failed to save session", "error", err)
+			http.Error(response, "failed to start session", http.StatusInternalServerError)
+			return
+		}
+		registerSession(request.Context(), user.Username, sessionID)
+	}
+	http.Redirect(response, request, landingPage(role), http.StatusFound)
+}
+
+// oidcUser exchanges code for the provider's tokens and userinfo and returns the user
+// with its verified email. A user is provisioned when there is none; an existing user
+// logs in once linked to the provider's subject, which only provisioning does unless
+// oidcLinkExisting is on.
+func oidcUser(ctx context.Context, store UserStore, code string, nonce string) (*User, error) {
+	if code == "" {
+		return nil, fmt.Errorf("%w: callback without a code", errOIDCLogin)
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, oidcHTTPClient)
+	config := oidcOAuthConfig()
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, fmt.Errorf("%w: token response without an ID token", errOIDCLogin)
+	}
+	claims, err := verifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+	var info oidcUserinfo
+	if err := oidcGetJSON(ctx, config.Client(ctx, token), oidcProvider.UserinfoURL, &info); err != nil {
+		return nil, fmt.Errorf("%w: %w", errOIDCLogin, err)
+	}
+	if info.Subject != claims.Subject {
+		return nil, fmt.Errorf("%w: userinfo is for another subject", errOIDCLogin)
+	}
+	if !validEmail(info.Email) || info.EmailVerified == nil || !*info.EmailVerified {
+		return nil, fmt.Errorf("%w: no verified email", errOIDCLogin)
+	}
+
+	email := normalizeEmail(info.Email)
+	user, err := store.FindUserByEmail(ctx, email)
+	if errors.Is(err, errUserNotFound) {
+		return provisionOIDCUser(ctx, store, email, claims.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.isEnabled() {
+		return user, errAccountDisabled
+	}
+	if user.OIDCSubject == "" {
+		if !oidcLinkExisting || user.roleOrDefault() == roleAdmin {
+			return nil, fmt.Errorf("%w: %s was not created through single sign-on", errOIDCLogin, user.Username)
+		}
+		if err := store.LinkOIDCSubject(ctx, user.Username, claims.Subject); err != nil {
+			return nil, err
+		}
+		user.OIDCSubject = claims.Subject
+	}
+	if user.OIDCSubject != claims.Subject {
+		return nil, fmt.Errorf("%w: %s is linked to another identity", errOIDCLogin, user.Username)
+	}
+	return user, nil
+}
+
+// oidcUsername names a user provisioned for email after it, or after its local part when
+// the email is too long for a username
+func oidcUsername(email string) (string, error) {
+	name := normalizeUsername(email)
+	if validateUsername(name) == nil {
+		return name, nil
+	}
+	local, _, _ := strings.Cut(name, "@")
+	if runes := []rune(local); len(runes) > maxUsernameLength {
+		local = string(runes[:maxUsernameLength])
+	}
+	if err := validateUsername(local); err != nil {
+		return "", fmt.Errorf("%w: no valid username for %s: %w", errOIDCLogin, email, err)
+	}
+	return local, nil
+}
+
+// provisionOIDCUser creates a regular user for email linked to subject; it gets a random
+// password, so it can only log in through the provider until the password is reset
+func provisionOIDCUser(ctx context.Context, store UserStore, email string, subject string) (*User, error) {
+	name, err := oidcUsername(email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(fmt.Sprintf("%x", securecookie.GenerateRandomKey(32)))
+	if err != nil {
+		return nil, err
+	}
+	user := User{Username: name, DisplayName: displayNameFor(email), Password: hash, Role: roleUser, Email: email, OIDCSubject: subject}
+	if err := store.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
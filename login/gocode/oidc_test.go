@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeOIDCProvider is a provider that issues tokens for the code "good-code"; the
+// userinfo and ID token it hands out follow its fields
+type fakeOIDCProvider struct {
+	server   *httptest.Server
+	key      *ecdsa.PrivateKey
+	email    string
+	verified bool
+	// audience defaults to the client ID
+	audience string
+}
+
+// oidcTestNonce is the nonce the fake provider puts in ID tokens and oidcCallback sends
+const oidcTestNonce = "n0nce"
+
+// oidcSubject is the fake provider's subject for email
+func oidcSubject(email string) string {
+	return "id-" + strings.ToLower(email)
+}
+
+// useOIDCProvider enables single sign-on against a fake provider reporting email as the
+// user's verified address
+func useOIDCProvider(t *testing.T, email string) *fakeOIDCProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeOIDCProvider{key: key, email: email, verified: true}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	provider.server = server
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(response http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(response).Encode(oidcEndpoints{
+			Issuer:      server.URL,
+			AuthURL:     server.URL + "/authorize",
+			TokenURL:    server.URL + "/token",
+			UserinfoURL: server.URL + "/userinfo",
+			JWKSURL:     server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(response http.ResponseWriter, request *http.Request) {
+		encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32))) }
+		json.NewEncoder(response).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{Kty: "EC", Kid: "k1", Use: "sig", Crv: "P-256", X: encode(key.X), Y: encode(key.Y)},
+		}})
+	})
+	mux.HandleFunc("/token", func(response http.ResponseWriter, request *http.Request) {
+		secret := request.PostFormValue("client_secret")
+		if _, basicSecret, ok := request.BasicAuth(); ok {
+			secret = basicSecret
+		}
+		if request.PostFormValue("code") != "good-code" || secret != "client-secret" {
+			response.Header().Set("Content-Type", "application/json")
+			http.Error(response, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode(map[string]string{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token":     provider.idToken(t),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(response, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"sub":            oidcSubject(provider.email),
+			"email":          provider.email,
+			"email_verified": provider.verified,
+		})
+	})
+
+	originalProvider, originalID, originalSecret, originalRedirect, originalLink := oidcProvider, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcLinkExisting
+	t.Cleanup(func() {
+		oidcProvider, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcLinkExisting = originalProvider, originalID, originalSecret, originalRedirect, originalLink
+	})
+	discovered, err := discoverOIDC(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidcProvider = discovered
+	oidcClientID, oidcClientSecret = "client-id", "client-secret"
+	oidcRedirectURL = "https://login.example.com/auth/oidc/callback"
+	return provider
+}
+
+// idToken signs an ID token for the provider's current user
+func (p *fakeOIDCProvider) idToken(t *testing.T) string {
+	audience := p.audience
+	if audience == "" {
+		audience = oidcClientID
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, oidcIDClaims{
+		Nonce: oidcTestNonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.server.URL,
+			Subject:   oidcSubject(p.email),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(clock()),
+			ExpiresAt: jwt.NewNumericDate(clock().Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// oidcCallback calls the callback with code, a state matching its state cookie and the
+// nonce the fake provider puts in its ID tokens
+func oidcCallback(code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth/oidc/callback?state=abc&code="+url.QueryEscape(code), nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "abc"})
+	req.AddCookie(&http.Cookie{Name: oidcNonceCookie, Value: oidcTestNonce})
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// oidcSessionOf returns the user and role of the session a callback started
+func oidcSessionOf(rr *httptest.ResponseRecorder) (string, string) {
+	req := httptest.NewRequest("GET", "/internal", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			req.AddCookie(cookie)
+		}
+	}
+	return getUserName(req), getSessionRole(req)
+}
+
+func TestOIDCStartRedirectsToProvider(t *testing.T) {
+	provider := useOIDCProvider(t, "bob@example.com")
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/auth/oidc/start", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider, got %d", rr.Code)
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), provider.server.URL+"/authorize?") {
+		t.Fatalf("expected a redirect to the authorization endpoint, got %q", rr.Header().Get("Location"))
+	}
+	query := location.Query()
+	if query.Get("client_id") != "client-id" || query.Get("response_type") != "code" || query.Get("redirect_uri") != oidcRedirectURL {
+		t.Errorf("unexpected authorization request %v", query)
+	}
+	cookies := map[string]string{}
+	for _, cookie := range rr.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies[oidcStateCookie] == "" || cookies[oidcStateCookie] != query.Get("state") {
+		t.Errorf("the state parameter should match the state cookie, got %q and %q", cookies[oidcStateCookie], query.Get("state"))
+	}
+	if cookies[oidcNonceCookie] == "" || cookies[oidcNonceCookie] != query.Get("nonce") {
+		t.Errorf("the nonce parameter should match the nonce cookie, got %q and %q", cookies[oidcNonceCookie], query.Get("nonce"))
+	}
+}
+
+func TestOIDCCallbackEstablishesSession(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+
+	// an unknown email provisions a regular user, who logs in with it from then on
+	useOIDCProvider(t, "Carol@Example.com")
+	for i := 0; i < 2; i++ {
+		rr := oidcCallback("good-code")
+		if rr.Code != http.StatusFound || rr.Header().Get("Location") != landingPage(roleUser) {
+			t.Fatalf("expected carol to be logged in, got %d %q", rr.Code, rr.Header().Get("Location"))
+		}
+		if name, role := oidcSessionOf(rr); name != "carol@example.com" || role != roleUser {
+			t.Errorf("expected a session for carol, got %q %q", name, role)
+		}
+	}
+	user, err := store.FindUserByEmail(context.Background(), "carol@example.com")
+	if err != nil || user.Role != roleUser || user.OIDCSubject != oidcSubject("Carol@Example.com") {
+		t.Errorf("expected carol to be provisioned as a linked regular user, got %+v, %v", user, err)
+	}
+
+	if rr := oidcCallback("bad-code"); rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("a failed token exchange should return to the login page, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestOIDCCallbackLinksExistingUsersOnlyWhenAllowed(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore(
+		User{Username: "alice", Password: "secret", Role: roleAdmin, Email: "alice@example.com"},
+		User{Username: "bob", Password: "secret", Email: "bob@example.com"},
+	)
+	useMemoryUserStore(t, store)
+
+	useOIDCProvider(t, "Bob@Example.com")
+	if rr := oidcCallback("good-code"); rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("an existing user should not be taken over by email, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	oidcLinkExisting = true
+	rr := oidcCallback("good-code")
+	if name, _ := oidcSessionOf(rr); name != "bob" {
+		t.Errorf("with OIDC_LINK_EXISTING bob should be linked and logged in, got %d %q", rr.Code, name)
+	}
+	if user, _ := store.FindUser(context.Background(), "bob"); user.OIDCSubject != oidcSubject("Bob@Example.com") {
+		t.Errorf("bob should be linked to the provider's subject, got %q", user.OIDCSubject)
+	}
+
+	useOIDCProvider(t, "alice@example.com")
+	oidcLinkExisting = true
+	if rr := oidcCallback("good-code"); rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("an existing admin should never be linked, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestOIDCCallbackRejectsUntrustedIdentities(t *testing.T) {
+	freshLoginThrottle(t)
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+	provider := useOIDCProvider(t, "carol@example.com")
+
+	provider.verified = false
+	if rr := oidcCallback("good-code"); rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("an unverified email should be refused, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	provider.verified = true
+
+	provider.audience = "another-client"
+	if rr := oidcCallback("good-code"); rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("an ID token for another client should be refused, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	provider.audience = ""
+
+	req := httptest.NewRequest("GET", "/auth/oidc/callback?state=abc&code=good-code", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "abc"})
+	req.AddCookie(&http.Cookie{Name: oidcNonceCookie, Value: "replayed"})
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Header().Get("Location") != loginURL("sso", "") {
+		t.Errorf("an ID token with another nonce should be refused, got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	if _, err := store.FindUserByEmail(context.Background(), "carol@example.com"); err == nil {
+		t.Error("no user should be provisioned for a refused identity")
+	}
+}
+
+func TestOIDCUsernameOfLongEmail(t *testing.T) {
+	email := strings.Repeat("a", 60) + "@example.com"
+	if name, err := oidcUsername(email); err != nil || name != strings.Repeat("a", 60) {
+		t.Errorf("an email too long for a username should fall back to its local part, got %q, %v", name, err)
+	}
+	if name, err := oidcUsername("Dave@Example.com"); err != nil || name != "dave@example.com" {
+		t.Errorf("expected the normalized email as username, got %q, %v", name, err)
+	}
+	if _, err := oidcUsername(strings.Repeat("a", 100) + "@example.com"); err != nil {
+		t.Errorf("an overlong local part should be shortened, got %v", err)
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore())
+	useOIDCProvider(t, "bob@example.com")
+
+	req := httptest.NewRequest("GET", "/auth/oidc/callback?state=forged&code=good-code", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "abc"})
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a forged state, got %d", rr.Code)
+	}
+}
+
+func TestOIDCDisabledWithoutConfig(t *testing.T) {
+	original := oidcProvider
+	oidcProvider = nil
+	t.Cleanup(func() { oidcProvider = original })
+
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/auth/oidc/start", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without an OIDC provider, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password length bounds; bcrypt ignores anything past 72 bytes
+const minPasswordLength = 8
+const maxPasswordLength = 72
+
+// errors returned when a new password doesn't meet the policy
+var errWeakPassword = fmt.Errorf("password must be at least %d characters and contain a letter and a digit", minPasswordLength)
+var errPasswordTooLong = fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+
+// fallbackPasswordHash is the bcrypt hash of the fallback user's password, used when running
+// without a database. Set it at build time with -ldflags "-X main.fallbackPasswordHash=<hash>"
+// or at runtime with FALLBACK_PASSWORD_HASH; the plaintext default is only accepted in development.
+var fallbackPasswordHash string
+
+// bcryptCost is the bcrypt cost factor for new hashes; raise it in production, lower it
+// to speed up tests
+var bcryptCost = bcrypt.DefaultCost
+
+// validBcryptCost checks that cost is within bcrypt's allowed range
+func validBcryptCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost %d is outside the allowed range %d-%d", cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of pass for storage
+func hashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// passwordMatches compares pass against a stored password, which is either a bcrypt
+// hash or, for documents created before hashing, the plaintext password
+func passwordMatches(stored string, pass string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+}
+
+// dummyPasswordHash is a bcrypt hash of a random password, compared against when there
+// is no user to check, so unknown usernames take as long to reject as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword(securecookie.GenerateRandomKey(32), bcryptCost)
+	return hash
+})
+
+// rejectPassword spends the time of a bcrypt comparison of pass and fails it
+func rejectPassword(pass string) bool {
+	bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(pass))
+	return false
+}
+
+// validateNewPassword checks a new password against the password policy
+func validateNewPassword(pass string) error {
+	if len(pass) < minPasswordLength {
+		return errWeakPassword
+	}
+	if len(pass) > maxPasswordLength {
+		return errPasswordTooLong
+	}
+	hasLetter := strings.ContainsAny(strings.ToLower(pass), "abcdefghijklmnopqrstuvwxyz")
+	hasDigit := strings.ContainsAny(pass, "0123456789")
+	if !hasLetter || !hasDigit {
+		return errWeakPassword
+	}
+	return nil
+}
+
+// validFallbackHash reports whether hash is a usable bcrypt hash
+func validFallbackHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// verifyFallbackCredentials checks credentials against the hardcoded fallback user
+func verifyFallbackCredentials(user string, pass string) bool {
+	if username == "" || normalizeUsername(user) != normalizeUsername(username) {
+		return rejectPassword(pass)
+	}
+	if fallbackPasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(fallbackPasswordHash), []byte(pass)) == nil
+	}
+	if appEnv == "production" {
+		// no plaintext default password outside development
+		return rejectPassword(pass)
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+}
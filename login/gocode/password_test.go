@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := hashPassword("s3cretpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "s3cretpass" {
+		t.Fatal("hashPassword should not return the plaintext")
+	}
+	if !passwordMatches(hash, "s3cretpass") {
+		t.Error("hash should match the original password")
+	}
+	if passwordMatches(hash, "wrongpass1") {
+		t.Error("hash should not match a different password")
+	}
+}
+
+func TestBcryptCostFromConfig(t *testing.T) {
+	original := bcryptCost
+	t.Cleanup(func() { bcryptCost = original })
+
+	t.Setenv("BCRYPT_COST", "5")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	hash, err := hashPassword("s3cretpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != 5 {
+		t.Errorf("hash cost = %d (%v), want 5", cost, err)
+	}
+}
+
+func TestLoadConfigRejectsInvalidBcryptCost(t *testing.T) {
+	original := bcryptCost
+	t.Cleanup(func() { bcryptCost = original })
+
+	for _, value := range []string{"3", "32"} {
+		t.Setenv("BCRYPT_COST", value)
+		if err := loadConfig(); err == nil {
+			t.Errorf("BCRYPT_COST=%s should be rejected", value)
+		}
+		if bcryptCost != original {
+			t.Errorf("BCRYPT_COST=%s changed the cost to %d", value, bcryptCost)
+		}
+	}
+}
+
+func TestPasswordMatchesLegacyPlaintext(t *testing.T) {
+	if !passwordMatches("Pass123", "Pass123") {
+		t.Error("plaintext documents from before hashing should still match")
+	}
+	if passwordMatches("Pass123", "pass123") {
+		t.Error("plaintext comparison should be exact")
+	}
+}
+
+func TestValidateNewPassword(t *testing.T) {
+	testCases := []struct {
+		password string
+		valid    bool
+	}{
+		{"short1", false},
+		{"allletters", false},
+		{"1234567890", false},
+		{"letters123", true},
+		{strings.Repeat("a1", 40), false},
+	}
+
+	for _, tc := range testCases {
+		err := validateNewPassword(tc.password)
+		if (err == nil) != tc.valid {
+			t.Errorf("validateNewPassword(%q) = %v, want valid=%v", tc.password, err, tc.valid)
+		}
+	}
+}
+
+func TestFallbackAuthenticatesAgainstConfiguredHash(t *testing.T) {
+	originalHash, originalCollection := fallbackPasswordHash, currentUsersCollection()
+	defer func() {
+		fallbackPasswordHash = originalHash
+		setUsersCollection(originalCollection)
+	}()
+	setUsersCollection(nil)
+	useMemoryUserStore(t, nil)
+
+	hash, err := hashPassword("fallback123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallbackPasswordHash = hash
+
+	if !verifyCredentials(context.Background(), username, "fallback123") {
+		t.Error("fallback should authenticate against the configured hash")
+	}
+	if verifyCredentials(context.Background(), username, password) {
+		t.Error("the plaintext default should not be accepted once a hash is configured")
+	}
+	if verifyCredentials(context.Background(), "someoneelse", "fallback123") {
+		t.Error("fallback should only accept the fallback username")
+	}
+}
+
+func TestFallbackPlaintextOnlyInDevelopment(t *testing.T) {
+	originalHash, originalEnv := fallbackPasswordHash, appEnv
+	defer func() { fallbackPasswordHash, appEnv = originalHash, originalEnv }()
+	fallbackPasswordHash = ""
+
+	appEnv = "development"
+	if !verifyFallbackCredentials(username, password) {
+		t.Error("plaintext default should work in development")
+	}
+
+	appEnv = "production"
+	if verifyFallbackCredentials(username, password) {
+		t.Error("plaintext default must not work in production")
+	}
+}
+
+func TestValidFallbackHash(t *testing.T) {
+	hash, _ := hashPassword("fallback123")
+	if !validFallbackHash(hash) {
+		t.Error("bcrypt hash should be valid")
+	}
+	if validFallbackHash("not-a-hash") {
+		t.Error("arbitrary string should not be a valid hash")
+	}
+}
+
+func TestFailedLoginResponsesIdentical(t *testing.T) {
+	freshLoginThrottle(t)
+	hash, err := hashPassword("s3cret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: hash}))
+
+	start := time.Now()
+	wrongPassword := postLogin("bob", "wrong-pass1")
+	wrongPasswordTime := time.Since(start)
+	start = time.Now()
+	unknownUser := postLogin("nobody", "wrong-pass1")
+	unknownUserTime := time.Since(start)
+
+	if wrongPassword.Code != unknownUser.Code || wrongPassword.Body.String() != unknownUser.Body.String() {
+		t.Errorf("responses differ: wrong password %d %q, unknown user %d %q",
+			wrongPassword.Code, wrongPassword.Body.String(), unknownUser.Code, unknownUser.Body.String())
+	}
+	if len(wrongPassword.Result().Cookies()) != len(unknownUser.Result().Cookies()) {
+		t.Error("responses should set the same cookies")
+	}
+	// an unknown user still costs a bcrypt comparison; the bound is loose to stay reliable
+	if unknownUserTime < wrongPasswordTime/4 {
+		t.Errorf("an unknown user was rejected in %v, a wrong password in %v", unknownUserTime, wrongPasswordTime)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// per-IP rate limit: requests per second refilled into a bucket of rateLimitBurst;
+// a zero rate disables limiting
+var rateLimitPerSecond float64
+var rateLimitBurst = 20
+
+// tokenBucket is the state of one client's bucket
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxRateLimitBuckets caps the client IPs tracked at once, so a flood of addresses can't
+// exhaust memory; past it, an arbitrary bucket is dropped, handing that client a full one
+var maxRateLimitBuckets = 100000
+
+// rateLimitSweepInterval is how often buckets left idle long enough to refill are dropped
+var rateLimitSweepInterval = time.Minute
+
+// ipRateLimiter hands out tokens per client IP
+type ipRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token for ip, or reports how long until one is available
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			for other := range l.buckets {
+				delete(l.buckets, other)
+				break
+			}
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := (1 - bucket.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since they behave like new ones, at
+// most once per rateLimitSweepInterval; callers hold l.mu
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// setRetryAfter tells the client to retry after wait, in whole seconds rounded up
+func setRetryAfter(response http.ResponseWriter, wait time.Duration) {
+	response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// rateLimit answers 429 with Retry-After once a client IP has used up its bucket
+func rateLimit(next http.Handler) http.Handler {
+	if rateLimitPerSecond <= 0 {
+		return next
+	}
+	limiter := newIPRateLimiter(rateLimitPerSecond, rateLimitBurst)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if ok, wait := limiter.allow(clientIP(request), clock()); !ok {
+			setRetryAfter(response, wait)
+			http.Error(response, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// maxInflightRequests caps the requests served at once across all clients, protecting
+// MongoDB from connection storms; zero disables the cap
+var maxInflightRequests = 0
+
+// inflightExempt lists the health probes, which must keep answering under load
+var inflightExempt = map[string]bool{"/healthz": true, "/livez": true, "/readyz": true}
+
+// limitInflight answers 503 with Retry-After while maxInflightRequests are being served
+func limitInflight(next http.Handler) http.Handler {
+	if maxInflightRequests <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, maxInflightRequests)
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if inflightExempt[request.URL.Path] {
+			next.ServeHTTP(response, request)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(response, request)
+		default:
+			response.Header().Set("Retry-After", "1")
+			httpError(response, request, http.StatusServiceUnavailable, errCodeUnavailable, "server busy, try again later")
+		}
+	})
+}
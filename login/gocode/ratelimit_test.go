@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limitedHandler returns the app handler with a small per-IP rate limit
+func limitedHandler(t *testing.T, rate float64, burst int) http.Handler {
+	originalRate, originalBurst := rateLimitPerSecond, rateLimitBurst
+	rateLimitPerSecond, rateLimitBurst = rate, burst
+	t.Cleanup(func() { rateLimitPerSecond, rateLimitBurst = originalRate, originalBurst })
+	return appHandler(setupRouter())
+}
+
+func getFrom(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	handler := limitedHandler(t, 0.1, 3)
+
+	var limited *httptest.ResponseRecorder
+	for i := 0; i < 10 && limited == nil; i++ {
+		if rr := getFrom(handler, "198.51.100.1:1234"); rr.Code == http.StatusTooManyRequests {
+			limited = rr
+		}
+	}
+	if limited == nil {
+		t.Fatal("rapid requests from one IP should eventually get 429")
+	}
+	if limited.Header().Get("Retry-After") == "" {
+		t.Error("a 429 should carry Retry-After")
+	}
+
+	if rr := getFrom(handler, "198.51.100.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("another IP should be unaffected, got %d", rr.Code)
+	}
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	handler := limitedHandler(t, 0.1, 1)
+	original := trustProxyHeaders
+	trustProxyHeaders = true
+	defer func() { trustProxyHeaders = original }()
+
+	get := func(forwarded string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	get("203.0.113.7")
+	if code := get("203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("the forwarded client should be limited, got %d", code)
+	}
+	if code := get("203.0.113.8"); code != http.StatusOK {
+		t.Errorf("clients behind the same proxy should have separate buckets, got %d", code)
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	limiter := newIPRateLimiter(0.001, 50)
+	now := time.Now()
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := limiter.allow("198.51.100.1", now); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("exactly the burst should be allowed under concurrency, got %d", allowed)
+	}
+}
+
+func TestRateLimitFollowsClock(t *testing.T) {
+	fake := useFakeClock(t)
+	handler := limitedHandler(t, 1, 1)
+
+	getFrom(handler, "198.51.100.1:1234")
+	if rr := getFrom(handler, "198.51.100.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("the second request should be limited, got %d", rr.Code)
+	}
+	fake.Advance(time.Second)
+	if rr := getFrom(handler, "198.51.100.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("the bucket should refill as the clock moves on, got %d", rr.Code)
+	}
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	limiter := newIPRateLimiter(1, 2)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		limiter.allow(fmt.Sprintf("198.51.100.%d", i), now)
+	}
+
+	limiter.allow("203.0.113.1", now.Add(rateLimitSweepInterval))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("idle buckets should be swept, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterIsBounded(t *testing.T) {
+	original := maxRateLimitBuckets
+	maxRateLimitBuckets = 3
+	t.Cleanup(func() { maxRateLimitBuckets = original })
+	limiter := newIPRateLimiter(0.001, 1)
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		limiter.allow(fmt.Sprintf("198.51.100.%d", i), now)
+	}
+	if len(limiter.buckets) > maxRateLimitBuckets {
+		t.Errorf("expected at most %d buckets, got %d", maxRateLimitBuckets, len(limiter.buckets))
+	}
+	if ok, _ := limiter.allow("198.51.100.9", now); ok {
+		t.Error("the newest client's bucket should be kept")
+	}
+}
+
+func TestLimitInflight(t *testing.T) {
+	original := maxInflightRequests
+	maxInflightRequests = 2
+	t.Cleanup(func() { maxInflightRequests = original })
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := limitInflight(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxInflightRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/internal", nil))
+		}()
+		<-started
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/internal", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After at the limit, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	wg.Wait()
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/internal", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("requests should be served again once the others finished, got %d", rr.Code)
+	}
+}
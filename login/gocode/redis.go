@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis settings of SESSION_BACKEND=redis
+var redisAddr = ""
+var redisPassword = ""
+var redisTimeout = 2 * time.Second
+
+// redisFallback uses the in-memory session store when Redis can't be reached at
+// startup; otherwise the app refuses to start
+var redisFallback = false
+
+// redisSessionKeyPrefix namespaces the session keys in a shared Redis
+const redisSessionKeyPrefix = "session:"
+
+// redisSessionStore keeps sessions in Redis under random IDs, so every instance sees
+// them and deleting a key revokes the session everywhere. Keys expire with the session.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+func newRedisSessionStore(client *redis.Client) *redisSessionStore {
+	return &redisSessionStore{client: client}
+}
+
+func (s *redisSessionStore) Save(values map[string]string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Set(ctx, redisSessionKeyPrefix+id, data, sessionTTL+sessionGracePeriod).Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *redisSessionStore) Load(cookieValue string) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, redisSessionKeyPrefix+cookieValue).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("failed to load session from Redis", "error", err)
+		}
+		return nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil
+	}
+	return values
+}
+
+func (s *redisSessionStore) Delete(cookieValue string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.client.Del(ctx, redisSessionKeyPrefix+cookieValue).Err(); err != nil {
+		slog.Error("failed to delete session from Redis", "error", err)
+	}
+}
+
+// connectRedisSessionStore connects to redisAddr, falling back to the in-memory store
+// when Redis is unreachable and redisFallback is set
+func connectRedisSessionStore() (SessionStore, error) {
+	if redisAddr == "" {
+		return nil, errors.New("REDIS_ADDR is required with SESSION_BACKEND=redis")
+	}
+	client := redis.NewClient(&redis.Options{Addr: redisAddr, Password: redisPassword})
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		if !redisFallback {
+			return nil, err
+		}
+		slog.Warn("Redis is unreachable, keeping sessions in memory", "addr", redisAddr, "error", err)
+		return newMemorySessionStore(), nil
+	}
+	return newRedisSessionStore(client), nil
+}
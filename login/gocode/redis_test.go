@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedisSessions points the session store at an in-process Redis
+func useRedisSessions(t *testing.T) (*miniredis.Miniredis, *redisSessionStore) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store := newRedisSessionStore(client)
+	useSessionStore(t, store)
+	return server, store
+}
+
+var _ SessionStore = (*redisSessionStore)(nil)
+
+func TestRedisSessionStoreSetGetDelete(t *testing.T) {
+	server, store := useRedisSessions(t)
+
+	id, err := store.Save(map[string]string{"name": "bob", "role": roleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists(redisSessionKeyPrefix + id) {
+		t.Fatalf("the session should be stored under %s%s", redisSessionKeyPrefix, id)
+	}
+	if ttl := server.TTL(redisSessionKeyPrefix + id); ttl != sessionTTL+sessionGracePeriod {
+		t.Errorf("the key should expire with the session, got TTL %v", ttl)
+	}
+	if values := store.Load(id); values["name"] != "bob" || values["role"] != roleAdmin {
+		t.Errorf("expected bob's session back, got %v", values)
+	}
+
+	store.Delete(id)
+	if store.Load(id) != nil {
+		t.Error("a deleted session should not load")
+	}
+}
+
+func TestRedisSessionExpires(t *testing.T) {
+	server, store := useRedisSessions(t)
+	id, _ := store.Save(map[string]string{"name": "bob"})
+
+	server.FastForward(sessionTTL + sessionGracePeriod)
+	if store.Load(id) != nil {
+		t.Error("the session should be gone once its TTL passes")
+	}
+}
+
+func TestRedisSessionRoundTripsUsername(t *testing.T) {
+	useRedisSessions(t)
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	if got := getUserName(req); got != "bob" {
+		t.Errorf("expected bob from the Redis store, got %q", got)
+	}
+}
+
+func TestLoadConfigRedisBackend(t *testing.T) {
+	useSessionStore(t, sessionStore)
+	originalAddr, originalFallback, originalTimeout := redisAddr, redisFallback, redisTimeout
+	t.Cleanup(func() { redisAddr, redisFallback, redisTimeout = originalAddr, originalFallback, originalTimeout })
+	server := miniredis.RunT(t)
+
+	t.Setenv("SESSION_BACKEND", "redis")
+	t.Setenv("REDIS_ADDR", server.Addr())
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if _, ok := sessionStore.(*redisSessionStore); !ok {
+		t.Errorf("SESSION_BACKEND=redis should select the Redis store, got %T", sessionStore)
+	}
+
+	// nothing listens on an address taken from a closed server
+	unreachable := server.Addr()
+	server.Close()
+	t.Setenv("REDIS_ADDR", unreachable)
+	t.Setenv("REDIS_TIMEOUT", "200ms")
+	if err := loadConfig(); err == nil {
+		t.Error("an unreachable Redis should fail startup without REDIS_FALLBACK")
+	}
+	t.Setenv("REDIS_FALLBACK", "true")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("REDIS_FALLBACK should keep going: %v", err)
+	}
+	if _, ok := sessionStore.(*memorySessionStore); !ok {
+		t.Errorf("an unreachable Redis should fall back to memory sessions, got %T", sessionStore)
+	}
+}
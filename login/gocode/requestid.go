@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestIDKey is the context key under which the current request ID is stored
+type requestIDKey struct{}
+
+// withRequestID returns a copy of ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID stored in ctx, or "" when there is none
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// queryComment is the MongoDB comment attached to queries so they can be traced back to
+// the request in the server logs and profiler; "" when ctx carries no request ID
+func queryComment(ctx context.Context) string {
+	if id := requestIDFromContext(ctx); id != "" {
+		return "request_id:" + id
+	}
+	return ""
+}
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds incoming IDs so clients can't flood the logs
+const maxRequestIDLength = 128
+
+// newRequestID returns a random 16-byte hex ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// validRequestID accepts short IDs made of characters that are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware tags each request with the incoming X-Request-ID, or a generated
+// one, stores it in the request context and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		response.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(response, request.WithContext(withRequestID(request.Context(), id)))
+	})
+}
+
+// requestLogger returns the default logger, tagged with the request ID when ctx carries one
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDEchoesIncoming(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		seen = requestIDFromContext(request.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if id := rr.Header().Get("X-Request-ID"); id != "abc-123" {
+		t.Errorf("incoming request ID should be echoed, got %q", id)
+	}
+	if seen != "abc-123" {
+		t.Errorf("request ID should be in the handler's context, got %q", seen)
+	}
+}
+
+func TestRequestIDGeneratedWhenAbsentOrInvalid(t *testing.T) {
+	handler := appHandler(setupRouter())
+
+	for _, incoming := range []string{"", "bad id\nwith newline", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", incoming)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if len(id) != 32 || id == incoming {
+			t.Errorf("expected a generated request ID for %q, got %q", incoming, id)
+		}
+	}
+}
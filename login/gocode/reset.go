@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resetTokenTTL is how long a password reset token stays valid
+var resetTokenTTL = 30 * time.Minute
+
+// ResetSender delivers password reset tokens to users (email, ...)
+type ResetSender interface {
+	SendResetToken(user User, token string)
+}
+
+// logResetTokens makes logResetSender also log the tokens themselves, at debug level, to
+// try resets out in development without email; LOG_RESET_TOKENS, refused in production
+var logResetTokens = false
+
+// logResetSender is the default ResetSender; it only logs until email delivery is wired up
+type logResetSender struct{}
+
+func (logResetSender) SendResetToken(user User, token string) {
+	slog.Info("password reset token issued", "user", user.Username)
+	if logResetTokens {
+		slog.Debug("password reset token", "user", user.Username, "token", token)
+	}
+}
+
+// resetSender receives newly issued reset tokens
+var resetSender ResetSender = logResetSender{}
+
+// errInvalidResetToken covers unknown, used and expired tokens alike
+var errInvalidResetToken = errors.New("reset token is invalid or expired")
+
+// hashResetToken is how reset tokens are stored; they are random enough that a fast
+// hash is fine and lets the token be looked up directly
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// findResetUser returns the user named by identifier, either a username or an email
+func findResetUser(ctx context.Context, store UserStore, identifier string) (*User, error) {
+	if strings.Contains(identifier, "@") {
+		return store.FindUserByEmail(ctx, normalizeEmail(identifier))
+	}
+	return store.FindUser(ctx, normalizeUsername(identifier))
+}
+
+// issueResetToken stores a new reset token for the user and hands it to resetSender
+func issueResetToken(ctx context.Context, store UserStore, user *User) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(raw)
+	if err := store.SetResetToken(ctx, user.Username, hashResetToken(token), clock().Add(resetTokenTTL)); err != nil {
+		return err
+	}
+	resetSender.SendResetToken(*user, token)
+	return nil
+}
+
+// forgotPasswordHandler issues a reset token for the given username or email. It answers
+// the same way whether or not the user exists, so it can't be used to probe accounts.
+func forgotPasswordHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		http.Error(response, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	identifier := strings.TrimSpace(request.FormValue("name"))
+	user, err := findResetUser(request.Context(), store, identifier)
+	if err == nil {
+		err = issueResetToken(request.Context(), store, user)
+	}
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		requestLogger(request.Context()).Error("failed to issue reset token", "error", err)
+	}
+	fmt.Fprint(response, "<h1>Check your inbox</h1><p>If the account exists, a reset link is on its way.</p>")
+}
+
+// resetPasswordHandler sets a new password for the holder of a valid reset token and ends
+// the user's sessions, which may belong to whoever made the reset necessary
+func resetPasswordHandler(response http.ResponseWriter, request *http.Request) {
+	store, ok := writableStore(response, request)
+	if !ok {
+		return
+	}
+	if err := request.ParseForm(); isBodyTooLarge(err) {
+		http.Error(response, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	token := request.FormValue("token")
+	user, err := store.FindUserByResetToken(request.Context(), hashResetToken(token))
+	if token == "" || err != nil || !clock().Before(user.ResetTokenExpires) {
+		if err != nil && !errors.Is(err, errUserNotFound) {
+			requestLogger(request.Context()).Error("failed to look up reset token", "error", err)
+		}
+		http.Error(response, errInvalidResetToken.Error(), http.StatusBadRequest)
+		return
+	}
+	newPassword := request.FormValue("new_password")
+	if err := validateNewPassword(newPassword); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err == nil {
+		err = store.UpdatePassword(request.Context(), user.Username, hash)
+	}
+	if err == nil {
+		// tokens are single use
+		err = store.SetResetToken(request.Context(), user.Username, "", time.Time{})
+	}
+	if err == nil {
+		err = store.ClearSessions(request.Context(), user.Username)
+	}
+	if err != nil {
+		requestLogger(request.Context()).Error("failed to reset password", "user", user.Username, "error", err)
+		http.Error(response, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	recordLoginSuccess(request.Context(), user.Username)
+	audit(request, auditPasswordChange, user.Username, "reset token")
+	fmt.Fprint(response, "<h1>Password reset</h1><a href=\"/login\">Log in</a>")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingResetSender remembers the last token it was asked to deliver
+type recordingResetSender struct {
+	sent  int
+	token string
+}
+
+func (s *recordingResetSender) SendResetToken(user User, token string) {
+	s.sent++
+	s.token = token
+}
+
+// useResetSender captures reset tokens for the duration of a test
+func useResetSender(t *testing.T) *recordingResetSender {
+	sender := &recordingResetSender{}
+	original := resetSender
+	resetSender = sender
+	t.Cleanup(func() { resetSender = original })
+	return sender
+}
+
+func postForm(path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestForgotPasswordIssuesHashedToken(t *testing.T) {
+	sender := useResetSender(t)
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret", Email: "bob@example.com"})
+	useMemoryUserStore(t, store)
+
+	for _, identifier := range []string{"bob", "Bob@Example.com"} {
+		if rr := postForm("/forgot-password", url.Values{"name": {identifier}}); rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", identifier, rr.Code)
+		}
+	}
+	if sender.sent != 2 || len(sender.token) != 64 {
+		t.Fatalf("expected a token for both the username and the email, got %d sent", sender.sent)
+	}
+	user, _ := store.FindUser(context.Background(), "bob")
+	if user.ResetTokenHash != hashResetToken(sender.token) || user.ResetTokenHash == sender.token {
+		t.Error("only the hash of the latest token should be stored")
+	}
+	if !user.ResetTokenExpires.After(time.Now()) {
+		t.Errorf("token should expire in the future, got %v", user.ResetTokenExpires)
+	}
+}
+
+func TestForgotPasswordUnknownUser(t *testing.T) {
+	sender := useResetSender(t)
+	useMemoryUserStore(t, newMemoryUserStore())
+
+	rr := postForm("/forgot-password", url.Values{"name": {"nobody"}})
+	if rr.Code != http.StatusOK || sender.sent != 0 {
+		t.Errorf("unknown users should get the same answer and no token, got %d and %d sent", rr.Code, sender.sent)
+	}
+}
+
+func TestResetPasswordWithToken(t *testing.T) {
+	sender := useResetSender(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	postForm("/forgot-password", url.Values{"name": {"bob"}})
+
+	rr := postForm("/reset-password", url.Values{"token": {sender.token}, "new_password": {"newpass123"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !verifyCredentials(context.Background(), "bob", "newpass123") {
+		t.Error("the new password should work after a reset")
+	}
+
+	rr = postForm("/reset-password", url.Values{"token": {sender.token}, "new_password": {"other1234"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("a used token should be rejected, got %d", rr.Code)
+	}
+}
+
+func TestResetPasswordEndsSessions(t *testing.T) {
+	fake := useFakeClock(t)
+	sender := useResetSender(t)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+	session := app.loginCookie("bob", "secret")
+	app.postForm("/forgot-password", url.Values{"name": {"bob"}})
+	fake.Advance(time.Second)
+
+	if rr := app.postForm("/reset-password", url.Values{"token": {sender.token}, "new_password": {"newpass123"}}); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := app.get("/internal", session); rr.Code != http.StatusFound {
+		t.Errorf("sessions from before the reset should be ended, got %d", rr.Code)
+	}
+	if rr := app.get("/internal", app.loginCookie("bob", "newpass123")); rr.Code != http.StatusOK {
+		t.Errorf("logging in with the new password should work, got %d", rr.Code)
+	}
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	fake := useFakeClock(t)
+	sender := useResetSender(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	postForm("/forgot-password", url.Values{"name": {"bob"}})
+
+	fake.Advance(resetTokenTTL + time.Second)
+	rr := postForm("/reset-password", url.Values{"token": {sender.token}, "new_password": {"newpass123"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("an expired token should be rejected, got %d", rr.Code)
+	}
+	if !verifyCredentials(context.Background(), "bob", "secret") {
+		t.Error("the old password should still work")
+	}
+}
+
+func TestLogResetSenderKeepsTokensOutOfTheLog(t *testing.T) {
+	logs := captureLogs(t)
+	logLevel.Set(slog.LevelDebug)
+	original := logResetTokens
+	t.Cleanup(func() { logResetTokens = original })
+
+	logResetTokens = false
+	logResetSender{}.SendResetToken(User{Username: "bob"}, "secret-token")
+	if !strings.Contains(logs.String(), "password reset token issued") {
+		t.Errorf("the issued token should be noted, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "secret-token") {
+		t.Errorf("the token should not be logged by default, got %q", logs.String())
+	}
+
+	logResetTokens = true
+	logResetSender{}.SendResetToken(User{Username: "bob"}, "secret-token")
+	if !strings.Contains(logs.String(), "secret-token") {
+		t.Errorf("LOG_RESET_TOKENS should log the token at debug level, got %q", logs.String())
+	}
+}
+
+func TestLoadConfigRefusesLoggedResetTokensInProduction(t *testing.T) {
+	originalLog, originalEnv, originalSeed := logResetTokens, appEnv, seedDefaultUser
+	t.Cleanup(func() { logResetTokens, appEnv, seedDefaultUser = originalLog, originalEnv, originalSeed })
+
+	t.Setenv("LOG_RESET_TOKENS", "true")
+	t.Setenv("APP_ENV", "development")
+	if err := loadConfig(); err != nil || !logResetTokens {
+		t.Fatalf("LOG_RESET_TOKENS should be accepted in development, got %v", err)
+	}
+	t.Setenv("APP_ENV", "production")
+	if err := loadConfig(); err == nil {
+		t.Error("LOG_RESET_TOKENS should be refused in production")
+	}
+}
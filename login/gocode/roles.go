@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// roles stored on user documents and carried in the session
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// roleOrDefault returns the user's role, treating documents without one as regular users
+func (u *User) roleOrDefault() string {
+	if u.Role == "" {
+		return roleUser
+	}
+	return u.Role
+}
+
+// lookupRole returns the role of a user that has already been authenticated
+func lookupRole(ctx context.Context, userName string) string {
+	store := currentUserStore()
+	if store == nil {
+		// the hardcoded fallback user is the seeded admin
+		if userName == normalizeUsername(username) {
+			return roleAdmin
+		}
+		return roleUser
+	}
+	user, err := store.FindUser(ctx, userName)
+	if err != nil {
+		return roleUser
+	}
+	return user.roleOrDefault()
+}
+
+// landingPages maps roles to where they land after logging in; roles without an entry
+// go to /internal. A valid ?next= still wins.
+var landingPages = map[string]string{}
+
+// landingPage returns the post-login redirect target for role
+func landingPage(role string) string {
+	if page, ok := landingPages[role]; ok {
+		return page
+	}
+	return "/internal"
+}
+
+// parseLandingPages parses "role=/path" entries, rejecting unknown roles and off-site paths
+func parseLandingPages(entries []string) (map[string]string, error) {
+	pages := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		role, page, ok := strings.Cut(entry, "=")
+		role, page = strings.TrimSpace(role), strings.TrimSpace(page)
+		if !ok || !validRole(role) {
+			return nil, fmt.Errorf("invalid entry %q, expected role=/path with role user or admin", entry)
+		}
+		if safeNext(page) == "" {
+			return nil, fmt.Errorf("invalid path %q for role %s, expected a local path", page, role)
+		}
+		pages[role] = page
+	}
+	return pages, nil
+}
+
+// authUserKey is the context key for the user authenticated by requireAuth
+type authUserKey struct{}
+
+// authUser returns the user authenticated by requireAuth, or ""
+func authUser(request *http.Request) string {
+	userName, _ := request.Context().Value(authUserKey{}).(string)
+	return userName
+}
+
+// isAPIRequest reports whether a request should get status codes rather than redirects
+func isAPIRequest(request *http.Request) bool {
+	return strings.HasPrefix(request.URL.Path, "/api/") || wantsJSON(request)
+}
+
+// preventCaching keeps browsers and proxies from storing an authenticated response, so
+// the back button can't show it again after logout (bfcache included)
+func preventCaching(response http.ResponseWriter) {
+	response.Header().Set("Cache-Control", "no-store, no-cache")
+	response.Header().Set("Pragma", "no-cache")
+}
+
+// requireAuth only lets requests through that carry a session, storing the user in the
+// request context for authUser. Sessions in their grace period pass too; handlers that
+// change state check sessionExpired themselves. Pages redirect to "/" without a session,
+// API requests get a 401. Responses are marked uncacheable.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		preventCaching(response)
+		userName := getUserName(request)
+		if userName == "" {
+			if isAPIRequest(request) {
+				writeJSONError(response, http.StatusUnauthorized, errCodeUnauthenticated, "authentication required")
+				return
+			}
+			http.Redirect(response, request, "/", http.StatusFound)
+			return
+		}
+		ctx := context.WithValue(request.Context(), authUserKey{}, userName)
+		next(response, request.WithContext(ctx))
+	}
+}
+
+// requireRole only lets requests through whose session carries the given role,
+// answering 401 without a live session and 403 for any other role
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		preventCaching(response)
+		if getUserName(request) == "" || sessionExpired(request) {
+			httpError(response, request, http.StatusUnauthorized, errCodeUnauthenticated, "authentication required")
+			return
+		}
+		if getSessionRole(request) != role {
+			httpError(response, request, http.StatusForbidden, errCodeForbidden, "insufficient role")
+			return
+		}
+		next(response, request)
+	}
+}
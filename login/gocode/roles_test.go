@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireRoleDeniesUserAllowsAdmin(t *testing.T) {
+	gated := requireRole(roleAdmin, func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusOK)
+	})
+
+	testCases := []struct {
+		role       string
+		wantStatus int
+	}{
+		{roleUser, http.StatusForbidden},
+		{roleAdmin, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.role, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.AddCookie(sessionCookieFor(t, "someone", tc.role))
+			rr := httptest.NewRecorder()
+			gated(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Errorf("role %s: got status %d want %d", tc.role, rr.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireRoleWithoutSession(t *testing.T) {
+	gated := requireRole(roleAdmin, func(response http.ResponseWriter, request *http.Request) {
+		t.Error("handler should not be reached without a session")
+	})
+
+	rr := httptest.NewRecorder()
+	gated(rr, httptest.NewRequest("GET", "/admin", nil))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", rr.Code)
+	}
+}
+
+func TestGetSessionRoleDefaultsToUser(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(sessionCookieFor(t, "someone", ""))
+
+	if role := getSessionRole(req); role != roleUser {
+		t.Errorf("expected default role %s, got %s", roleUser, role)
+	}
+}
+
+func TestLookupRoleFromStore(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(
+		User{Username: "boss", Password: "secret", Role: roleAdmin},
+		User{Username: "bob", Password: "secret"},
+	))
+
+	if role := lookupRole(context.Background(), "boss"); role != roleAdmin {
+		t.Errorf("expected admin role, got %s", role)
+	}
+	if role := lookupRole(context.Background(), "bob"); role != roleUser {
+		t.Errorf("users without a role field should default to %s, got %s", roleUser, role)
+	}
+}
+
+func TestLoginStoresRoleAndInternalPageShowsIt(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "boss", Password: "secret", Role: roleAdmin}))
+	r := setupRouter()
+
+	form := url.Values{}
+	form.Add("name", "boss")
+	form.Add("password", "secret")
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("login should set a session cookie")
+	}
+
+	req = httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "Role: admin") {
+		t.Errorf("internal page should display the role, got %s", rr.Body.String())
+	}
+}
+
+func TestRequireAuthBlocksWithoutSession(t *testing.T) {
+	called := false
+	gated := requireAuth(func(response http.ResponseWriter, request *http.Request) {
+		called = true
+	})
+
+	testCases := []struct {
+		path       string
+		accept     string
+		wantStatus int
+	}{
+		{"/internal", "", http.StatusFound},
+		{"/internal", "application/json", http.StatusUnauthorized},
+		{"/api/me", "", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+		gated(rr, req)
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s (Accept %q): expected %d, got %d", tc.path, tc.accept, tc.wantStatus, rr.Code)
+		}
+	}
+	if called {
+		t.Error("the protected handler must not run without a session")
+	}
+}
+
+func TestRequireAuthPopulatesContext(t *testing.T) {
+	var seen string
+	gated := requireAuth(func(response http.ResponseWriter, request *http.Request) {
+		seen = authUser(request)
+	})
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleUser))
+	gated(httptest.NewRecorder(), req)
+	if seen != "bob" {
+		t.Errorf("expected bob in the request context, got %q", seen)
+	}
+}
+
+// useLandingPages sets LANDING_PAGES for the duration of a test
+func useLandingPages(t *testing.T, pages map[string]string) {
+	original := landingPages
+	landingPages = pages
+	t.Cleanup(func() { landingPages = original })
+}
+
+func TestLoginRedirectsToRoleLandingPage(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(
+		User{Username: "bob", Password: "secret"},
+		User{Username: "boss", Password: "secret", Role: roleAdmin},
+	))
+	useLandingPages(t, map[string]string{roleAdmin: "/users", roleUser: "/home"})
+
+	if location := postLogin("boss", "secret").Header().Get("Location"); location != "/users" {
+		t.Errorf("an admin should land on /users, got %q", location)
+	}
+	if location := postLogin("bob", "secret").Header().Get("Location"); location != "/home" {
+		t.Errorf("a user should land on /home, got %q", location)
+	}
+
+	// a valid next still takes precedence
+	form := url.Values{"name": {"boss"}, "password": {"secret"}, "next": {"/api/me"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	loginHandler(rr, req)
+	if location := rr.Header().Get("Location"); location != "/api/me" {
+		t.Errorf("next should win over the landing page, got %q", location)
+	}
+}
+
+func TestLandingPageDefaultsToInternal(t *testing.T) {
+	useLandingPages(t, map[string]string{roleAdmin: "/users"})
+	if page := landingPage(roleUser); page != "/internal" {
+		t.Errorf("roles without a landing page should go to /internal, got %q", page)
+	}
+}
+
+func TestParseLandingPages(t *testing.T) {
+	pages, err := parseLandingPages([]string{"admin=/users", " user = /home "})
+	if err != nil || pages[roleAdmin] != "/users" || pages[roleUser] != "/home" {
+		t.Errorf("unexpected landing pages %v (%v)", pages, err)
+	}
+	for _, entries := range [][]string{
+		{"admin"},
+		{"root=/users"},
+		{"admin=https://evil.example"},
+		{"user=//evil.example"},
+	} {
+		if _, err := parseLandingPages(entries); err == nil {
+			t.Errorf("%v should be rejected", entries)
+		}
+	}
+}
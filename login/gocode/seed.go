@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// seedUser is one entry of the SEED_USERS_FILE JSON array
+type seedUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// seedUsers are seeded instead of the single default user when SEED_USERS_FILE is set
+var seedUsers []seedUser
+
+// loadSeedUsers reads the JSON array of seed users at path, rejecting entries that
+// could not be seeded so a broken fixture fails at startup rather than half-applied
+func loadSeedUsers(path string) ([]seedUser, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []seedUser
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of users: %w", err)
+	}
+	for i, user := range users {
+		if normalizeUsername(user.Username) == "" || user.Password == "" {
+			return nil, fmt.Errorf("entry %d: username and password are required", i)
+		}
+		if user.Role == "" {
+			users[i].Role = roleUser
+		} else if !validRole(user.Role) {
+			return nil, fmt.Errorf("entry %d: unknown role %q", i, user.Role)
+		}
+	}
+	return users, nil
+}
+
+// upsertSeedUser creates name with role, or updates its password when it changed
+func upsertSeedUser(ctx context.Context, store UserStore, name string, pass string, role string) error {
+	normalized := normalizeUsername(name)
+	existing, err := store.FindUser(ctx, normalized)
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		return err
+	}
+	if existing != nil && passwordMatches(existing.Password, pass) {
+		// bcrypt salts every hash, so only rewrite it when the password changed
+		slog.Debug("seed user is up to date", "user", normalized)
+		return nil
+	}
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return err
+	}
+	return store.UpsertUser(ctx, User{Username: normalized, DisplayName: displayNameFor(name), Password: hash, Role: role})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSeedFile writes content to a temporary SEED_USERS_FILE and returns its path
+func writeSeedFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCreateUsersFromSeedFile(t *testing.T) {
+	original := seedUsers
+	t.Cleanup(func() { seedUsers = original })
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+
+	t.Setenv("SEED_USERS_FILE", writeSeedFile(t, `[
+		{"username":"alice","password":"alicepass1","role":"admin"},
+		{"username":"Bob","password":"bobpass1"},
+		{"username":"carol","password":"carolpass1","role":"user"}
+	]`))
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := createUsers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for name, role := range map[string]string{"alice": roleAdmin, "bob": roleUser, "carol": roleUser} {
+		user, err := store.FindUser(ctx, name)
+		if err != nil {
+			t.Errorf("%s should have been seeded: %v", name, err)
+			continue
+		}
+		if user.Role != role {
+			t.Errorf("%s: expected role %q, got %q", name, role, user.Role)
+		}
+		if !passwordMatches(user.Password, name+"pass1") || user.Password == name+"pass1" {
+			t.Errorf("%s: the password should be stored as a hash", name)
+		}
+	}
+	if _, err := store.FindUser(ctx, normalizeUsername(username)); err == nil {
+		t.Error("the default user should not be seeded alongside a seed file")
+	}
+}
+
+func TestLoadConfigRejectsMalformedSeedFile(t *testing.T) {
+	original := seedUsers
+	t.Cleanup(func() { seedUsers = original })
+
+	for name, content := range map[string]string{
+		"not json":         `{"username":`,
+		"not an array":     `{"username":"alice","password":"alicepass1"}`,
+		"missing password": `[{"username":"alice"}]`,
+		"unknown role":     `[{"username":"alice","password":"alicepass1","role":"root"}]`,
+	} {
+		t.Setenv("SEED_USERS_FILE", writeSeedFile(t, content))
+		if err := loadConfig(); err == nil {
+			t.Errorf("%s: a malformed seed file should be rejected at startup", name)
+		}
+	}
+
+	t.Setenv("SEED_USERS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if err := loadConfig(); err == nil {
+		t.Error("a missing seed file should be rejected at startup")
+	}
+}
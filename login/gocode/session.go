@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Session is what a session says about its user. Stores and cookies carry it as the flat
+// string map returned by values, so sessions issued before a field existed still decode.
+type Session struct {
+	Username string
+	Role     string
+	// Tenant is empty for sessions of the default database
+	Tenant string
+	Issued time.Time
+	// Expires is only set for JWT sessions; cookie sessions expire sessionTTL after Issued
+	Expires time.Time
+	// LoggedIn is when the user logged in; Issued moves on when the session is refreshed
+	LoggedIn   time.Time
+	RememberMe bool
+	// ID identifies the session in User.Sessions; only set while maxSessionsPerUser is positive
+	ID string
+}
+
+// values flattens the session into the map kept by session stores
+func (s Session) values() map[string]string {
+	values := map[string]string{
+		"name": s.Username,
+		"role": s.Role,
+	}
+	if !s.Issued.IsZero() {
+		values["issued"] = strconv.FormatInt(s.Issued.Unix(), 10)
+	}
+	if s.Tenant != "" {
+		values["tenant"] = s.Tenant
+	}
+	if !s.Expires.IsZero() {
+		values["expires"] = strconv.FormatInt(s.Expires.Unix(), 10)
+	}
+	if !s.LoggedIn.IsZero() {
+		values["login"] = strconv.FormatInt(s.LoggedIn.Unix(), 10)
+	}
+	if s.RememberMe {
+		values["remember"] = "true"
+	}
+	if s.ID != "" {
+		values["sid"] = s.ID
+	}
+	return values
+}
+
+// sessionFromValues parses the map written by Session.values, failing on malformed timestamps
+func sessionFromValues(values map[string]string) (Session, bool) {
+	session := Session{
+		Username:   values["name"],
+		Role:       values["role"],
+		Tenant:     values["tenant"],
+		RememberMe: values["remember"] == "true",
+		ID:         values["sid"],
+	}
+	for key, field := range map[string]*time.Time{"issued": &session.Issued, "expires": &session.Expires, "login": &session.LoggedIn} {
+		raw, ok := values[key]
+		if !ok {
+			continue
+		}
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return Session{}, false
+		}
+		*field = time.Unix(unix, 0)
+	}
+	if session.LoggedIn.IsZero() {
+		// sessions issued before refreshing existed were never refreshed
+		session.LoggedIn = session.Issued
+	}
+	return session, true
+}
+
+// expiry is when the session expires, false when it carries no timestamp to tell
+func (s Session) expiry() (time.Time, bool) {
+	if !s.Expires.IsZero() {
+		return s.Expires, true
+	}
+	if s.Issued.IsZero() {
+		return time.Time{}, false
+	}
+	return s.Issued.Add(sessionTTL), true
+}
+
+// SessionStore keeps the values of cookie sessions. The session cookie carries whatever
+// Save returns: the encoded values themselves, or just an ID for server-side stores.
+type SessionStore interface {
+	// Save stores the values of a new session and returns the cookie value for it
+	Save(values map[string]string) (string, error)
+	// Load returns the values behind a cookie value, or nil when it is unknown or invalid
+	Load(cookieValue string) map[string]string
+	// Delete ends the session behind a cookie value; unknown values are ignored
+	Delete(cookieValue string)
+}
+
+// session backends selected by SESSION_BACKEND
+const (
+	sessionBackendCookie = "cookie"
+	sessionBackendMemory = "memory"
+	sessionBackendRedis  = "redis"
+)
+
+// sessionStore holds the sessions of cookie auth mode (JWT sessions are self-contained)
+var sessionStore SessionStore = cookieSessionStore{}
+
+// cookieSessionStore keeps the session values in the cookie itself, signed and
+// encrypted with cookieCodecs; sessions can't be revoked before they expire
+type cookieSessionStore struct{}
+
+func (cookieSessionStore) Save(values map[string]string) (string, error) {
+	return securecookie.EncodeMulti(sessionCookieName, values, cookieCodecs[:1]...)
+}
+
+func (cookieSessionStore) Load(cookieValue string) map[string]string {
+	values := make(map[string]string)
+	if err := securecookie.DecodeMulti(sessionCookieName, cookieValue, &values, cookieCodecs...); err != nil {
+		return nil
+	}
+	return values
+}
+
+func (cookieSessionStore) Delete(string) {}
+
+// memorySession is a session held by memorySessionStore
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// memorySessionStore keeps sessions in process memory under random IDs. Sessions are lost
+// on restart and not shared between instances, but logout revokes them immediately.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession)}
+}
+
+// newSessionID returns a random, URL-safe ID for server-side sessions
+func newSessionID() (string, error) {
+	key := securecookie.GenerateRandomKey(32)
+	if key == nil {
+		return "", errors.New("failed to generate a session ID")
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func (s *memorySessionStore) Save(values map[string]string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+
+	now := clock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.sessions[id] = memorySession{values: copied, expires: now.Add(sessionTTL + sessionGracePeriod)}
+	return id, nil
+}
+
+func (s *memorySessionStore) Load(cookieValue string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[cookieValue]
+	if !ok || !clock().Before(session.expires) {
+		return nil
+	}
+	copied := make(map[string]string, len(session.values))
+	for k, v := range session.values {
+		copied[k] = v
+	}
+	return copied
+}
+
+func (s *memorySessionStore) Delete(cookieValue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, cookieValue)
+}
+
+// prune drops expired sessions once there are enough to be worth a sweep; callers hold s.mu
+func (s *memorySessionStore) prune(now time.Time) {
+	if len(s.sessions) < 1024 {
+		return
+	}
+	for id, session := range s.sessions {
+		if !now.Before(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// sliding expiration: when enabled, cookie sessions used within sessionRefreshWindow of
+// their expiry are re-issued with a fresh sessionTTL, but never past sessionMaxLifetime
+// after login. A zero refresh window means half of sessionTTL.
+var slidingSessions = false
+var sessionRefreshWindow time.Duration
+var sessionMaxLifetime = 7 * 24 * time.Hour
+
+// refreshWindow is the effective sessionRefreshWindow
+func refreshWindow() time.Duration {
+	if sessionRefreshWindow > 0 {
+		return sessionRefreshWindow
+	}
+	return sessionTTL / 2
+}
+
+// refreshedSession returns session re-issued at now when it is due for a refresh that
+// the absolute lifetime still allows
+func refreshedSession(session Session, now time.Time) (Session, bool) {
+	expiry, ok := session.expiry()
+	if !ok || !session.Expires.IsZero() || !now.Before(expiry) || expiry.Sub(now) > refreshWindow() {
+		return session, false
+	}
+	if now.Add(sessionTTL).After(session.LoggedIn.Add(sessionMaxLifetime)) {
+		return session, false
+	}
+	session.Issued = now
+	return session, true
+}
+
+// slidingSessionMiddleware refreshes sessions nearing their expiry (see slidingSessions).
+// The old session is left to expire on its own, so the request itself and any running
+// in parallel with it still see it.
+func slidingSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if slidingSessions && authMode != authModeJWT {
+			if session, ok := getSession(request); ok {
+				if refreshed, due := refreshedSession(session, clock()); due {
+					if err := saveSession(refreshed, response); err != nil {
+						// the current session stays valid until it expires
+						requestLogger(request.Context()).Warn("failed to refresh session", "error", err)
+					}
+				}
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// maxSessionsPerUser (MAX_SESSIONS_PER_USER) caps the cookie sessions a user holds at
+// once: logging in beyond it ends the oldest. Zero allows any number. JWT sessions are
+// self-contained and not counted.
+var maxSessionsPerUser = 0
+
+// sessionRevokedKey marks requests whose session was ended since it was issued
+type sessionRevokedKey struct{}
+
+// sessionRevoked reports whether activeSessionMiddleware ended the request's session
+func sessionRevoked(request *http.Request) bool {
+	revoked, _ := request.Context().Value(sessionRevokedKey{}).(bool)
+	return revoked
+}
+
+// newLimitedSessionID returns an ID for a new cookie session when sessions are counted,
+// "" otherwise
+func newLimitedSessionID() string {
+	if maxSessionsPerUser <= 0 || authMode == authModeJWT {
+		return ""
+	}
+	id, err := newSessionID()
+	if err != nil {
+		slog.Error("failed to generate a session ID", "error", err)
+		return ""
+	}
+	return id
+}
+
+// registerSession records a new session of username, pushing its oldest sessions past
+// maxSessionsPerUser out of User.Sessions
+func registerSession(ctx context.Context, username string, sessionID string) {
+	store := currentUserStore()
+	if sessionID == "" || store == nil {
+		return
+	}
+	if err := store.AddSession(ctx, username, sessionID, maxSessionsPerUser); err != nil && !errors.Is(err, errUserNotFound) {
+		requestLogger(ctx).Warn("failed to record session", "user", username, "error", err)
+	}
+}
+
+// revokedBy reports whether user's current state ends session: the account was disabled,
+// its role changed, or ClearSessions ended its sessions since session logged in
+func (s Session) revokedBy(user *User) bool {
+	role := s.Role
+	if role == "" {
+		role = roleUser
+	}
+	if !user.isEnabled() || user.roleOrDefault() != role {
+		return true
+	}
+	// sessions keep whole seconds, so one renewed right after ClearSessions isn't older
+	return s.LoggedIn.Before(user.SessionsNotBefore.Truncate(time.Second))
+}
+
+// activeSession reports whether session's user still exists and hasn't revoked it (see
+// revokedBy), and while sessions are counted, whether the session is still among the
+// user's sessions. Sessions issued before the limit was enabled carry no ID and aren't
+// counted; all sessions stay valid while the store can't be asked.
+func activeSession(ctx context.Context, session Session) bool {
+	store := currentUserStore()
+	if store == nil {
+		return true
+	}
+	user, err := store.FindUser(ctx, session.Username)
+	if errors.Is(err, errUserNotFound) {
+		return false
+	}
+	if err != nil {
+		requestLogger(ctx).Warn("failed to check session", "user", session.Username, "error", err)
+		return true
+	}
+	if session.revokedBy(user) {
+		return false
+	}
+	if session.ID == "" || maxSessionsPerUser <= 0 || authMode == authModeJWT {
+		return true
+	}
+	for _, id := range user.Sessions {
+		if id == session.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// activeSessionMiddleware ends sessions that were revoked since they were issued (see
+// activeSession): it clears their cookie and the rest of the request sees no session
+func activeSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if session, ok := getSession(request); ok && !activeSession(request.Context(), session) {
+			destroySession(response, request)
+			request = request.WithContext(context.WithValue(request.Context(), sessionRevokedKey{}, true))
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// renewSession replaces the request's session with a new one for the same user and role,
+// logged in now, so it outlives a ClearSessions ending the user's other sessions
+func renewSession(response http.ResponseWriter, request *http.Request) error {
+	ctx := request.Context()
+	userName, role := getUserName(request), getSessionRole(request)
+	if authMode == authModeJWT {
+		_, err := setTokenSession(tenantFrom(ctx), userName, role, response)
+		return err
+	}
+	if cookie, err := request.Cookie(sessionCookieName); err == nil {
+		sessionStore.Delete(cookie.Value)
+	}
+	sessionID, err := setTenantSession(tenantFrom(ctx), userName, role, response)
+	if err != nil {
+		return err
+	}
+	registerSession(ctx, userName, sessionID)
+	return nil
+}
+
+// destroySession deletes the request's session from the store and clears the cookie
+func destroySession(response http.ResponseWriter, request *http.Request) {
+	if cookie, err := request.Cookie(sessionCookieName); err == nil && authMode != authModeJWT {
+		sessionStore.Delete(cookie.Value)
+	}
+	clearSession(response)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useSessionStore swaps the session store for the duration of a test
+func useSessionStore(t *testing.T, store SessionStore) {
+	original := sessionStore
+	sessionStore = store
+	t.Cleanup(func() { sessionStore = original })
+}
+
+var (
+	_ SessionStore = cookieSessionStore{}
+	_ SessionStore = (*memorySessionStore)(nil)
+)
+
+func TestSessionStoresRoundTripUsername(t *testing.T) {
+	for name, store := range map[string]SessionStore{
+		"cookie": cookieSessionStore{},
+		"memory": newMemorySessionStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			useSessionStore(t, store)
+
+			cookie := sessionCookieFor(t, "bob", roleUser)
+			req := httptest.NewRequest("GET", "/internal", nil)
+			req.AddCookie(cookie)
+			if got := getUserName(req); got != "bob" {
+				t.Errorf("expected bob from the %s store, got %q", name, got)
+			}
+
+			if store.Load("not-a-session") != nil {
+				t.Error("an unknown cookie value should not load a session")
+			}
+		})
+	}
+}
+
+func TestMemorySessionCookieHoldsOnlyID(t *testing.T) {
+	store := newMemorySessionStore()
+	useSessionStore(t, store)
+
+	cookie := sessionCookieFor(t, "bob", roleAdmin)
+	if len(cookie.Value) != 43 {
+		t.Errorf("the cookie should carry a 32 byte ID, got %q", cookie.Value)
+	}
+	if values := store.Load(cookie.Value); values["name"] != "bob" || values["role"] != roleAdmin {
+		t.Errorf("the session values should be kept server-side, got %v", values)
+	}
+}
+
+func TestLogoutRevokesMemorySession(t *testing.T) {
+	useSessionStore(t, newMemorySessionStore())
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	logout := httptest.NewRequest("POST", "/logout", nil)
+	logout.AddCookie(cookie)
+	setupRouter().ServeHTTP(httptest.NewRecorder(), logout)
+
+	// replaying the old cookie no longer works once the session is deleted
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	if rr.Code == http.StatusOK {
+		t.Error("a logged out session should be rejected")
+	}
+}
+
+func TestMemorySessionExpires(t *testing.T) {
+	fake := useFakeClock(t)
+	store := newMemorySessionStore()
+	useSessionStore(t, store)
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	fake.Advance(sessionTTL + sessionGracePeriod)
+	if store.Load(cookie.Value) != nil {
+		t.Error("the session should be gone after sessionTTL")
+	}
+}
+
+func TestLoadConfigSessionBackend(t *testing.T) {
+	useSessionStore(t, sessionStore)
+
+	t.Setenv("SESSION_BACKEND", "memory")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if _, ok := sessionStore.(*memorySessionStore); !ok {
+		t.Errorf("SESSION_BACKEND=memory should select the memory store, got %T", sessionStore)
+	}
+
+	t.Setenv("SESSION_BACKEND", "disk")
+	if err := loadConfig(); err == nil {
+		t.Error("an unknown SESSION_BACKEND should be rejected")
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	useSessionStore(t, cookieSessionStore{})
+	issued := time.Unix(1700000000, 0)
+	session := Session{Username: "bob", Role: roleAdmin, Tenant: "acme", Issued: issued, LoggedIn: issued.Add(-time.Hour), RememberMe: true}
+
+	encoded, err := sessionStore.Save(session.values())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := sessionFromValues(sessionStore.Load(encoded))
+	if !ok || decoded != session {
+		t.Errorf("expected %+v to round-trip, got %+v (ok=%v)", session, decoded, ok)
+	}
+	if expiry, _ := decoded.expiry(); !expiry.Equal(issued.Add(sessionTTL)) {
+		t.Errorf("expected the session to expire sessionTTL after it was issued, got %v", expiry)
+	}
+
+	tampered := []byte(encoded)
+	tampered[len(tampered)/2] ^= 1
+	if values := sessionStore.Load(string(tampered)); values != nil {
+		t.Errorf("a tampered cookie should not decode, got %v", values)
+	}
+}
+
+func TestGetSessionFromCookie(t *testing.T) {
+	useSessionStore(t, cookieSessionStore{})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(sessionCookieFor(t, "bob", roleAdmin))
+
+	session, ok := getSession(req)
+	if !ok || session.Username != "bob" || session.Role != roleAdmin || session.Issued.IsZero() {
+		t.Errorf("unexpected session %+v (ok=%v)", session, ok)
+	}
+	if getUserName(req) != "bob" {
+		t.Errorf("getUserName should read the session username, got %q", getUserName(req))
+	}
+
+	cookie := sessionCookieFor(t, "bob", roleAdmin)
+	cookie.Value = cookie.Value[:len(cookie.Value)-2] + "xx"
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	if _, ok := getSession(req); ok {
+		t.Error("a tampered cookie should not yield a session")
+	}
+}
+
+// useSlidingSessions enables sliding expiration with the given lifetimes
+func useSlidingSessions(t *testing.T, ttl time.Duration, window time.Duration, maxLifetime time.Duration) {
+	originalSliding, originalTTL, originalWindow, originalMax := slidingSessions, sessionTTL, sessionRefreshWindow, sessionMaxLifetime
+	t.Cleanup(func() {
+		slidingSessions, sessionTTL, sessionRefreshWindow, sessionMaxLifetime = originalSliding, originalTTL, originalWindow, originalMax
+	})
+	slidingSessions, sessionTTL, sessionRefreshWindow, sessionMaxLifetime = true, ttl, window, maxLifetime
+}
+
+// visitInternal requests /internal with cookie, returning the refreshed session cookie if any
+func visitInternal(t *testing.T, cookie *http.Cookie) (int, *http.Cookie) {
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	for _, refreshed := range rr.Result().Cookies() {
+		if refreshed.Name == sessionCookieName && refreshed.MaxAge > 0 {
+			return rr.Code, refreshed
+		}
+	}
+	return rr.Code, nil
+}
+
+func TestSlidingSessionRefreshesNearExpiry(t *testing.T) {
+	useSessionStore(t, cookieSessionStore{})
+	useSlidingSessions(t, time.Hour, 10*time.Minute, 24*time.Hour)
+	fake := useFakeClock(t)
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	fake.Advance(30 * time.Minute)
+	if _, refreshed := visitInternal(t, cookie); refreshed != nil {
+		t.Error("a session far from its expiry should not be refreshed")
+	}
+
+	fake.Advance(25 * time.Minute)
+	code, refreshed := visitInternal(t, cookie)
+	if code != http.StatusOK || refreshed == nil {
+		t.Fatalf("a session within the refresh window should be refreshed, got %d", code)
+	}
+
+	// the original session would have expired by now, the refreshed one is still valid
+	fake.Advance(30 * time.Minute)
+	if code, _ := visitInternal(t, cookie); code == http.StatusOK {
+		t.Error("the original session should have expired")
+	}
+	if code, _ := visitInternal(t, refreshed); code != http.StatusOK {
+		t.Errorf("the refreshed session should still be valid, got %d", code)
+	}
+}
+
+func TestSlidingSessionCappedByMaxLifetime(t *testing.T) {
+	useSessionStore(t, cookieSessionStore{})
+	useSlidingSessions(t, time.Hour, 10*time.Minute, 2*time.Hour)
+	fake := useFakeClock(t)
+	cookie := sessionCookieFor(t, "bob", roleUser)
+
+	// refreshed at 55 minutes to expire at 1h55, within the 2h cap
+	fake.Advance(55 * time.Minute)
+	_, refreshed := visitInternal(t, cookie)
+	if refreshed == nil {
+		t.Fatal("a session within its maximum lifetime should be refreshed")
+	}
+
+	// another refresh would run to 2h50, past the cap
+	fake.Advance(55 * time.Minute)
+	if _, again := visitInternal(t, refreshed); again != nil {
+		t.Error("a session should not be refreshed past its maximum lifetime")
+	}
+	fake.Advance(10 * time.Minute)
+	if code, _ := visitInternal(t, refreshed); code == http.StatusOK {
+		t.Error("the session should expire at the end of its last refresh")
+	}
+}
+
+// limitSessions sets MAX_SESSIONS_PER_USER for the duration of a test
+func limitSessions(t *testing.T, limit int) {
+	original := maxSessionsPerUser
+	maxSessionsPerUser = limit
+	t.Cleanup(func() { maxSessionsPerUser = original })
+}
+
+func TestSecondLoginEndsFirstSessionAtLimitOne(t *testing.T) {
+	limitSessions(t, 1)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+
+	first := app.loginCookie("bob", "secret")
+	if rr := app.get("/internal", first); rr.Code != http.StatusOK {
+		t.Fatalf("expected the first session to work before the second login, got %d", rr.Code)
+	}
+	second := app.loginCookie("bob", "secret")
+
+	rr := app.get("/internal", first)
+	if rr.Code != http.StatusFound {
+		t.Errorf("expected the first session to be ended by the second login, got %d", rr.Code)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) == 0 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the ended session's cookie to be cleared, got %v", cookies)
+	}
+	if rr := app.get("/internal", second); rr.Code != http.StatusOK {
+		t.Errorf("expected the second session to work, got %d", rr.Code)
+	}
+}
+
+func TestSessionLimitKeepsNewestSessions(t *testing.T) {
+	limitSessions(t, 2)
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+
+	cookies := []*http.Cookie{app.loginCookie("bob", "secret"), app.loginCookie("bob", "secret"), app.loginCookie("bob", "secret")}
+	for i, want := range []int{http.StatusFound, http.StatusOK, http.StatusOK} {
+		if rr := app.get("/internal", cookies[i]); rr.Code != want {
+			t.Errorf("session %d: expected %d, got %d", i+1, want, rr.Code)
+		}
+	}
+	if user, _ := app.store.FindUser(context.Background(), "bob"); len(user.Sessions) != 2 {
+		t.Errorf("expected two sessions on record, got %v", user.Sessions)
+	}
+}
+
+func TestUnlimitedSessionsCarryNoID(t *testing.T) {
+	app := newTestApp(t, User{Username: "bob", Password: "secret"})
+
+	first := app.loginCookie("bob", "secret")
+	app.loginCookie("bob", "secret")
+	if rr := app.get("/internal", first); rr.Code != http.StatusOK {
+		t.Errorf("expected sessions to be unlimited by default, got %d", rr.Code)
+	}
+	if user, _ := app.store.FindUser(context.Background(), "bob"); len(user.Sessions) != 0 {
+		t.Errorf("expected no sessions on record, got %v", user.Sessions)
+	}
+}
+
+// failingSessionStore can't save sessions, like a session backend that went away
+type failingSessionStore struct {
+	cookieSessionStore
+}
+
+func (failingSessionStore) Save(map[string]string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestLoginFailsWhenSessionCannotBeSaved(t *testing.T) {
+	freshLoginThrottle(t)
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+	useSessionStore(t, failingSessionStore{})
+
+	rr := postLogin("bob", "secret")
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when the session can't be saved, got %d", rr.Code)
+	}
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			t.Error("no session cookie should be set")
+		}
+	}
+}
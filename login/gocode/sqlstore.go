@@ -0,0 +1,349 @@
+//go:build sqlstore
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqlUsersSchema creates the users table of sqlUserStore. It sticks to SQL that Postgres
+// and SQLite share: times are Unix seconds (0 for none), enabled is NULL for users that
+// were never disabled or enabled, and sessions are newline separated.
+const sqlUsersSchema = `CREATE TABLE IF NOT EXISTS users (
+	username            VARCHAR(255) PRIMARY KEY,
+	display_name        VARCHAR(255) NOT NULL DEFAULT '',
+	password            VARCHAR(255) NOT NULL,
+	role                VARCHAR(32)  NOT NULL DEFAULT '',
+	email               VARCHAR(255) UNIQUE,
+	failed_attempts     INTEGER      NOT NULL DEFAULT 0,
+	locked_until        BIGINT       NOT NULL DEFAULT 0,
+	reset_token_hash    VARCHAR(64)  NOT NULL DEFAULT '',
+	reset_token_expires BIGINT       NOT NULL DEFAULT 0,
+	enabled             SMALLINT,
+	sessions            TEXT         NOT NULL DEFAULT '',
+	sessions_not_before BIGINT       NOT NULL DEFAULT 0,
+	oidc_subject        VARCHAR(255) NOT NULL DEFAULT ''
+)`
+
+// sqlUserColumns are the columns scanned by findOne, in order
+const sqlUserColumns = `username, display_name, password, role, email, failed_attempts, locked_until,
+	reset_token_hash, reset_token_expires, enabled, sessions, sessions_not_before, oidc_subject`
+
+// sqlUserStore is the UserStore kept in the users table of a database/sql database,
+// selected with STORE_BACKEND=sql
+type sqlUserStore struct {
+	db *sql.DB
+}
+
+// openSQLUserStore connects to dsn with the database/sql driver named driver, which has
+// to be compiled in (see sqlstore_postgres.go and sqlstore_sqlite.go), and creates the
+// users table unless ensureIndexes is off
+func openSQLUserStore(driver string, dsn string) (UserStore, error) {
+	if dsn == "" {
+		return nil, errors.New("SQL_DSN is required")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if ensureIndexes {
+		if _, err := db.ExecContext(ctx, sqlUsersSchema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating the users table: %w", err)
+		}
+	}
+	return &sqlUserStore{db: db}, nil
+}
+
+// sqlQueryer is what sqlUserStore needs of a *sql.DB or *sql.Tx
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// unixTime and fromUnix convert between time.Time and the stored Unix seconds
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// nullableEmail stores missing emails as NULL, which the unique constraint ignores
+func nullableEmail(email string) sql.NullString {
+	return sql.NullString{String: email, Valid: email != ""}
+}
+
+// findOne returns the user where column equals value, or errUserNotFound
+func (s *sqlUserStore) findOne(ctx context.Context, q sqlQueryer, column string, value string) (*User, error) {
+	defer trackDBOp()()
+	var user User
+	var email sql.NullString
+	var lockedUntil, resetExpires, sessionsNotBefore int64
+	var enabled sql.NullInt64
+	var sessions string
+	err := q.QueryRowContext(ctx, "SELECT "+sqlUserColumns+" FROM users WHERE "+column+" = $1", value).Scan(
+		&user.Username, &user.DisplayName, &user.Password, &user.Role, &email, &user.FailedAttempts,
+		&lockedUntil, &user.ResetTokenHash, &resetExpires, &enabled, &sessions, &sessionsNotBefore, &user.OIDCSubject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.Email = email.String
+	user.LockedUntil = fromUnix(lockedUntil)
+	user.ResetTokenExpires = fromUnix(resetExpires)
+	user.SessionsNotBefore = fromUnix(sessionsNotBefore)
+	if enabled.Valid {
+		isEnabled := enabled.Int64 != 0
+		user.Enabled = &isEnabled
+	}
+	if sessions != "" {
+		user.Sessions = strings.Split(sessions, "\n")
+	}
+	return &user, nil
+}
+
+func (s *sqlUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	return s.findOne(ctx, s.db, "username", username)
+}
+
+func (s *sqlUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findOne(ctx, s.db, "email", email)
+}
+
+func (s *sqlUserStore) FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error) {
+	if tokenHash == "" {
+		return nil, errUserNotFound
+	}
+	return s.findOne(ctx, s.db, "reset_token_hash", tokenHash)
+}
+
+func (s *sqlUserStore) ListUsernames(ctx context.Context) ([]string, error) {
+	defer trackDBOp()()
+	return s.usernames(ctx, "SELECT username FROM users ORDER BY username")
+}
+
+func (s *sqlUserStore) ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error) {
+	defer trackDBOp()()
+	var total int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if limit == 0 || offset >= total {
+		return []string{}, total, nil
+	}
+	usernames, err := s.usernames(ctx, "SELECT username FROM users ORDER BY username LIMIT $1 OFFSET $2", limit, offset)
+	return usernames, total, err
+}
+
+// usernames runs a query selecting usernames
+func (s *sqlUserStore) usernames(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, name)
+	}
+	return usernames, rows.Err()
+}
+
+// inTx runs fn in a transaction, committing when it succeeds
+func (s *sqlUserStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlUserStore) CreateUser(ctx context.Context, user User) error {
+	defer trackDBOp()()
+	// drivers word unique violations differently, so duplicates are looked up first; the
+	// constraints still catch concurrent inserts, reported as plain errors
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := s.findOne(ctx, tx, "username", user.Username); !errors.Is(err, errUserNotFound) {
+			if err == nil {
+				return errDuplicateUser
+			}
+			return err
+		}
+		if user.Email != "" {
+			if _, err := s.findOne(ctx, tx, "email", user.Email); !errors.Is(err, errUserNotFound) {
+				if err == nil {
+					return errDuplicateEmail
+				}
+				return err
+			}
+		}
+		var enabled sql.NullInt64
+		if user.Enabled != nil {
+			enabled = sql.NullInt64{Int64: boolInt(*user.Enabled), Valid: true}
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO users (username, display_name, password, role, email,
+			failed_attempts, locked_until, reset_token_hash, reset_token_expires, enabled, sessions, oidc_subject)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			user.Username, user.DisplayName, user.Password, user.Role, nullableEmail(user.Email),
+			user.FailedAttempts, unixTime(user.LockedUntil), user.ResetTokenHash, unixTime(user.ResetTokenExpires),
+			enabled, strings.Join(user.Sessions, "\n"), user.OIDCSubject)
+		return err
+	})
+}
+
+func (s *sqlUserStore) UpsertUser(ctx context.Context, user User) error {
+	defer trackDBOp()()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (username, display_name, password, role)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET password = excluded.password`,
+		user.Username, user.DisplayName, user.Password, user.Role)
+	return err
+}
+
+// boolInt stores a bool in an integer column
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// update runs an UPDATE of the user's row, returning errUserNotFound when there is none
+func (s *sqlUserStore) update(ctx context.Context, q sqlQueryer, username string, set string, args ...interface{}) error {
+	args = append(args, username)
+	result, err := q.ExecContext(ctx, fmt.Sprintf("UPDATE users SET %s WHERE username = $%d", set, len(args)), args...)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *sqlUserStore) UpdatePassword(ctx context.Context, username string, passwordHash string) error {
+	defer trackDBOp()()
+	return s.update(ctx, s.db, username, "password = $1", passwordHash)
+}
+
+func (s *sqlUserStore) UpdateRole(ctx context.Context, username string, role string) error {
+	defer trackDBOp()()
+	return s.update(ctx, s.db, username, "role = $1", role)
+}
+
+func (s *sqlUserStore) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	defer trackDBOp()()
+	return s.update(ctx, s.db, username, "enabled = $1", boolInt(enabled))
+}
+
+func (s *sqlUserStore) LinkOIDCSubject(ctx context.Context, username string, subject string) error {
+	defer trackDBOp()()
+	return s.update(ctx, s.db, username, "oidc_subject = $1", subject)
+}
+
+func (s *sqlUserStore) DeleteUser(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	result, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *sqlUserStore) RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error) {
+	defer trackDBOp()()
+	locked := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.update(ctx, tx, username, "failed_attempts = failed_attempts + 1"); err != nil {
+			return err
+		}
+		var attempts int
+		if err := tx.QueryRowContext(ctx, "SELECT failed_attempts FROM users WHERE username = $1", username).Scan(&attempts); err != nil {
+			return err
+		}
+		if maxAttempts <= 0 || attempts < maxAttempts {
+			return nil
+		}
+		locked = true
+		return s.update(ctx, tx, username, "failed_attempts = 0, locked_until = $1", unixTime(clock().Add(lockFor)))
+	})
+	return locked && err == nil, err
+}
+
+func (s *sqlUserStore) ClearFailedLogins(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	err := s.update(ctx, s.db, username, "failed_attempts = 0, locked_until = 0")
+	if errors.Is(err, errUserNotFound) {
+		// like MongoDB's UpdateOne, clearing an unknown user is not an error
+		return nil
+	}
+	return err
+}
+
+func (s *sqlUserStore) SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error {
+	defer trackDBOp()()
+	if tokenHash == "" {
+		expires = time.Time{}
+	}
+	return s.update(ctx, s.db, username, "reset_token_hash = $1, reset_token_expires = $2", tokenHash, unixTime(expires))
+}
+
+func (s *sqlUserStore) AddSession(ctx context.Context, username string, sessionID string, keep int) error {
+	defer trackDBOp()()
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		user, err := s.findOne(ctx, tx, "username", username)
+		if err != nil {
+			return err
+		}
+		sessions := append(user.Sessions, sessionID)
+		if len(sessions) > keep {
+			sessions = sessions[len(sessions)-keep:]
+		}
+		return s.update(ctx, tx, username, "sessions = $1", strings.Join(sessions, "\n"))
+	})
+}
+
+func (s *sqlUserStore) ClearSessions(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	return s.update(ctx, s.db, username, "sessions = '', sessions_not_before = $1", unixTime(clock()))
+}
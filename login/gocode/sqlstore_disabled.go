@@ -0,0 +1,10 @@
+//go:build !sqlstore
+
+package main
+
+import "errors"
+
+// openSQLUserStore stands in for the SQL store in builds without the sqlstore tag
+func openSQLUserStore(driver string, dsn string) (UserStore, error) {
+	return nil, errors.New("this build has no SQL support, rebuild with -tags sqlstore")
+}
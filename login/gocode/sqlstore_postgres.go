@@ -0,0 +1,6 @@
+//go:build sqlstore && postgres
+
+package main
+
+// registers the "postgres" database/sql driver for SQL_DRIVER=postgres
+import _ "github.com/lib/pq"
@@ -0,0 +1,6 @@
+//go:build sqlstore && sqlite
+
+package main
+
+// registers the pure Go "sqlite" database/sql driver for SQL_DRIVER=sqlite
+import _ "modernc.org/sqlite"
@@ -0,0 +1,115 @@
+//go:build sqlstore && sqlite
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useSQLiteUserStore makes an in-memory SQLite database the user store
+func useSQLiteUserStore(t *testing.T) *sqlUserStore {
+	store, err := openSQLUserStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening SQLite: %v", err)
+	}
+	sqlStore := store.(*sqlUserStore)
+	// every connection would get its own empty in-memory database
+	sqlStore.db.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlStore.db.Close() })
+	useMemoryUserStore(t, sqlStore)
+	return sqlStore
+}
+
+func TestSQLUserStoreCreateAndVerify(t *testing.T) {
+	store := useSQLiteUserStore(t)
+	ctx := context.Background()
+
+	hash, err := hashPassword("secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "bob", Password: hash, Role: roleUser, Email: "bob@example.com"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if !verifyCredentials(ctx, "bob", "secret1") {
+		t.Error("bob should log in with his password")
+	}
+	if verifyCredentials(ctx, "bob", "wrong1") {
+		t.Error("a wrong password should be rejected")
+	}
+
+	if err := store.CreateUser(ctx, User{Username: "bob", Password: hash}); !errors.Is(err, errDuplicateUser) {
+		t.Errorf("expected errDuplicateUser, got %v", err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "carol", Password: hash, Email: "bob@example.com"}); !errors.Is(err, errDuplicateEmail) {
+		t.Errorf("expected errDuplicateEmail, got %v", err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "dave", Password: hash}); err != nil {
+		t.Errorf("users without an email should not collide: %v", err)
+	}
+	if user, err := store.FindUserByEmail(ctx, "bob@example.com"); err != nil || user.Username != "bob" {
+		t.Errorf("expected to find bob by email, got %v, %v", user, err)
+	}
+	if usernames, total, err := store.ListUsernamesPage(ctx, 1, 10); err != nil || total != 2 || len(usernames) != 1 || usernames[0] != "dave" {
+		t.Errorf("expected the second page to hold dave of 2 users, got %v of %d, %v", usernames, total, err)
+	}
+}
+
+func TestSQLUserStoreUpdates(t *testing.T) {
+	store := useSQLiteUserStore(t)
+	ctx := context.Background()
+	if err := store.UpsertUser(ctx, User{Username: "bob", Password: "first", Role: roleUser}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpsertUser(ctx, User{Username: "bob", Password: "second", Role: roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindUser(ctx, "bob"); user.Password != "second" || user.Role != roleUser {
+		t.Errorf("upserting should replace the password and keep the role, got %q/%q", user.Password, user.Role)
+	}
+
+	if err := store.SetEnabled(ctx, "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindUser(ctx, "bob"); user.isEnabled() {
+		t.Error("bob should be disabled")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := store.AddSession(ctx, "bob", string(rune('a'+i)), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if user, _ := store.FindUser(ctx, "bob"); len(user.Sessions) != 2 || user.Sessions[0] != "b" {
+		t.Errorf("expected the two newest sessions, got %v", user.Sessions)
+	}
+	if err := store.ClearSessions(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindUser(ctx, "bob"); len(user.Sessions) != 0 || user.SessionsNotBefore.IsZero() {
+		t.Errorf("expected the sessions to be ended, got %v since %v", user.Sessions, user.SessionsNotBefore)
+	}
+
+	if locked, err := store.RecordFailedLogin(ctx, "bob", 2, time.Minute); err != nil || locked {
+		t.Fatalf("the first failure should not lock, got %v, %v", locked, err)
+	}
+	if locked, err := store.RecordFailedLogin(ctx, "bob", 2, time.Minute); err != nil || !locked {
+		t.Fatalf("the second failure should lock, got %v, %v", locked, err)
+	}
+	if user, _ := store.FindUser(ctx, "bob"); !user.LockedUntil.After(time.Now()) {
+		t.Errorf("expected bob to be locked, got %v", user.LockedUntil)
+	}
+
+	if err := store.UpdatePassword(ctx, "nobody", "x"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("expected errUserNotFound, got %v", err)
+	}
+	if err := store.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindUser(ctx, "bob"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("expected bob to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// staticFiles holds the CSS/JS assets served under /static/
+//
+//go:embed static
+var staticFiles embed.FS
+
+// fileOnlyFS hides directories so http.FileServer can't list them
+type fileOnlyFS struct {
+	http.FileSystem
+}
+
+func (f fileOnlyFS) Open(name string) (http.File, error) {
+	file, err := f.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
+
+// staticHandler serves the embedded assets under /static/, answering 404 for directories
+func staticHandler() http.Handler {
+	assets, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(fileOnlyFS{http.FS(assets)}))
+}
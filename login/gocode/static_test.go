@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getStatic(path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	return rr
+}
+
+func TestStaticServesEmbeddedAsset(t *testing.T) {
+	rr := getStatic("/static/style.css")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", got)
+	}
+	if !strings.Contains(rr.Body.String(), "font-family") {
+		t.Error("body should be the embedded stylesheet")
+	}
+}
+
+func TestStaticMissingAssetIs404(t *testing.T) {
+	if rr := getStatic("/static/missing.js"); rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rr.Code)
+	}
+}
+
+func TestStaticDoesNotListDirectories(t *testing.T) {
+	rr := getStatic("/static/")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "style.css") {
+		t.Error("GET /static/ listed the directory")
+	}
+}
+
+func TestLoginPageLinksStylesheet(t *testing.T) {
+	rr := httptest.NewRecorder()
+	indexPageHandler(rr, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rr.Body.String(), `href="/static/style.css"`) {
+		t.Error("login page should reference the embedded stylesheet")
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// User is a user document as stored in the users collection
+type User struct {
+	// Username is stored normalized (see normalizeUsername); DisplayName keeps the
+	// original spelling when normalizing changed it
+	Username    string `bson:"username"`
+	DisplayName string `bson:"display_name,omitempty"`
+	Password    string `bson:"password"`
+	Role        string `bson:"role,omitempty"`
+	Email       string `bson:"email,omitempty"`
+	// FailedAttempts and LockedUntil persist the login lockout across restarts and instances
+	FailedAttempts int       `bson:"failed_attempts,omitempty"`
+	LockedUntil    time.Time `bson:"locked_until,omitempty"`
+	// ResetTokenHash is the SHA-256 of a pending password reset token
+	ResetTokenHash    string    `bson:"reset_token_hash,omitempty"`
+	ResetTokenExpires time.Time `bson:"reset_token_expires,omitempty"`
+	// Enabled is nil for users created before accounts could be disabled; see isEnabled
+	Enabled *bool `bson:"enabled,omitempty"`
+	// Sessions lists the IDs of the user's live sessions, oldest first, while their number
+	// is limited (see maxSessionsPerUser)
+	Sessions []string `bson:"sessions,omitempty"`
+	// SessionsNotBefore ends every session logged in before it; see ClearSessions
+	SessionsNotBefore time.Time `bson:"sessions_not_before,omitempty"`
+	// OIDCSubject is the provider's subject of users who log in through single sign-on
+	OIDCSubject string `bson:"oidc_subject,omitempty"`
+}
+
+// isEnabled reports whether the user may log in; accounts are enabled unless an admin
+// disabled them
+func (u *User) isEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// caseInsensitiveUsernames lowercases usernames before storage and lookup, so "Ahmad"
+// and "ahmad" are the same account
+var caseInsensitiveUsernames = true
+
+// normalizeUsername is how usernames are stored and looked up
+func normalizeUsername(name string) string {
+	name = strings.TrimSpace(name)
+	if caseInsensitiveUsernames {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// username length bounds in characters, checked when users register or log in, so
+// oversized names never reach the database or a session cookie
+var minUsernameLength = 3
+var maxUsernameLength = 64
+
+// validateUsername checks the length of a normalized username
+func validateUsername(name string) error {
+	if length := utf8.RuneCountInString(name); length < minUsernameLength || length > maxUsernameLength {
+		return fmt.Errorf("username must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	return nil
+}
+
+// displayNameFor returns the trimmed original spelling of name when normalizing changes
+// it, and "" otherwise
+func displayNameFor(name string) string {
+	if display := strings.TrimSpace(name); display != normalizeUsername(name) {
+		return display
+	}
+	return ""
+}
+
+// UserStore abstracts user persistence so handlers can run against MongoDB or a test double
+type UserStore interface {
+	// FindUser returns the user with the given username, or errUserNotFound
+	FindUser(ctx context.Context, username string) (*User, error)
+	// FindUserByEmail returns the user with the given normalized email, or errUserNotFound
+	FindUserByEmail(ctx context.Context, email string) (*User, error)
+	// ListUsernames returns all registered usernames sorted alphabetically
+	ListUsernames(ctx context.Context) ([]string, error)
+	// ListUsernamesPage returns up to limit sorted usernames after skipping offset,
+	// along with the total number of users
+	ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error)
+	// CreateUser inserts a new user document
+	CreateUser(ctx context.Context, user User) error
+	// UpsertUser sets the password of user.Username, creating the user with user.Role and
+	// user.DisplayName when missing; the role of an existing user is left alone
+	UpsertUser(ctx context.Context, user User) error
+	// UpdatePassword replaces the stored password hash, or returns errUserNotFound
+	UpdatePassword(ctx context.Context, username string, passwordHash string) error
+	// UpdateRole changes the user's role, or returns errUserNotFound
+	UpdateRole(ctx context.Context, username string, role string) error
+	// SetEnabled enables or disables logging in as the user, or returns errUserNotFound
+	SetEnabled(ctx context.Context, username string, enabled bool) error
+	// LinkOIDCSubject records the single sign-on subject of the user, or returns errUserNotFound
+	LinkOIDCSubject(ctx context.Context, username string, subject string) error
+	// DeleteUser removes the user document, or returns errUserNotFound
+	DeleteUser(ctx context.Context, username string) error
+	// RecordFailedLogin counts a failed login and, once maxAttempts is reached, locks the
+	// user for lockFor and resets the count; it reports whether the user got locked
+	RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error)
+	// ClearFailedLogins resets the failed login count and any lockout
+	ClearFailedLogins(ctx context.Context, username string) error
+	// SetResetToken stores a password reset token hash, or clears it when tokenHash is empty
+	SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error
+	// FindUserByResetToken returns the user holding the reset token hash, or errUserNotFound
+	FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error)
+	// AddSession appends a session ID to the user's sessions, dropping all but the newest
+	// keep, or returns errUserNotFound
+	AddSession(ctx context.Context, username string, sessionID string, keep int) error
+	// ClearSessions ends all of the user's sessions, counted or not: it forgets their IDs
+	// and sets SessionsNotBefore to now. It returns errUserNotFound for unknown users.
+	ClearSessions(ctx context.Context, username string) error
+}
+
+// errUserNotFound is returned by stores when no user matches a lookup
+var errUserNotFound = errors.New("user not found")
+
+// errDuplicateUser is returned by CreateUser when the username is already taken
+var errDuplicateUser = errors.New("username already exists")
+
+// errDuplicateEmail is returned by CreateUser when the email is already taken
+var errDuplicateEmail = errors.New("email already in use")
+
+// userStore overrides the MongoDB-backed store when set (e.g. an in-memory store in tests)
+var userStore UserStore
+
+// user store backends selected by STORE_BACKEND; the SQL one is only compiled in with the
+// sqlstore build tag and keeps its users in the SQL_DSN database of the SQL_DRIVER driver
+const (
+	storeBackendMongo = "mongo"
+	storeBackendSQL   = "sql"
+)
+
+var storeBackend = storeBackendMongo
+var sqlDriver = "postgres"
+var sqlDSN = ""
+
+// currentUserStore returns the active user store, or nil when running without a database.
+// Lookups go through the user cache when USER_CACHE_TTL is set.
+func currentUserStore() UserStore {
+	store := baseUserStore()
+	if store != nil && userCacheTTL > 0 {
+		return &cachingUserStore{next: store, cache: lookupCache}
+	}
+	return store
+}
+
+// baseUserStore returns the uncached user store, or nil when running without a database
+func baseUserStore() UserStore {
+	if userStore != nil {
+		return userStore
+	}
+	if collection := currentUsersCollection(); collection != nil {
+		if tenantSource != "" {
+			return &tenantUserStore{storeFor: mongoTenantStore}
+		}
+		return &mongoUserStore{collection: collection}
+	}
+	return nil
+}
+
+// mongoUserStore is the UserStore backed by the users collection
+type mongoUserStore struct {
+	collection *mongo.Collection
+}
+
+// findOneOptions tags the lookup with the request ID, when ctx carries one
+func findOneOptions(ctx context.Context) *options.FindOneOptions {
+	opts := options.FindOne()
+	if comment := queryComment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+func (s *mongoUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	return s.findOne(ctx, bson.D{{Key: "username", Value: username}})
+}
+
+func (s *mongoUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findOne(ctx, bson.D{{Key: "email", Value: email}})
+}
+
+// findOne decodes the single user matching filter, or returns errUserNotFound
+func (s *mongoUserStore) findOne(ctx context.Context, filter bson.D) (*User, error) {
+	defer trackDBOp()()
+	var user User
+	err := s.collection.FindOne(ctx, filter, findOneOptions(ctx)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *mongoUserStore) ListUsernames(ctx context.Context) ([]string, error) {
+	defer trackDBOp()()
+	return s.findUsernames(ctx, usernamesFindOptions(ctx))
+}
+
+func (s *mongoUserStore) ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error) {
+	defer trackDBOp()()
+	countOpts := options.Count()
+	if comment := queryComment(ctx); comment != "" {
+		countOpts.SetComment(comment)
+	}
+	total, err := s.collection.CountDocuments(ctx, bson.D{}, countOpts)
+	if err != nil {
+		return nil, 0, err
+	}
+	// a zero limit means no limit to MongoDB
+	if limit == 0 || offset >= total {
+		return []string{}, total, nil
+	}
+	usernames, err := s.findUsernames(ctx, usernamesFindOptions(ctx).SetSkip(offset).SetLimit(limit))
+	return usernames, total, err
+}
+
+// usernamesFindOptions projects users to their username, sorted so pages are stable
+func usernamesFindOptions(ctx context.Context) *options.FindOptions {
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "username", Value: 1}}).
+		SetSort(bson.D{{Key: "username", Value: 1}})
+	if comment := queryComment(ctx); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+// findUsernames runs a username query built by usernamesFindOptions
+func (s *mongoUserStore) findUsernames(ctx context.Context, opts *options.FindOptions) ([]string, error) {
+	cursor, err := s.collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(users))
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+	return usernames, nil
+}
+
+func (s *mongoUserStore) UpdatePassword(ctx context.Context, username string, passwordHash string) error {
+	defer trackDBOp()()
+	return s.setField(ctx, username, "password", passwordHash)
+}
+
+func (s *mongoUserStore) UpdateRole(ctx context.Context, username string, role string) error {
+	defer trackDBOp()()
+	return s.setField(ctx, username, "role", role)
+}
+
+func (s *mongoUserStore) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	defer trackDBOp()()
+	return s.setField(ctx, username, "enabled", enabled)
+}
+
+func (s *mongoUserStore) LinkOIDCSubject(ctx context.Context, username string, subject string) error {
+	defer trackDBOp()()
+	return s.setField(ctx, username, "oidc_subject", subject)
+}
+
+// setField $sets a single field on the user's document
+func (s *mongoUserStore) setField(ctx context.Context, username string, field string, value interface{}) error {
+	result, err := s.collection.UpdateOne(ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: value}}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error) {
+	defer trackDBOp()()
+	filter := bson.D{{Key: "username", Value: username}}
+	var user User
+	err := s.collection.FindOneAndUpdate(ctx, filter,
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "failed_attempts", Value: 1}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, errUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if maxAttempts <= 0 || user.FailedAttempts < maxAttempts {
+		return false, nil
+	}
+	_, err = s.collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "failed_attempts", Value: 0},
+		{Key: "locked_until", Value: clock().Add(lockFor)},
+	}}})
+	return err == nil, err
+}
+
+func (s *mongoUserStore) AddSession(ctx context.Context, username string, sessionID string, keep int) error {
+	defer trackDBOp()()
+	result, err := s.collection.UpdateOne(ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "sessions", Value: bson.D{
+			{Key: "$each", Value: bson.A{sessionID}},
+			{Key: "$slice", Value: -keep},
+		}}}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) ClearSessions(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	result, err := s.collection.UpdateOne(ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{
+			{Key: "$unset", Value: bson.D{{Key: "sessions", Value: ""}}},
+			{Key: "$set", Value: bson.D{{Key: "sessions_not_before", Value: clock()}}},
+		})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) ClearFailedLogins(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	_, err := s.collection.UpdateOne(ctx,
+		bson.D{{Key: "username", Value: username}},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "failed_attempts", Value: ""}, {Key: "locked_until", Value: ""}}}})
+	return err
+}
+
+func (s *mongoUserStore) SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error {
+	defer trackDBOp()()
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "reset_token_hash", Value: tokenHash},
+		{Key: "reset_token_expires", Value: expires},
+	}}}
+	if tokenHash == "" {
+		update = bson.D{{Key: "$unset", Value: bson.D{
+			{Key: "reset_token_hash", Value: ""},
+			{Key: "reset_token_expires", Value: ""},
+		}}}
+	}
+	result, err := s.collection.UpdateOne(ctx, bson.D{{Key: "username", Value: username}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error) {
+	return s.findOne(ctx, bson.D{{Key: "reset_token_hash", Value: tokenHash}})
+}
+
+func (s *mongoUserStore) DeleteUser(ctx context.Context, username string) error {
+	defer trackDBOp()()
+	result, err := s.collection.DeleteOne(ctx, bson.D{{Key: "username", Value: username}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) CreateUser(ctx context.Context, user User) error {
+	defer trackDBOp()()
+	_, err := s.collection.InsertOne(ctx, user)
+	if duplicate := duplicateKeyError(err); duplicate != nil {
+		return duplicate
+	}
+	return err
+}
+
+// duplicateKeyCode is the MongoDB error code for unique index violations
+const duplicateKeyCode = 11000
+
+// duplicateKeyError maps a unique index violation in a write error to errDuplicateEmail
+// or errDuplicateUser, returning nil for any other error
+func duplicateKeyError(err error) error {
+	var writeException mongo.WriteException
+	if !errors.As(err, &writeException) {
+		return nil
+	}
+	for _, writeError := range writeException.WriteErrors {
+		if writeError.Code != duplicateKeyCode {
+			continue
+		}
+		// the message names the violated index, email_1 or username_1
+		if strings.Contains(writeError.Message, "email_1") {
+			return errDuplicateEmail
+		}
+		return errDuplicateUser
+	}
+	return nil
+}
+
+func (s *mongoUserStore) UpsertUser(ctx context.Context, user User) error {
+	defer trackDBOp()()
+	setOnInsert := bson.D{{Key: "role", Value: user.Role}}
+	if user.DisplayName != "" {
+		setOnInsert = append(setOnInsert, bson.E{Key: "display_name", Value: user.DisplayName})
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "password", Value: user.Password}}},
+		{Key: "$setOnInsert", Value: setOnInsert},
+	}
+	_, err := s.collection.UpdateOne(ctx, bson.D{{Key: "username", Value: user.Username}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// ensureIndexes (ENSURE_INDEXES) creates the unique user indexes on startup and for each
+// tenant database; turn it off where the app's MongoDB user may not create indexes
+var ensureIndexes = true
+
+// createIndexesFunc creates the user indexes of a collection; tests replace it
+var createIndexesFunc = ensureUserIndexes
+
+// mongoUnauthorized is the MongoDB error code for commands the user lacks privileges for
+const mongoUnauthorized = 13
+
+// unnormalizedUsernames matches usernames that normalizeUsername may change: ASCII capitals,
+// any non-ASCII character (checked again in Go) and surrounding whitespace
+const unnormalizedUsernames = `[A-Z]|[^\x00-\x7f]|^\s|\s$`
+
+// normalizeStoredUsernames rewrites usernames stored before they were normalized, keeping
+// the original spelling as the display name, so those users can still log in. A name whose
+// normalized form is already taken is left alone and logged. Failures are logged and
+// tolerated like those of prepareUserIndexes.
+func normalizeStoredUsernames(ctx context.Context, collection *mongo.Collection, logAttrs ...interface{}) {
+	if !caseInsensitiveUsernames {
+		return
+	}
+	defer trackDBOp()()
+	filter := bson.D{{Key: "username", Value: bson.D{{Key: "$regex", Value: unnormalizedUsernames}}}}
+	opts := options.Find().SetProjection(bson.D{{Key: "username", Value: 1}, {Key: "display_name", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Warn("failed to look up unnormalized usernames", append(logAttrs, "error", err)...)
+		return
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		slog.Warn("failed to look up unnormalized usernames", append(logAttrs, "error", err)...)
+		return
+	}
+	for _, user := range users {
+		name := normalizeUsername(user.Username)
+		if name == user.Username || name == "" {
+			continue
+		}
+		taken, err := collection.CountDocuments(ctx, bson.D{{Key: "username", Value: name}})
+		if err != nil {
+			slog.Warn("failed to normalize username", append(logAttrs, "username", user.Username, "error", err)...)
+			continue
+		}
+		if taken > 0 {
+			slog.Warn("not normalizing username, the normalized name is taken", append(logAttrs, "username", user.Username, "normalized", name)...)
+			continue
+		}
+		set := bson.D{{Key: "username", Value: name}}
+		if user.DisplayName == "" {
+			set = append(set, bson.E{Key: "display_name", Value: displayNameFor(user.Username)})
+		}
+		_, err = collection.UpdateOne(ctx, bson.D{{Key: "username", Value: user.Username}}, bson.D{{Key: "$set", Value: set}})
+		if err != nil {
+			slog.Warn("failed to normalize username", append(logAttrs, "username", user.Username, "error", err)...)
+			continue
+		}
+		slog.Info("normalized username", append(logAttrs, "username", user.Username, "normalized", name)...)
+	}
+}
+
+// prepareUserIndexes creates the user indexes of collection unless ensureIndexes is off.
+// Failures are logged and tolerated, since logins work without the indexes; it reports
+// whether there is no point in trying again, i.e. unless a transient error got in the way.
+func prepareUserIndexes(ctx context.Context, collection *mongo.Collection, logAttrs ...interface{}) bool {
+	if !ensureIndexes {
+		slog.Info("skipping user index creation, ENSURE_INDEXES is off", logAttrs...)
+		return true
+	}
+	err := createIndexesFunc(ctx, collection)
+	if err == nil {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(mongoUnauthorized) {
+		slog.Warn("not allowed to create unique user indexes, set ENSURE_INDEXES=false to skip them", append(logAttrs, "error", err)...)
+		return true
+	}
+	// e.g. existing duplicates or a conflicting non-unique index
+	slog.Warn("failed to create unique user indexes", append(logAttrs, "error", err)...)
+	return false
+}
+
+// ensureUserIndexes creates the unique indexes on username and email (sparse, since
+// older users have none); creating identical indexes again is a no-op in MongoDB
+func ensureUserIndexes(ctx context.Context, collection *mongo.Collection) error {
+	defer trackDBOp()()
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	return err
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// memoryUserStore is an in-memory UserStore used by tests that don't need MongoDB
+type memoryUserStore struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+func newMemoryUserStore(users ...User) *memoryUserStore {
+	store := &memoryUserStore{users: make(map[string]User)}
+	for _, user := range users {
+		store.users[user.Username] = user
+	}
+	return store
+}
+
+func (s *memoryUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return &user, nil
+}
+
+func (s *memoryUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email != "" && user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (s *memoryUserStore) ListUsernames(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usernames := make([]string, 0, len(s.users))
+	for name := range s.users {
+		usernames = append(usernames, name)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (s *memoryUserStore) ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error) {
+	usernames, err := s.ListUsernames(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := int64(len(usernames))
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return usernames[offset:end], total, nil
+}
+
+func (s *memoryUserStore) UpdatePassword(ctx context.Context, username string, passwordHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Password = passwordHash
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) CreateUser(ctx context.Context, user User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[user.Username]; exists {
+		return errDuplicateUser
+	}
+	for _, existing := range s.users {
+		if user.Email != "" && existing.Email == user.Email {
+			return errDuplicateEmail
+		}
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *memoryUserStore) UpsertUser(ctx context.Context, user User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.users[user.Username]; ok {
+		existing.Password = user.Password
+		s.users[user.Username] = existing
+		return nil
+	}
+	s.users[user.Username] = User{Username: user.Username, DisplayName: user.DisplayName, Password: user.Password, Role: user.Role}
+	return nil
+}
+
+func (s *memoryUserStore) UpdateRole(ctx context.Context, username string, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Role = role
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) AddSession(ctx context.Context, username string, sessionID string, keep int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	sessions := append(append([]string(nil), user.Sessions...), sessionID)
+	if len(sessions) > keep {
+		sessions = sessions[len(sessions)-keep:]
+	}
+	user.Sessions = sessions
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) ClearSessions(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Sessions = nil
+	user.SessionsNotBefore = clock()
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Enabled = &enabled
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) LinkOIDCSubject(ctx context.Context, username string, subject string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.OIDCSubject = subject
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) DeleteUser(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return errUserNotFound
+	}
+	delete(s.users, username)
+	return nil
+}
+
+func (s *memoryUserStore) RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return false, errUserNotFound
+	}
+	user.FailedAttempts++
+	locked := maxAttempts > 0 && user.FailedAttempts >= maxAttempts
+	if locked {
+		user.FailedAttempts = 0
+		user.LockedUntil = clock().Add(lockFor)
+	}
+	s.users[username] = user
+	return locked, nil
+}
+
+func (s *memoryUserStore) ClearFailedLogins(ctx context.Context, username string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[username]; ok {
+		user.FailedAttempts = 0
+		user.LockedUntil = time.Time{}
+		s.users[username] = user
+	}
+	return nil
+}
+
+func (s *memoryUserStore) SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	user.ResetTokenHash = tokenHash
+	user.ResetTokenExpires = expires
+	if tokenHash == "" {
+		user.ResetTokenExpires = time.Time{}
+	}
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryUserStore) FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if tokenHash != "" && user.ResetTokenHash == tokenHash {
+			return &user, nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+// useMemoryUserStore installs store as the active user store for the duration of the test
+func useMemoryUserStore(t *testing.T, store UserStore) {
+	original := userStore
+	userStore = store
+	t.Cleanup(func() { userStore = original })
+}
+
+func TestCurrentUserStore(t *testing.T) {
+	originalCollection, originalStore := currentUsersCollection(), userStore
+	defer func() {
+		setUsersCollection(originalCollection)
+		userStore = originalStore
+	}()
+
+	setUsersCollection(nil)
+	userStore = nil
+	if currentUserStore() != nil {
+		t.Error("currentUserStore should be nil without a database")
+	}
+
+	memory := newMemoryUserStore()
+	userStore = memory
+	if currentUserStore() != memory {
+		t.Error("currentUserStore should prefer the override store")
+	}
+}
+
+func TestVerifyCredentialsWithMemoryStore(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	if !verifyCredentials(context.Background(), "bob", "secret") {
+		t.Error("verifyCredentials should accept a stored user with the right password")
+	}
+	if verifyCredentials(context.Background(), "bob", "wrong") {
+		t.Error("verifyCredentials should reject a wrong password")
+	}
+	if verifyCredentials(context.Background(), "nobody", "secret") {
+		t.Error("verifyCredentials should reject an unknown user")
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	if got := normalizeUsername("  Ahmad "); got != "ahmad" {
+		t.Errorf("expected trimmed, lowercased username, got %q", got)
+	}
+	if got := displayNameFor("Ahmad"); got != "Ahmad" {
+		t.Errorf("the original spelling should be kept as the display name, got %q", got)
+	}
+	if got := displayNameFor("ahmad"); got != "" {
+		t.Errorf("no display name is needed when normalizing changes nothing, got %q", got)
+	}
+
+	original := caseInsensitiveUsernames
+	caseInsensitiveUsernames = false
+	defer func() { caseInsensitiveUsernames = original }()
+	if got := normalizeUsername("  Ahmad "); got != "Ahmad" {
+		t.Errorf("case should be kept when USERNAME_CASE_INSENSITIVE is off, got %q", got)
+	}
+}
+
+func TestVerifyCredentialsIgnoresUsernameCase(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	for _, name := range []string{"Bob", "BOB", " bob "} {
+		if !verifyCredentials(context.Background(), name, "secret") {
+			t.Errorf("verifyCredentials should accept %q for user bob", name)
+		}
+	}
+}
+
+func TestCreateUsersCancelledContext(t *testing.T) {
+	store := newMemoryUserStore()
+	useMemoryUserStore(t, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := createUsers(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("createUsers should return the context error, got %v", err)
+	}
+	if usernames, _ := store.ListUsernames(context.Background()); len(usernames) != 0 {
+		t.Error("no user should be inserted with a cancelled context")
+	}
+}
+
+func TestVerifyCredentialsCancelledContext(t *testing.T) {
+	useMemoryUserStore(t, newMemoryUserStore(User{Username: "bob", Password: "secret"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if verifyCredentials(ctx, "bob", "secret") {
+		t.Error("verifyCredentials should not succeed once the context is cancelled")
+	}
+}
+
+func TestMongoUserStoreCancelledContext(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	store := &mongoUserStore{collection: client.Database("test_login_app").Collection("test_users")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	user, err := store.FindUser(ctx, "bob")
+	if user != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("FindUser should return a context error instead of a result, got %v, %v", user, err)
+	}
+}
+
+func TestFindOneOptionsCarriesRequestID(t *testing.T) {
+	opts := findOneOptions(withRequestID(context.Background(), "req-42"))
+	if opts.Comment == nil || *opts.Comment != "request_id:req-42" {
+		t.Errorf("expected the request ID as query comment, got %v", opts.Comment)
+	}
+
+	if opts := findOneOptions(context.Background()); opts.Comment != nil {
+		t.Errorf("no comment should be set without a request ID, got %q", *opts.Comment)
+	}
+}
+
+func TestMemoryStoreRejectsDuplicateUser(t *testing.T) {
+	store := newMemoryUserStore(User{Username: "bob", Password: "secret"})
+
+	if err := store.CreateUser(context.Background(), User{Username: "bob", Password: "other"}); !errors.Is(err, errDuplicateUser) {
+		t.Errorf("expected errDuplicateUser, got %v", err)
+	}
+}
+
+func TestNormalizeStoredUsernames(t *testing.T) {
+	testCollection, cleanup := setupTestMongoDB(t)
+	if testCollection == nil {
+		return
+	}
+	defer cleanup()
+	ctx := context.Background()
+	// stored before usernames were normalized
+	for _, name := range []string{"Ahmad", "Bob", "bob", "carol"} {
+		if _, err := testCollection.InsertOne(ctx, User{Username: name, Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	normalizeStoredUsernames(ctx, testCollection)
+
+	store := &mongoUserStore{collection: testCollection}
+	user, err := store.FindUser(ctx, "ahmad")
+	if err != nil {
+		t.Fatalf("a mixed-case legacy user should be found by the normalized name: %v", err)
+	}
+	if user.DisplayName != "Ahmad" {
+		t.Errorf("the original spelling should become the display name, got %q", user.DisplayName)
+	}
+	// "bob" is taken, so "Bob" stays as it was
+	for _, name := range []string{"Bob", "bob", "carol"} {
+		if _, err := store.FindUser(ctx, name); err != nil {
+			t.Errorf("%s should be untouched: %v", name, err)
+		}
+	}
+}
+
+func TestUserIndexesRejectDuplicates(t *testing.T) {
+	testCollection, cleanup := setupTestMongoDB(t)
+	if testCollection == nil {
+		return
+	}
+	defer cleanup()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := ensureUserIndexes(ctx, testCollection); err != nil {
+			t.Fatalf("creating the index (attempt %d) should succeed: %v", i+1, err)
+		}
+	}
+
+	store := &mongoUserStore{collection: testCollection}
+	if err := store.CreateUser(ctx, User{Username: "bob", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "bob", Password: "other"}); !errors.Is(err, errDuplicateUser) {
+		t.Errorf("a duplicate insert should fail with errDuplicateUser, got %v", err)
+	}
+
+	// users without an email don't collide on the sparse email index
+	if err := store.CreateUser(ctx, User{Username: "carol", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "dave", Password: "secret", Email: "d@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "erin", Password: "secret", Email: "d@example.com"}); !errors.Is(err, errDuplicateEmail) {
+		t.Errorf("a duplicate email should fail with errDuplicateEmail, got %v", err)
+	}
+}
+
+// run with -race: readers resolve the store while a writer swaps the collection
+func TestUsersCollectionConcurrentAccess(t *testing.T) {
+	originalCollection, originalStore := currentUsersCollection(), userStore
+	defer func() {
+		setUsersCollection(originalCollection)
+		userStore = originalStore
+	}()
+	userStore = nil
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					baseUserStore()
+				}
+			}
+		}()
+	}
+	collection := &mongo.Collection{}
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			setUsersCollection(collection)
+		} else {
+			setUsersCollection(nil)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestMongoListUsernamesPage(t *testing.T) {
+	testCollection, cleanup := setupTestMongoDB(t)
+	if testCollection == nil {
+		return
+	}
+	defer cleanup()
+	ctx := context.Background()
+
+	store := &mongoUserStore{collection: testCollection}
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if err := store.CreateUser(ctx, User{Username: name, Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usernames, total, err := store.ListUsernamesPage(ctx, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(usernames) != 1 || usernames[0] != "bob" {
+		t.Errorf("expected [bob] of 3, got %v of %d", usernames, total)
+	}
+}
+
+func TestDuplicateKeyError(t *testing.T) {
+	duplicate := func(message string) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: duplicateKeyCode, Message: message}}}
+	}
+	testCases := []struct {
+		err  error
+		want error
+	}{
+		{duplicate(`E11000 duplicate key error collection: login_app.users index: username_1 dup key: { username: "bob" }`), errDuplicateUser},
+		{duplicate(`E11000 duplicate key error collection: login_app.users index: email_1 dup key: { email: "b@example.com" }`), errDuplicateEmail},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: "Document failed validation"}}}, nil},
+		{errors.New("connection reset by peer"), nil},
+		{nil, nil},
+	}
+	for _, tc := range testCases {
+		if got := duplicateKeyError(tc.err); got != tc.want {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"ab":                    false,
+		"bob":                   true,
+		"ahmad":                 true,
+		"élodie":                true,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+		strings.Repeat("é", 64): true,
+	} {
+		if err := validateUsername(name); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v", name, valid, err)
+		}
+	}
+}
+
+// stubCreateIndexes makes index creation fail with err, counting the attempts
+func stubCreateIndexes(t *testing.T, err error) *int {
+	originalCreate, originalEnsure := createIndexesFunc, ensureIndexes
+	t.Cleanup(func() { createIndexesFunc, ensureIndexes = originalCreate, originalEnsure })
+	calls := 0
+	createIndexesFunc = func(context.Context, *mongo.Collection) error {
+		calls++
+		return err
+	}
+	return &calls
+}
+
+func TestPrepareUserIndexesToggle(t *testing.T) {
+	calls := stubCreateIndexes(t, nil)
+	logs := captureLogs(t)
+
+	if !prepareUserIndexes(context.Background(), nil) || *calls != 1 {
+		t.Errorf("expected the indexes to be created while ENSURE_INDEXES is on, got %d attempts", *calls)
+	}
+
+	ensureIndexes = false
+	if !prepareUserIndexes(context.Background(), nil) || *calls != 1 {
+		t.Errorf("expected no index creation while ENSURE_INDEXES is off, got %d attempts", *calls)
+	}
+	if !strings.Contains(logs.String(), "skipping user index creation") {
+		t.Errorf("expected a note that index creation was skipped, got %q", logs.String())
+	}
+}
+
+func TestPrepareUserIndexesToleratesPermissionErrors(t *testing.T) {
+	stubCreateIndexes(t, mongo.CommandError{Code: mongoUnauthorized, Name: "Unauthorized", Message: "not authorized on users to execute command createIndexes"})
+	logs := captureLogs(t)
+
+	if !prepareUserIndexes(context.Background(), nil) {
+		t.Error("a permission error should not be retried")
+	}
+	if !strings.Contains(logs.String(), "ENSURE_INDEXES=false") {
+		t.Errorf("expected a warning pointing at ENSURE_INDEXES, got %q", logs.String())
+	}
+
+	stubCreateIndexes(t, errors.New("connection reset"))
+	if prepareUserIndexes(context.Background(), nil) {
+		t.Error("other errors should be retried")
+	}
+}
+
+func TestLoadConfigEnsureIndexes(t *testing.T) {
+	original := ensureIndexes
+	t.Cleanup(func() { ensureIndexes = original })
+
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !ensureIndexes {
+		t.Error("index creation should default to on")
+	}
+	t.Setenv("ENSURE_INDEXES", "false")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if ensureIndexes {
+		t.Error("ENSURE_INDEXES=false should turn index creation off")
+	}
+}
+
+func TestLoadConfigStoreBackend(t *testing.T) {
+	originalBackend, originalStore := storeBackend, userStore
+	t.Cleanup(func() { storeBackend, userStore = originalBackend, originalStore })
+
+	t.Setenv("STORE_BACKEND", "postgres")
+	if err := loadConfig(); err == nil {
+		t.Error("expected an unknown STORE_BACKEND to be rejected")
+	}
+	// without the sqlstore build tag there is no SQL support, and with it a DSN is required
+	t.Setenv("STORE_BACKEND", storeBackendSQL)
+	if err := loadConfig(); err == nil {
+		t.Error("expected STORE_BACKEND=sql without SQL_DSN to be rejected")
+	}
+	t.Setenv("STORE_BACKEND", storeBackendMongo)
+	if err := loadConfig(); err != nil {
+		t.Errorf("loadConfig: %v", err)
+	}
+}
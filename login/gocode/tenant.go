@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tenant sources: "header" reads the tenant from tenantHeader, "subdomain" from the
+// label in front of tenantDomain; empty disables tenants and everyone shares one database
+const (
+	tenantSourceHeader    = "header"
+	tenantSourceSubdomain = "subdomain"
+)
+
+var tenantSource = ""
+var tenantHeader = "X-Tenant"
+var tenantDomain = ""
+
+// tenants lists the known tenants; each keeps its users in its own database, named
+// after database_name and the tenant (see tenantDatabase)
+var tenants []string
+
+// tenantKey is the context key for the tenant resolved by tenantMiddleware
+type tenantKey struct{}
+
+// tenantFrom returns the tenant of the request ctx belongs to, or "" for the default database
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantUsername keys per-user state kept in memory, like the lookup cache and the login
+// throttle, so the same username in different tenants stays apart. Tenant names can't
+// contain "/", so keys never collide.
+func tenantUsername(ctx context.Context, username string) string {
+	if tenant := tenantFrom(ctx); tenant != "" {
+		return tenant + "/" + username
+	}
+	return username
+}
+
+// validTenantName reports whether name is usable in a database name
+func validTenantName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTenantConfig checks the tenant settings loadConfig read
+func validateTenantConfig() error {
+	switch tenantSource {
+	case "":
+		return nil
+	case tenantSourceHeader:
+		if tenantHeader == "" {
+			return fmt.Errorf("TENANT_HEADER must not be empty")
+		}
+	case tenantSourceSubdomain:
+		if tenantDomain == "" {
+			return fmt.Errorf("TENANT_DOMAIN is required with TENANT_SOURCE=subdomain")
+		}
+	default:
+		return fmt.Errorf("invalid TENANT_SOURCE %q, expected header or subdomain", tenantSource)
+	}
+	if len(tenants) == 0 {
+		return fmt.Errorf("TENANTS must list the known tenants")
+	}
+	for _, tenant := range tenants {
+		if !validTenantName(tenant) {
+			return fmt.Errorf("invalid tenant name %q, expected lowercase letters, digits and dashes", tenant)
+		}
+	}
+	return nil
+}
+
+// knownTenant reports whether tenant is listed in tenants
+func knownTenant(tenant string) bool {
+	for _, known := range tenants {
+		if known == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// requestTenant extracts the tenant name a request asks for, "" when it names none
+func requestTenant(request *http.Request) string {
+	switch tenantSource {
+	case tenantSourceHeader:
+		return strings.ToLower(strings.TrimSpace(request.Header.Get(tenantHeader)))
+	case tenantSourceSubdomain:
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+		host = strings.ToLower(host)
+		if label, ok := strings.CutSuffix(host, "."+strings.ToLower(tenantDomain)); ok {
+			return label
+		}
+	}
+	return ""
+}
+
+// tenantMiddleware stores the request's tenant in its context for tenantFrom, answering
+// 404 for tenants that aren't configured. Requests without a tenant use the default database.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		tenant := requestTenant(request)
+		if tenant == "" {
+			next.ServeHTTP(response, request)
+			return
+		}
+		if !knownTenant(tenant) {
+			httpError(response, request, http.StatusNotFound, errCodeNotFound, "unknown tenant")
+			return
+		}
+		ctx := context.WithValue(request.Context(), tenantKey{}, tenant)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+// tenantDatabase names the database holding a tenant's users
+func tenantDatabase(tenant string) string {
+	return database_name + "_" + tenant
+}
+
+// tenantUserStore is the UserStore used when tenants are enabled. It routes every call to
+// the store of the tenant carried by ctx, as returned by storeFor.
+type tenantUserStore struct {
+	storeFor func(ctx context.Context, tenant string) (UserStore, error)
+}
+
+// store returns the UserStore of ctx's tenant
+func (s *tenantUserStore) store(ctx context.Context) (UserStore, error) {
+	return s.storeFor(ctx, tenantFrom(ctx))
+}
+
+func (s *tenantUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindUser(ctx, username)
+}
+
+func (s *tenantUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindUserByEmail(ctx, email)
+}
+
+func (s *tenantUserStore) ListUsernames(ctx context.Context) ([]string, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.ListUsernames(ctx)
+}
+
+func (s *tenantUserStore) ListUsernamesPage(ctx context.Context, offset int64, limit int64) ([]string, int64, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return store.ListUsernamesPage(ctx, offset, limit)
+}
+
+func (s *tenantUserStore) CreateUser(ctx context.Context, user User) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.CreateUser(ctx, user)
+}
+
+func (s *tenantUserStore) UpsertUser(ctx context.Context, user User) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.UpsertUser(ctx, user)
+}
+
+func (s *tenantUserStore) UpdatePassword(ctx context.Context, username string, passwordHash string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.UpdatePassword(ctx, username, passwordHash)
+}
+
+func (s *tenantUserStore) UpdateRole(ctx context.Context, username string, role string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.UpdateRole(ctx, username, role)
+}
+
+func (s *tenantUserStore) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.SetEnabled(ctx, username, enabled)
+}
+
+func (s *tenantUserStore) LinkOIDCSubject(ctx context.Context, username string, subject string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.LinkOIDCSubject(ctx, username, subject)
+}
+
+func (s *tenantUserStore) AddSession(ctx context.Context, username string, sessionID string, keep int) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.AddSession(ctx, username, sessionID, keep)
+}
+
+func (s *tenantUserStore) ClearSessions(ctx context.Context, username string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.ClearSessions(ctx, username)
+}
+
+func (s *tenantUserStore) DeleteUser(ctx context.Context, username string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.DeleteUser(ctx, username)
+}
+
+func (s *tenantUserStore) RecordFailedLogin(ctx context.Context, username string, maxAttempts int, lockFor time.Duration) (bool, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return false, err
+	}
+	return store.RecordFailedLogin(ctx, username, maxAttempts, lockFor)
+}
+
+func (s *tenantUserStore) ClearFailedLogins(ctx context.Context, username string) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.ClearFailedLogins(ctx, username)
+}
+
+func (s *tenantUserStore) SetResetToken(ctx context.Context, username string, tokenHash string, expires time.Time) error {
+	store, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	return store.SetResetToken(ctx, username, tokenHash, expires)
+}
+
+func (s *tenantUserStore) FindUserByResetToken(ctx context.Context, tokenHash string) (*User, error) {
+	store, err := s.store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store.FindUserByResetToken(ctx, tokenHash)
+}
+
+// tenantPrepareTimeout bounds preparing a tenant's collection, which doesn't run on the
+// context of the request that happens to use the tenant first
+var tenantPrepareTimeout = 30 * time.Second
+
+// tenantPrepareRetryDelay is how long a tenant whose preparation failed waits for the next
+// attempt; the delay doubles with every further failure up to tenantPrepareMaxRetryDelay
+var tenantPrepareRetryDelay = time.Minute
+var tenantPrepareMaxRetryDelay = time.Hour
+
+// prepareTenantCollection normalizes the usernames and creates the user indexes of a
+// tenant's collection, reporting whether there is no point in trying again (see
+// prepareUserIndexes); tests replace it
+var prepareTenantCollection = func(ctx context.Context, collection *mongo.Collection, tenant string) bool {
+	normalizeStoredUsernames(ctx, collection, "tenant", tenant)
+	return prepareUserIndexes(ctx, collection, "tenant", tenant)
+}
+
+// tenantCollection is a tenant's users collection and how far preparing it got
+type tenantCollection struct {
+	collection *mongo.Collection
+	prepared   bool
+	preparing  bool
+	failures   int
+	retryAt    time.Time
+}
+
+// tenantCollectionCache hands out the users collection of each tenant database, preparing
+// it on first use. The cache is dropped when the client changes (see watchDB).
+type tenantCollectionCache struct {
+	mu          sync.Mutex
+	client      *mongo.Client
+	collections map[string]*tenantCollection
+}
+
+// tenantCollections is the cache behind mongoTenantStore
+var tenantCollections = &tenantCollectionCache{}
+
+// collection returns tenant's users collection on the client behind base. The first use
+// prepares it outside the lock, so other tenants aren't held up; meanwhile, and after a
+// failure until the retry delay has passed, the collection is used as it is, like at
+// startup.
+func (c *tenantCollectionCache) collection(base *mongo.Collection, tenant string) *mongo.Collection {
+	c.mu.Lock()
+	client := base.Database().Client()
+	if c.client != client {
+		c.client = client
+		c.collections = make(map[string]*tenantCollection)
+	}
+	entry, ok := c.collections[tenant]
+	if !ok {
+		entry = &tenantCollection{collection: client.Database(tenantDatabase(tenant)).Collection(collection_name)}
+		c.collections[tenant] = entry
+	}
+	if entry.prepared || entry.preparing || clock().Before(entry.retryAt) {
+		c.mu.Unlock()
+		return entry.collection
+	}
+	entry.preparing = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tenantPrepareTimeout)
+	done := prepareTenantCollection(ctx, entry.collection, tenant)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.preparing, entry.prepared = false, done
+	if !done {
+		delay := tenantPrepareRetryDelay << entry.failures
+		if delay <= 0 || delay > tenantPrepareMaxRetryDelay {
+			delay = tenantPrepareMaxRetryDelay
+		} else {
+			entry.failures++
+		}
+		entry.retryAt = clock().Add(delay)
+	}
+	return entry.collection
+}
+
+// mongoTenantStore is the storeFor of tenantUserStore in production: the default
+// collection for requests without a tenant, the tenant's own database otherwise
+func mongoTenantStore(ctx context.Context, tenant string) (UserStore, error) {
+	base := currentUsersCollection()
+	if base == nil {
+		return nil, errStoreUnavailable
+	}
+	if tenant == "" {
+		return &mongoUserStore{collection: base}, nil
+	}
+	return &mongoUserStore{collection: tenantCollections.collection(base, tenant)}, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// useTenants enables header tenants backed by one in-memory store per tenant, with
+// stores[""] serving requests without a tenant
+func useTenants(t *testing.T, stores map[string]UserStore) {
+	originalSource, originalTenants := tenantSource, tenants
+	t.Cleanup(func() { tenantSource, tenants = originalSource, originalTenants })
+	tenantSource = tenantSourceHeader
+	tenants = nil
+	for tenant := range stores {
+		if tenant != "" {
+			tenants = append(tenants, tenant)
+		}
+	}
+	useMemoryUserStore(t, &tenantUserStore{storeFor: func(ctx context.Context, tenant string) (UserStore, error) {
+		return stores[tenant], nil
+	}})
+}
+
+// tenantLogin posts credentials to /login on behalf of tenant
+func tenantLogin(tenant string, name string, pass string) *httptest.ResponseRecorder {
+	form := url.Values{"name": {name}, "password": {pass}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	rr := httptest.NewRecorder()
+	setupRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTenantsUseSeparateStores(t *testing.T) {
+	acme := newMemoryUserStore(User{Username: "bob", Password: "acme-secret"})
+	globex := newMemoryUserStore(User{Username: "bob", Password: "globex-secret"})
+	useTenants(t, map[string]UserStore{"": newMemoryUserStore(), "acme": acme, "globex": globex})
+
+	if rr := tenantLogin("acme", "bob", "acme-secret"); rr.Code != http.StatusFound || rr.Header().Get("Location") != "/internal" {
+		t.Errorf("acme's bob should log in with acme's password, got %d", rr.Code)
+	}
+	if rr := tenantLogin("globex", "bob", "acme-secret"); rr.Header().Get("Location") == "/internal" {
+		t.Error("acme's password should not work for globex's bob")
+	}
+	if rr := tenantLogin("", "bob", "acme-secret"); rr.Header().Get("Location") == "/internal" {
+		t.Error("requests without a tenant should not see tenant users")
+	}
+
+	// failed logins are recorded in the tenant's own store
+	if user, _ := globex.FindUser(context.Background(), "bob"); user.FailedAttempts != 1 {
+		t.Errorf("globex should have counted the failed login, got %d", user.FailedAttempts)
+	}
+	if user, _ := acme.FindUser(context.Background(), "bob"); user.FailedAttempts != 0 {
+		t.Errorf("acme should not see globex's failed login, got %d", user.FailedAttempts)
+	}
+}
+
+func TestTenantSessionNotValidForOtherTenant(t *testing.T) {
+	useTenants(t, map[string]UserStore{
+		"":       newMemoryUserStore(),
+		"acme":   newMemoryUserStore(User{Username: "bob", Password: "secret"}),
+		"globex": newMemoryUserStore(),
+	})
+
+	rr := tenantLogin("acme", "bob", "secret")
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("login should set a session cookie")
+	}
+	internal := func(tenant string) int {
+		req := httptest.NewRequest("GET", "/internal", nil)
+		req.Header.Set(tenantHeader, tenant)
+		req.AddCookie(cookies[0])
+		rr := httptest.NewRecorder()
+		setupRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := internal("acme"); code != http.StatusOK {
+		t.Errorf("the session should be valid for acme, got %d", code)
+	}
+	if code := internal("globex"); code == http.StatusOK {
+		t.Error("an acme session should not authenticate globex requests")
+	}
+}
+
+func TestTenantsKeepCacheAndThrottleApart(t *testing.T) {
+	freshLoginThrottle(t)
+	enableUserCache(t, time.Minute)
+	useTenants(t, map[string]UserStore{
+		"":       newMemoryUserStore(),
+		"acme":   newMemoryUserStore(User{Username: "bob", Password: "acme-secret"}),
+		"globex": newMemoryUserStore(User{Username: "bob", Password: "globex-secret"}),
+	})
+
+	if rr := tenantLogin("acme", "bob", "acme-secret"); rr.Header().Get("Location") != "/internal" {
+		t.Fatalf("acme's bob should log in, got %d", rr.Code)
+	}
+	// acme's bob is cached now and must not answer for globex's bob
+	if rr := tenantLogin("globex", "bob", "acme-secret"); rr.Header().Get("Location") == "/internal" {
+		t.Error("acme's cached bob should not let acme's password into globex")
+	}
+
+	for i := 0; i < maxFailedLogins; i++ {
+		tenantLogin("acme", "bob", "wrong")
+	}
+	if rr := tenantLogin("acme", "bob", "acme-secret"); !strings.Contains(rr.Body.String(), "locked") {
+		t.Error("acme's bob should be locked out after repeated failures")
+	}
+	if rr := tenantLogin("globex", "bob", "globex-secret"); rr.Header().Get("Location") != "/internal" {
+		t.Errorf("failures in acme should not lock out globex's bob, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUnknownTenantRejected(t *testing.T) {
+	useTenants(t, map[string]UserStore{"": newMemoryUserStore(), "acme": newMemoryUserStore()})
+
+	if rr := tenantLogin("initech", "bob", "secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown tenant, got %d", rr.Code)
+	}
+}
+
+func TestRequestTenantFromSubdomain(t *testing.T) {
+	originalSource, originalDomain := tenantSource, tenantDomain
+	t.Cleanup(func() { tenantSource, tenantDomain = originalSource, originalDomain })
+	tenantSource, tenantDomain = tenantSourceSubdomain, "example.com"
+
+	for host, want := range map[string]string{
+		"acme.example.com":      "acme",
+		"ACME.example.com:8000": "acme",
+		"example.com":           "",
+		"acme.other.com":        "",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if got := requestTenant(req); got != want {
+			t.Errorf("%s: expected tenant %q, got %q", host, want, got)
+		}
+	}
+}
+
+func TestValidateTenantConfig(t *testing.T) {
+	originalSource, originalTenants, originalDomain := tenantSource, tenants, tenantDomain
+	t.Cleanup(func() { tenantSource, tenants, tenantDomain = originalSource, originalTenants, originalDomain })
+
+	testCases := []struct {
+		source  string
+		domain  string
+		tenants []string
+		valid   bool
+	}{
+		{"", "", nil, true},
+		{tenantSourceHeader, "", []string{"acme", "globex-2"}, true},
+		{tenantSourceHeader, "", nil, false},
+		{tenantSourceHeader, "", []string{"Acme"}, false},
+		{tenantSourceHeader, "", []string{"acme;drop"}, false},
+		{tenantSourceSubdomain, "", []string{"acme"}, false},
+		{tenantSourceSubdomain, "example.com", []string{"acme"}, true},
+		{"cookie", "", []string{"acme"}, false},
+	}
+	for _, tc := range testCases {
+		tenantSource, tenantDomain, tenants = tc.source, tc.domain, tc.tenants
+		if err := validateTenantConfig(); (err == nil) != tc.valid {
+			t.Errorf("source %q, domain %q, tenants %v: expected valid=%v, got %v", tc.source, tc.domain, tc.tenants, tc.valid, err)
+		}
+	}
+}
+
+// usePrepareTenantCollection replaces the tenant preparation with prepare for the test
+func usePrepareTenantCollection(t *testing.T, prepare func(tenant string) bool) {
+	original := prepareTenantCollection
+	t.Cleanup(func() { prepareTenantCollection = original })
+	prepareTenantCollection = func(_ context.Context, _ *mongo.Collection, tenant string) bool {
+		return prepare(tenant)
+	}
+}
+
+func TestTenantCollectionRetriesPreparationWithBackoff(t *testing.T) {
+	fake := useFakeClock(t)
+	base := lazyCollection(t)
+	attempts, succeed := 0, false
+	usePrepareTenantCollection(t, func(string) bool {
+		attempts++
+		return succeed
+	})
+	cache := &tenantCollectionCache{}
+
+	cache.collection(base, "acme")
+	cache.collection(base, "acme")
+	if attempts != 1 {
+		t.Fatalf("a failed preparation should not be retried right away, got %d attempts", attempts)
+	}
+	fake.Advance(tenantPrepareRetryDelay)
+	cache.collection(base, "acme")
+	if attempts != 2 {
+		t.Fatalf("the preparation should be retried after the delay, got %d attempts", attempts)
+	}
+	fake.Advance(tenantPrepareRetryDelay)
+	cache.collection(base, "acme")
+	if attempts != 2 {
+		t.Fatalf("the delay should double after another failure, got %d attempts", attempts)
+	}
+
+	succeed = true
+	fake.Advance(tenantPrepareRetryDelay)
+	cache.collection(base, "acme")
+	cache.collection(base, "acme")
+	if attempts != 3 {
+		t.Errorf("a prepared tenant should not be prepared again, got %d attempts", attempts)
+	}
+}
+
+func TestTenantCollectionPreparesOutsideTheLock(t *testing.T) {
+	base := lazyCollection(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	usePrepareTenantCollection(t, func(tenant string) bool {
+		if tenant == "slow" {
+			close(started)
+			<-release
+		}
+		return true
+	})
+	cache := &tenantCollectionCache{}
+	slowDone := make(chan struct{})
+	go func() {
+		cache.collection(base, "slow")
+		close(slowDone)
+	}()
+	defer func() {
+		close(release)
+		<-slowDone
+	}()
+	<-started
+
+	fastDone := make(chan struct{})
+	go func() {
+		cache.collection(base, "fast")
+		close(fastDone)
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("preparing one tenant should not hold up the others")
+	}
+}